@@ -0,0 +1,61 @@
+// Command migrate brings the database at DSN up to date, by applying the
+// migrations in data/migrations which it has not had yet, in order:
+//
+//	DSN=... migrate
+//	DSN=... migrate -status
+//
+// where -status only lists the migrations which are pending. A new database
+// is created from db.sql first, and then migrated.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"subscription_service/data"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+func main() {
+	status := flag.Bool("status", false, "list the pending migrations without applying them")
+	flag.Parse()
+
+	dsn := os.Getenv("DSN")
+	if dsn == "" {
+		log.Fatal("no database: set DSN")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	data.New(db)
+
+	if *status {
+		pending, err := data.PendingMigrations()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pending) == 0 {
+			fmt.Println("the database is up to date")
+		}
+		for _, version := range pending {
+			fmt.Println("pending", version)
+		}
+		return
+	}
+
+	applied, err := data.Migrate()
+	for _, version := range applied {
+		fmt.Println("applied", version)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("the database is up to date")
+	}
+}
@@ -0,0 +1,184 @@
+// Command replay sends payment provider webhooks to a running copy of the
+// application, signed the way the provider signs them, so that the payment
+// webhook receiver can be tried out locally without a real provider.
+//
+// It sends, in order, an event built from flags, events stored by the
+// application, and events read from files:
+//
+//	replay -type payment.succeeded -invoice 12
+//	DSN=... replay -event evt_123 -new-id
+//	replay testdata/refund.json -
+//
+// where - reads an event from standard input. Events keep their id, so
+// sending one twice shows how duplicates are handled, unless -new-id is given.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"subscription_service/data"
+	"subscription_service/webhooks"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+func main() {
+	target := flag.String("url", "http://localhost:8090/webhooks/payments", "where to send the events")
+	secret := flag.String("secret", firstSecret(os.Getenv("PAYMENT_WEBHOOK_SECRETS")), "secret to sign the events with")
+	header := flag.String("header", "Payment-Signature", "header to send the signature in")
+	eventID := flag.String("event", "", "id of a stored event to send again, read from the database at DSN")
+	newID := flag.Bool("new-id", false, "give every event a new id, so that none is treated as a duplicate")
+	eventType := flag.String("type", "", "type of a new event to send, e.g. payment.succeeded")
+	invoiceID := flag.Int("invoice", 0, "invoice id of the new event")
+	userID := flag.Int("user", 0, "user id of the new event")
+	amount := flag.Int("amount", 0, "amount of the new event, in cents")
+	reason := flag.String("reason", "", "reason of the new event")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("no secret: set PAYMENT_WEBHOOK_SECRETS or pass -secret")
+	}
+
+	var payloads [][]byte
+	if *eventType != "" {
+		payloads = append(payloads, newEvent(*eventType, *invoiceID, *userID, *amount, *reason))
+	}
+	if *eventID != "" {
+		payloads = append(payloads, storedEvent(*eventID))
+	}
+	for _, name := range flag.Args() {
+		payloads = append(payloads, readEvent(name))
+	}
+	if len(payloads) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, payload := range payloads {
+		if *newID {
+			payload = withNewID(payload)
+		}
+		if !send(*target, *header, *secret, payload) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// send posts one signed event, prints the response, and reports whether it was a success
+func send(target, header, secret string, payload []byte) bool {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, webhooks.Sign(secret, time.Now(), payload))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(payload, &event)
+	fmt.Printf("%s %s: %s %s\n", event.ID, event.Type, resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode >= 200 && resp.StatusCode <= 299
+}
+
+func newEvent(eventType string, invoiceID, userID, amount int, reason string) []byte {
+	payload, err := json.Marshal(map[string]any{
+		"id":         newEventID(),
+		"type":       eventType,
+		"created_at": time.Now().UTC(),
+		"data": map[string]any{
+			"invoice_id": invoiceID,
+			"user_id":    userID,
+			"amount":     amount,
+			"reason":     reason,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return payload
+}
+
+// storedEvent reads the payload of an event the application has received before
+func storedEvent(eventID string) []byte {
+	db, err := sql.Open("pgx", os.Getenv("DSN"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	models := data.New(db)
+	event, err := models.Payment.GetByEventID(eventID)
+	if err != nil {
+		log.Fatalf("unable to read event %s: %s", eventID, err)
+	}
+	return []byte(event.Payload)
+}
+
+func readEvent(name string) []byte {
+	var payload []byte
+	var err error
+	if name == "-" {
+		payload, err = io.ReadAll(os.Stdin)
+	} else {
+		payload, err = os.ReadFile(name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bytes.TrimSpace(payload)
+}
+
+// withNewID replaces the id of an event
+func withNewID(payload []byte) []byte {
+	var event map[string]any
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		log.Fatalf("not a JSON event: %s", err)
+	}
+	event["id"] = newEventID()
+	payload, err = json.Marshal(event)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return payload
+}
+
+func newEventID() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return "evt_replay_" + hex.EncodeToString(b)
+}
+
+func firstSecret(secrets string) string {
+	first, _, _ := strings.Cut(secrets, ",")
+	return strings.TrimSpace(first)
+}
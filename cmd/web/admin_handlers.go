@@ -0,0 +1,632 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription_service/data"
+	"subscription_service/forms"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const usersPerPage = 20
+
+func (app *Config) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.Models.User.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get users", http.StatusInternalServerError)
+		return
+	}
+
+	// filter by the search term, if any
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	if search != "" {
+		var filtered []*data.User
+		term := strings.ToLower(search)
+		for _, u := range users {
+			if strings.Contains(strings.ToLower(u.Email), term) ||
+				strings.Contains(strings.ToLower(u.FirstName), term) ||
+				strings.Contains(strings.ToLower(u.LastName), term) {
+				filtered = append(filtered, u)
+			}
+		}
+		users = filtered
+	}
+
+	// paginate
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	totalPages := int(math.Ceil(float64(len(users)) / float64(usersPerPage)))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+	start := (page - 1) * usersPerPage
+	end := start + usersPerPage
+	if end > len(users) {
+		end = len(users)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["users"] = users[start:end]
+
+	app.render(w, r, "admin-users.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{"q": search},
+		IntMap: map[string]int{
+			"page":       page,
+			"totalPages": totalPages,
+			"prevPage":   page - 1,
+			"nextPage":   page + 1,
+			"totalUsers": len(users),
+		},
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+
+	plans, err := app.Models.Plan.GetAllWithArchived()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get plans", http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := app.Models.Role.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get roles", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["user"] = u
+	dataMap["plans"] = plans
+	dataMap["roles"] = roles
+	if lock := app.loginLockedFor(u.Email); lock > 0 {
+		dataMap["lockedFor"] = lock.Round(time.Second).String()
+	}
+
+	// invoices are only shown to staff who are allowed to see them
+	if app.currentUser(r).HasPermission(data.PermInvoicesView) {
+		invoices, err := app.Models.Invoice.GetAllForUser(u.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			http.Error(w, "unable to get invoices", http.StatusInternalServerError)
+			return
+		}
+		dataMap["invoices"] = invoices
+	}
+
+	app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminPostUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok || !app.adminMayManage(w, r, u) {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	before := userState(u)
+	u.Email = forms.NormalizeEmail(r.Form.Get("email"))
+	u.FirstName = strings.TrimSpace(r.Form.Get("first-name"))
+	u.LastName = strings.TrimSpace(r.Form.Get("last-name"))
+	if u.Email == "" {
+		app.Session.Put(r.Context(), "error", "email is required")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	err = u.Update()
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		app.Session.Put(r.Context(), "error", "another user already has that email address")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to update the user")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+	app.auditChange(r, app.actorID(r), u.ID, "admin.user.updated", "", before, userState(u))
+	app.Session.Put(r.Context(), "flash", "user updated")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminPostUserRoles(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	roles, err := app.Models.Role.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get roles", http.StatusInternalServerError)
+		return
+	}
+
+	var roleIDs []int
+	keepsSuperAdmin := false
+	for _, role := range roles {
+		for _, id := range r.Form["role"] {
+			if id == strconv.Itoa(role.ID) {
+				roleIDs = append(roleIDs, role.ID)
+				if role.Name == data.RoleSuperAdmin {
+					keepsSuperAdmin = true
+				}
+			}
+		}
+	}
+
+	// stop superadmins from locking themselves out
+	if u.ID == app.Session.GetInt(r.Context(), "userID") && u.HasRole(data.RoleSuperAdmin) && !keepsSuperAdmin {
+		app.Session.Put(r.Context(), "error", "you cannot remove your own superadmin role")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	before := userState(u)
+	err = app.Models.Role.SetUserRoles(u.ID, roleIDs)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to update roles")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+	if updated, err := app.Models.User.GetOne(u.ID); err == nil {
+		app.auditChange(r, app.actorID(r), u.ID, "admin.user.roles_changed", "", before, userState(updated))
+	}
+	app.Session.Put(r.Context(), "flash", "roles updated")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminToggleUserActive(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok || !app.adminMayManage(w, r, u) {
+		return
+	}
+	if u.ID == app.Session.GetInt(r.Context(), "userID") {
+		app.Session.Put(r.Context(), "error", "you cannot deactivate your own account")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	before := userState(u)
+	if u.Active == 1 {
+		u.Active = 0
+	} else {
+		u.Active = 1
+	}
+	err := u.Update()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to update the user")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+	if u.Active == 1 {
+		app.auditChange(r, app.actorID(r), u.ID, "admin.user.activated", "", before, userState(u))
+		app.Session.Put(r.Context(), "flash", "user activated")
+	} else {
+		app.auditChange(r, app.actorID(r), u.ID, "admin.user.deactivated", "", before, userState(u))
+		app.Session.Put(r.Context(), "flash", "user deactivated")
+	}
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.clearLoginFailures(u.Email)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to unlock the user")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), u.ID, "admin.user.unlocked", "")
+	app.Session.Put(r.Context(), "flash", "user unlocked")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok || !app.adminMayManage(w, r, u) {
+		return
+	}
+	if u.ID == app.Session.GetInt(r.Context(), "userID") {
+		app.Session.Put(r.Context(), "error", "you cannot delete your own account")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := u.Delete()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to delete the user")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+	app.auditChange(r, app.actorID(r), u.ID, "admin.user.deleted", "", userState(u), nil)
+	app.Session.Put(r.Context(), "flash", "user deleted")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *Config) AdminPostUserSubscription(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	before := userState(u)
+
+	// a plan id of 0 cancels the subscription
+	planID, _ := strconv.Atoi(r.Form.Get("plan-id"))
+	if planID == 0 {
+		err = app.Models.Plan.CancelUserPlan(*u)
+	} else {
+		var plan *data.Plan
+		plan, err = app.Models.Plan.GetOne(planID)
+		if err == nil {
+			err = app.Models.Plan.SubscribeUserToPlan(*u, *plan)
+		}
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to change the subscription")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+	if updated, err := app.Models.User.GetOne(u.ID); err == nil {
+		app.auditChange(r, app.actorID(r), u.ID, "admin.subscription.changed", "", before, userState(updated))
+	}
+	app.Session.Put(r.Context(), "flash", "subscription updated")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminPostInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	u, invoice, ok := app.adminGetInvoice(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	status := r.Form.Get("status")
+	switch status {
+	case data.InvoicePending, data.InvoicePaid, data.InvoiceVoid:
+	default:
+		app.Session.Put(r.Context(), "error", "invalid invoice status")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	before := map[string]any{"status": invoice.Status}
+	err = invoice.UpdateStatus(status)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to update the invoice")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.auditChange(r, app.actorID(r), u.ID, "admin.invoice.status_changed", fmt.Sprintf("invoice %d", invoice.ID),
+		before, map[string]any{"status": invoice.Status})
+	app.Session.Put(r.Context(), "flash", "invoice updated")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminRefundInvoice(w http.ResponseWriter, r *http.Request) {
+	u, invoice, ok := app.adminGetInvoice(w, r)
+	if !ok {
+		return
+	}
+	if invoice.Status != data.InvoicePaid {
+		app.Session.Put(r.Context(), "error", "only paid invoices can be refunded")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := invoice.UpdateStatus(data.InvoiceRefunded)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to refund the invoice")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return
+	}
+	app.auditChange(r, app.actorID(r), u.ID, "admin.invoice.refunded", fmt.Sprintf("invoice %d", invoice.ID),
+		map[string]any{"status": data.InvoicePaid}, map[string]any{"status": invoice.Status})
+	app.Session.Put(r.Context(), "flash", "invoice refunded")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.Models.Plan.GetAllWithArchived()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get plans", http.StatusInternalServerError)
+		return
+	}
+	dataMap := make(map[string]any)
+	dataMap["plans"] = plans
+
+	app.render(w, r, "admin-plans.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminPlan(w http.ResponseWriter, r *http.Request) {
+	plan := &data.Plan{}
+	if id := chi.URLParam(r, "id"); id != "" {
+		planID, _ := strconv.Atoi(id)
+		p, err := app.Models.Plan.GetOne(planID)
+		if err != nil {
+			app.Session.Put(r.Context(), "error", "plan not found")
+			http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+			return
+		}
+		plan = p
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plan"] = plan
+
+	app.render(w, r, "admin-plan.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{"amount": fmt.Sprintf("%.2f", float64(plan.PlanAmount)/100.0)},
+		Data:       dataMap,
+	})
+}
+
+func (app *Config) AdminPostPlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	plan := &data.Plan{}
+	if id := chi.URLParam(r, "id"); id != "" {
+		planID, _ := strconv.Atoi(id)
+		p, err := app.Models.Plan.GetOne(planID)
+		if err != nil {
+			app.Session.Put(r.Context(), "error", "plan not found")
+			http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+			return
+		}
+		plan = p
+	}
+
+	var before map[string]any
+	if plan.ID != 0 {
+		before = planState(plan)
+	}
+
+	name := strings.TrimSpace(r.Form.Get("plan-name"))
+	amount, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(r.Form.Get("plan-amount")), "$"), 64)
+	if name == "" || err != nil || amount < 0 {
+		app.Session.Put(r.Context(), "error", "a plan needs a name and a valid amount")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	trialDays := 0
+	if s := strings.TrimSpace(r.Form.Get("plan-trial-days")); s != "" {
+		trialDays, err = strconv.Atoi(s)
+		if err != nil || trialDays < 0 {
+			app.Session.Put(r.Context(), "error", "the trial must be a number of days")
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+	plan.PlanName = name
+	plan.PlanAmount = int(math.Round(amount * 100))
+	plan.TrialDays = trialDays
+
+	if plan.ID == 0 {
+		plan.ID, err = app.Models.Plan.Insert(*plan)
+	} else {
+		err = plan.Update()
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to save the plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+	action := "admin.plan.updated"
+	if before == nil {
+		action = "admin.plan.created"
+	}
+	app.auditChange(r, app.actorID(r), 0, action, fmt.Sprintf("plan %d", plan.ID), before, planState(plan))
+	app.Session.Put(r.Context(), "flash", "plan saved")
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+func (app *Config) AdminToggleArchivePlan(w http.ResponseWriter, r *http.Request) {
+	planID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "plan not found")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	before := planState(plan)
+	if plan.Archived == 1 {
+		plan.Archived = 0
+	} else {
+		plan.Archived = 1
+	}
+	err = plan.Update()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to update the plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+	if plan.Archived == 1 {
+		app.auditChange(r, app.actorID(r), 0, "admin.plan.archived", fmt.Sprintf("plan %d", plan.ID), before, planState(plan))
+		app.Session.Put(r.Context(), "flash", "plan archived")
+	} else {
+		app.auditChange(r, app.actorID(r), 0, "admin.plan.restored", fmt.Sprintf("plan %d", plan.ID), before, planState(plan))
+		app.Session.Put(r.Context(), "flash", "plan restored")
+	}
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+const auditEventsPerPage = 50
+
+func (app *Config) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := data.AuditFilter{
+		Action: strings.TrimSpace(q.Get("action")),
+		Limit:  auditEventsPerPage + 1,
+	}
+	filter.ActorID, _ = strconv.Atoi(q.Get("actor"))
+	filter.TargetID, _ = strconv.Atoi(q.Get("target"))
+	if from, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+		filter.From = from
+	}
+	if to, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+		// include the whole of the last day
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter.Offset = (page - 1) * auditEventsPerPage
+
+	events, err := app.Models.Audit.GetAll(filter)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get audit events", http.StatusInternalServerError)
+		return
+	}
+	// one more event than needed was fetched to find out if there is a next page
+	hasNext := len(events) > auditEventsPerPage
+	if hasNext {
+		events = events[:auditEventsPerPage]
+	}
+
+	// the query string without the page, for building pagination links
+	q.Del("page")
+
+	dataMap := make(map[string]any)
+	dataMap["events"] = events
+	dataMap["query"] = template.URL(q.Encode())
+
+	app.render(w, r, "admin-audit.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{
+			"actor":  q.Get("actor"),
+			"target": q.Get("target"),
+			"action": q.Get("action"),
+			"from":   q.Get("from"),
+			"to":     q.Get("to"),
+		},
+		IntMap: map[string]int{
+			"page":     page,
+			"prevPage": page - 1,
+			"nextPage": page + 1,
+			"hasNext":  map[bool]int{true: 1}[hasNext],
+		},
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	brokenID, err := app.Models.Audit.Verify()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to verify the audit log")
+	} else if brokenID != 0 {
+		app.ErrorLog.Printf("audit log hash chain is broken at event %d", brokenID)
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("the audit log has been tampered with, starting at event %d", brokenID))
+	} else {
+		app.Session.Put(r.Context(), "flash", "the audit log is intact")
+	}
+	http.Redirect(w, r, "/admin/audit", http.StatusSeeOther)
+}
+
+// adminGetUser loads the user named by the id url parameter, redirecting back
+// to the user list if there is no such user
+func (app *Config) adminGetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	u, err := app.Models.User.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "user not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+	return u, true
+}
+
+// adminMayManage refuses, and redirects back to the user, when the current
+// user may not change the account of u, because u is staff who outrank them
+func (app *Config) adminMayManage(w http.ResponseWriter, r *http.Request, u *data.User) bool {
+	if app.currentUser(r).CanManage(u) {
+		return true
+	}
+	app.Session.Put(r.Context(), "error", "you cannot change the account of staff with permissions you do not have")
+	http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+	return false
+}
+
+// adminGetInvoice loads the user named by the id url parameter and their invoice
+// named by the invoiceID url parameter
+func (app *Config) adminGetInvoice(w http.ResponseWriter, r *http.Request) (*data.User, *data.Invoice, bool) {
+	u, ok := app.adminGetUser(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	invoiceID, _ := strconv.Atoi(chi.URLParam(r, "invoiceID"))
+	invoice, err := app.Models.Invoice.GetOne(invoiceID)
+	if err != nil || invoice.UserID != u.ID {
+		app.Session.Put(r.Context(), "error", "invoice not found")
+		http.Redirect(w, r, app.adminUserURL(u.ID), http.StatusSeeOther)
+		return nil, nil, false
+	}
+	return u, invoice, true
+}
+
+func (app *Config) adminUserURL(id int) string {
+	return fmt.Sprintf("/admin/users/%d", id)
+}
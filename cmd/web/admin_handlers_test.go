@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+
+	"subscription_service/data"
+)
+
+func TestAdminMayManage(t *testing.T) {
+	app := &Config{Session: scs.New()}
+	manager := &data.User{ID: 1, Roles: []*data.Role{{Name: "manager", Permissions: []string{data.PermUsersView, data.PermUsersManage}}}}
+	superadmin := &data.User{ID: 2, Roles: []*data.Role{{Name: data.RoleSuperAdmin, Permissions: []string{data.PermUsersManage, data.PermRolesManage}}}}
+	customer := &data.User{ID: 3}
+
+	tests := []struct {
+		name   string
+		actor  *data.User
+		target *data.User
+		want   bool
+	}{
+		{"manager changes a customer", manager, customer, true},
+		{"manager changes a superadmin", manager, superadmin, false},
+		{"superadmin changes a manager", superadmin, manager, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/admin/users/toggle-active", nil)
+			ctx, err := app.Session.Load(r.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(context.WithValue(ctx, contextUserKey, tt.actor))
+			w := httptest.NewRecorder()
+
+			if got := app.adminMayManage(w, r, tt.target); got != tt.want {
+				t.Fatalf("got %t, want %t", got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != app.adminUserURL(tt.target.ID) {
+				t.Errorf("got %d to %q, want a redirect back to the user", w.Code, w.Header().Get("Location"))
+			}
+			if app.Session.GetString(r.Context(), "error") == "" {
+				t.Error("no error was put in the session")
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription_service/data"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const contextAPITokenKey contextKey = "apiToken"
+
+const (
+	// apiDefaultPerPage and apiMaxPerPage bound the per_page parameter of list endpoints
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+	// apiMaxBodyBytes is the largest request body the API reads
+	apiMaxBodyBytes = 1 << 20
+)
+
+// apiError is the body of every error response from the API
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiData wraps the body of every successful response from the API
+type apiData struct {
+	Data any `json:"data"`
+}
+
+// apiList wraps the body of a response with one page of a list
+type apiList struct {
+	Data any     `json:"data"`
+	Meta apiMeta `json:"meta"`
+}
+
+// apiMeta describes which page of a list a response holds
+type apiMeta struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// apiPlan is how the API shows a plan
+type apiPlan struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	Amount          int    `json:"amount"`
+	AmountFormatted string `json:"amount_formatted"`
+}
+
+// apiSubscription is how the API shows the subscription of a user
+type apiSubscription struct {
+	Active bool     `json:"active"`
+	Plan   *apiPlan `json:"plan"`
+}
+
+// apiSubscriptionRequest is the body of a request to subscribe to a plan
+type apiSubscriptionRequest struct {
+	PlanID int `json:"plan_id"`
+}
+
+// apiInvoice is how the API shows an invoice
+type apiInvoice struct {
+	ID              int       `json:"id"`
+	PlanID          int       `json:"plan_id"`
+	PlanName        string    `json:"plan_name"`
+	Amount          int       `json:"amount"`
+	AmountFormatted string    `json:"amount_formatted"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (app *Config) apiRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.APIContentNegotiation)
+
+	mux.Get(openAPIPath, app.OpenAPISpec)
+
+	mux.Route("/v1", func(mux chi.Router) {
+		mux.Use(app.APIAuth)
+		mux.With(app.RequireScope(data.ScopePlansRead)).Get("/plans", app.APIListPlans)
+		mux.With(app.RequireScope(data.ScopeSubscriptionsRead)).Get("/subscription", app.APIGetSubscription)
+		mux.With(app.RequireScope(data.ScopeSubscriptionsWrite), app.Idempotent).Put("/subscription", app.APIPutSubscription)
+		mux.With(app.RequireScope(data.ScopeSubscriptionsWrite), app.Idempotent).Delete("/subscription", app.APIDeleteSubscription)
+		mux.With(app.RequireScope(data.ScopeInvoicesRead)).Get("/invoices", app.APIListInvoices)
+	})
+
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		app.errorJSON(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	mux.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		app.errorJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not allowed here")
+	})
+	return mux
+}
+
+// APIContentNegotiation makes sure API clients can accept JSON, which is all
+// the API speaks, and that request bodies are JSON
+func (app *Config) APIContentNegotiation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept")
+		if !acceptsJSON(r.Header.Get("Accept")) {
+			app.errorJSON(w, http.StatusNotAcceptable, "not_acceptable", "the API only responds with application/json")
+			return
+		}
+		if r.ContentLength != 0 && r.Header.Get("Content-Type") != "" {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				app.errorJSON(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "request bodies must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIAuth authenticates requests to the API, either with a personal API token
+// sent as "Authorization: Bearer <token>", or with the browser session. A
+// token takes precedence over the session.
+func (app *Config) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			if !app.IsAuthenticated(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				app.errorJSON(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+				return
+			}
+			// browser clients need the csrf token to send with requests which change anything
+			w.Header().Set(csrfHeader, app.csrfToken(r))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		plainText, ok := bearerToken(header)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.errorJSON(w, http.StatusUnauthorized, "unauthorized", "the Authorization header must be in the form \"Bearer <token>\"")
+			return
+		}
+		token, err := app.Models.APIToken.GetValid(plainText)
+		if err != nil {
+			if !errors.Is(err, data.ErrTokenInvalid) {
+				app.ErrorLog.Println(err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			app.errorJSON(w, http.StatusUnauthorized, "invalid_token", "the API token is invalid or has expired")
+			return
+		}
+		user, err := app.loadUser(token.UserID)
+		if err != nil || user.Active != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			app.errorJSON(w, http.StatusUnauthorized, "invalid_token", "the API token is invalid or has expired")
+			return
+		}
+
+		err = token.Touch()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+
+		ctx := context.WithValue(r.Context(), contextUserKey, user)
+		ctx = context.WithValue(ctx, contextAPITokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope only lets requests authenticated with an API token through if
+// the token grants scope. Requests authenticated by the browser session can
+// do anything the user can. It must be used after APIAuth.
+func (app *Config) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token, ok := r.Context().Value(contextAPITokenKey).(*data.APIToken); ok && !token.HasScope(scope) {
+				app.errorJSON(w, http.StatusForbidden, "insufficient_scope", "the API token does not have the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (app *Config) APIListPlans(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := app.pageParams(w, r)
+	if !ok {
+		return
+	}
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to get plans")
+		return
+	}
+
+	result := []*apiPlan{}
+	for _, p := range paginate(plans, page, perPage) {
+		result = append(result, planForAPI(p))
+	}
+	app.writeJSON(w, http.StatusOK, apiList{Data: result, Meta: pageMeta(len(plans), page, perPage)})
+}
+
+func (app *Config) APIGetSubscription(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, apiData{Data: subscriptionForAPI(app.currentUser(r))})
+}
+
+// APIPutSubscription subscribes the user to a plan, or changes their plan
+func (app *Config) APIPutSubscription(w http.ResponseWriter, r *http.Request) {
+	var req apiSubscriptionRequest
+	if !app.readJSON(w, r, &req) {
+		return
+	}
+	if req.PlanID <= 0 {
+		app.errorJSON(w, http.StatusBadRequest, "invalid_request", "plan_id is required")
+		return
+	}
+
+	u, err := app.subscribeUser(r, *app.currentUser(r), req.PlanID)
+	if errors.Is(err, errPlanUnavailable) {
+		app.errorJSON(w, http.StatusUnprocessableEntity, "plan_unavailable", "that plan does not exist or is no longer available")
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to subscribe to the plan")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, apiData{Data: subscriptionForAPI(u)})
+}
+
+// APIDeleteSubscription cancels the subscription of the user
+func (app *Config) APIDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	u, err := app.cancelSubscription(r, *app.currentUser(r))
+	if errors.Is(err, errNoSubscription) {
+		app.errorJSON(w, http.StatusNotFound, "not_found", "you do not have a subscription")
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to cancel the subscription")
+		return
+	}
+	app.writeJSON(w, http.StatusOK, apiData{Data: subscriptionForAPI(u)})
+}
+
+func (app *Config) APIListInvoices(w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := app.pageParams(w, r)
+	if !ok {
+		return
+	}
+	invoices, err := app.Models.Invoice.GetAllForUser(app.currentUser(r).ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to get invoices")
+		return
+	}
+
+	result := []*apiInvoice{}
+	for _, i := range paginate(invoices, page, perPage) {
+		result = append(result, invoiceForAPI(i))
+	}
+	app.writeJSON(w, http.StatusOK, apiList{Data: result, Meta: pageMeta(len(invoices), page, perPage)})
+}
+
+func subscriptionForAPI(u *data.User) apiSubscription {
+	if u.Plan == nil {
+		return apiSubscription{}
+	}
+	return apiSubscription{
+		Active: true,
+		Plan:   planForAPI(u.Plan),
+	}
+}
+
+func planForAPI(p *data.Plan) *apiPlan {
+	return &apiPlan{
+		ID:              p.ID,
+		Name:            p.PlanName,
+		Amount:          p.PlanAmount,
+		AmountFormatted: p.AmountForDisplay(),
+	}
+}
+
+func invoiceForAPI(i *data.Invoice) *apiInvoice {
+	return &apiInvoice{
+		ID:              i.ID,
+		PlanID:          i.PlanID,
+		PlanName:        i.PlanName,
+		Amount:          i.Amount,
+		AmountFormatted: i.AmountFormatted,
+		Status:          i.Status,
+		CreatedAt:       i.CreatedAt,
+	}
+}
+
+// writeJSON writes v as the JSON body of a response
+func (app *Config) writeJSON(w http.ResponseWriter, status int, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		status = http.StatusInternalServerError
+		out = []byte(`{"error":{"code":"internal_error","message":"internal error"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// errorJSON writes an error response in the standard API error envelope
+func (app *Config) errorJSON(w http.ResponseWriter, status int, code, message string) {
+	app.writeJSON(w, status, apiError{Error: apiErrorDetail{Code: code, Message: message}})
+}
+
+// readJSON decodes the JSON body of a request into dst. If it can't, it
+// writes an error response and returns false.
+func (app *Config) readJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodyBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must hold a single JSON object")
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("body must not be empty")
+		}
+		app.errorJSON(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return false
+	}
+	return true
+}
+
+// pageParams reads the page and per_page parameters of a list request. If
+// they are not valid, it writes an error response and returns false.
+func (app *Config) pageParams(w http.ResponseWriter, r *http.Request) (page, perPage int, ok bool) {
+	page, perPage = 1, apiDefaultPerPage
+	q := r.URL.Query()
+	var err error
+	if v := q.Get("page"); v != "" {
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			app.errorJSON(w, http.StatusBadRequest, "invalid_request", "page must be a positive number")
+			return 0, 0, false
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > apiMaxPerPage {
+			app.errorJSON(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("per_page must be between 1 and %d", apiMaxPerPage))
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
+
+// paginate returns one page of items
+func paginate[T any](items []T, page, perPage int) []T {
+	start := (page - 1) * perPage
+	if start >= len(items) {
+		return nil
+	}
+	end := start + perPage
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
+
+func pageMeta(total, page, perPage int) apiMeta {
+	return apiMeta{
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+}
+
+// acceptsJSON reports whether an Accept header allows a JSON response. A
+// missing header accepts anything.
+func acceptsJSON(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token from an Authorization header using the Bearer scheme
+func bearerToken(header string) (string, bool) {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
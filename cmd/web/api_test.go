@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+
+	"subscription_service/data"
+)
+
+func TestAPIAuth(t *testing.T) {
+	tokens := newFakeAPITokenDB()
+	tokens.add("ss_valid", 1, sql.NullTime{})
+	tokens.add("ss_inactive", 2, sql.NullTime{})
+
+	app := &Config{
+		Session:   scs.New(),
+		ErrorLog:  log.New(io.Discard, "", 0),
+		Models:    data.New(tokens.open(t)),
+		UserCache: newUserCache(time.Hour),
+	}
+	app.UserCache.put(&data.User{ID: 1, Active: 1})
+	app.UserCache.put(&data.User{ID: 2, Active: 0})
+
+	tests := []struct {
+		name      string
+		header    string
+		loggedIn  bool
+		wantAllow bool
+		wantCode  string
+	}{
+		{name: "no token or session", wantCode: "unauthorized"},
+		{name: "session", loggedIn: true, wantAllow: true},
+		{name: "token", header: "Bearer ss_valid", wantAllow: true},
+		{name: "token takes precedence over the session", header: "Bearer ss_wrong", loggedIn: true, wantCode: "invalid_token"},
+		{name: "another scheme", header: "Basic c3NfdmFsaWQ=", wantCode: "unauthorized"},
+		{name: "empty token", header: "Bearer ", wantCode: "unauthorized"},
+		{name: "not an API token", header: "Bearer abc", wantCode: "invalid_token"},
+		{name: "wrong or revoked token", header: "Bearer ss_wrong", wantCode: "invalid_token"},
+		{name: "token of a deactivated user", header: "Bearer ss_inactive", wantCode: "invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user *data.User
+			var token *data.APIToken
+			handler := app.APIAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user = app.currentUser(r)
+				token, _ = r.Context().Value(contextAPITokenKey).(*data.APIToken)
+			}))
+
+			r := httptest.NewRequest("GET", "/api/v1/subscription", nil)
+			ctx, err := app.Session.Load(r.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(ctx)
+			if tt.loggedIn {
+				app.Session.Put(r.Context(), "userID", 1)
+			}
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if tt.wantAllow != (user != nil) {
+				t.Fatalf("allowed is %t, want %t", user != nil, tt.wantAllow)
+			}
+			if !tt.wantAllow {
+				var body apiError
+				_ = json.Unmarshal(w.Body.Bytes(), &body)
+				if w.Code != http.StatusUnauthorized || body.Error.Code != tt.wantCode {
+					t.Errorf("got %d %q, want 401 %q", w.Code, body.Error.Code, tt.wantCode)
+				}
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("no WWW-Authenticate header")
+				}
+				return
+			}
+
+			// browser clients are given the csrf token, but token clients don't need one
+			csrf := w.Header().Get(csrfHeader)
+			if tt.loggedIn && (csrf == "" || csrf != app.Session.GetString(r.Context(), csrfSessionKey)) {
+				t.Errorf("got csrf header %q, want the session's token", csrf)
+			}
+			if !tt.loggedIn && csrf != "" {
+				t.Errorf("got csrf header %q for a token", csrf)
+			}
+			if !tt.loggedIn && (token == nil || user.ID != 1) {
+				t.Errorf("the token and its user were not put in the context")
+			}
+		})
+	}
+}
+
+func TestAPITokenTouch(t *testing.T) {
+	tokens := newFakeAPITokenDB()
+	data.New(tokens.open(t))
+
+	tests := []struct {
+		name      string
+		lastUsed  sql.NullTime
+		wantWrite bool
+	}{
+		{"never used", sql.NullTime{}, true},
+		{"used just now", sql.NullTime{Time: time.Now().Add(-10 * time.Second), Valid: true}, false},
+		{"used a while ago", sql.NullTime{Time: time.Now().Add(-2 * time.Minute), Valid: true}, true},
+	}
+	for _, tt := range tests {
+		before := tokens.writes()
+		token := &data.APIToken{ID: 1, LastUsedAt: tt.lastUsed}
+		if err := token.Touch(); err != nil {
+			t.Fatal(err)
+		}
+		if wrote := tokens.writes() > before; wrote != tt.wantWrite {
+			t.Errorf("%s: wrote is %t, want %t", tt.name, wrote, tt.wantWrite)
+		}
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	app := &Config{ErrorLog: log.New(io.Discard, "", 0)}
+
+	tests := []struct {
+		query       string
+		wantOK      bool
+		wantPage    int
+		wantPerPage int
+	}{
+		{"", true, 1, apiDefaultPerPage},
+		{"page=3&per_page=5", true, 3, 5},
+		{"per_page=1", true, 1, 1},
+		{"per_page=100", true, 1, apiMaxPerPage},
+		{"per_page=101", false, 0, 0},
+		{"per_page=0", false, 0, 0},
+		{"page=0", false, 0, 0},
+		{"page=-1", false, 0, 0},
+		{"page=two", false, 0, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/plans?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		page, perPage, ok := app.pageParams(w, r)
+		if ok != tt.wantOK || page != tt.wantPage || perPage != tt.wantPerPage {
+			t.Errorf("%q: got %d, %d, %t, want %d, %d, %t", tt.query, page, perPage, ok, tt.wantPage, tt.wantPerPage, tt.wantOK)
+		}
+		if !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want 400", tt.query, w.Code)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+
+	tests := []struct {
+		name          string
+		page, perPage int
+		want          []int
+		wantPages     int
+	}{
+		{"first page", 1, 2, []int{1, 2}, 3},
+		{"last page is short", 3, 2, []int{5}, 3},
+		{"past the end", 4, 2, nil, 3},
+		{"pages fit exactly", 1, 5, []int{1, 2, 3, 4, 5}, 1},
+		{"one per page", 5, 1, []int{5}, 5},
+	}
+	for _, tt := range tests {
+		got := paginate(items, tt.page, tt.perPage)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		if meta := pageMeta(len(items), tt.page, tt.perPage); meta.TotalPages != tt.wantPages {
+			t.Errorf("%s: got %d pages, want %d", tt.name, meta.TotalPages, tt.wantPages)
+		}
+	}
+	if meta := pageMeta(0, 1, apiDefaultPerPage); meta.TotalPages != 0 {
+		t.Errorf("an empty list has %d pages, want 0", meta.TotalPages)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		{"Bearer ss_abc", "ss_abc", true},
+		{"bearer ss_abc", "ss_abc", true},
+		{"Bearer  ss_abc ", "ss_abc", true},
+		{"Bearer", "", false},
+		{"Bearer ", "", false},
+		{"Basic ss_abc", "", false},
+		{"ss_abc", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := bearerToken(tt.header)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("bearerToken(%q) = %q, %t, want %q, %t", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", true},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"*/*", true},
+		{"application/*", true},
+		{"text/html, application/json;q=0.9", true},
+		{"text/html", false},
+		{"application/xml", false},
+		{"application/json;q=0", false},
+		{"not a media type", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsJSON(tt.accept); got != tt.want {
+			t.Errorf("acceptsJSON(%q) = %t, want %t", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// fakeAPITokenDB is a database/sql driver which understands just enough of
+// the api_tokens queries to test API authentication without postgres
+type fakeAPITokenDB struct {
+	mu      sync.Mutex
+	tokens  map[string][]driver.Value
+	touches int
+}
+
+var registerFakeAPITokenDB sync.Once
+
+// fakeAPITokenDBs holds the databases opened by tests, by name
+var fakeAPITokenDBs sync.Map
+
+func newFakeAPITokenDB() *fakeAPITokenDB {
+	return &fakeAPITokenDB{tokens: make(map[string][]driver.Value)}
+}
+
+// add stores a token for a user, as the row scanned by data.APIToken
+func (f *fakeAPITokenDB) add(plainText string, userID int, lastUsed sql.NullTime) {
+	hash := sha256.Sum256([]byte(plainText))
+	var lastUsedAt driver.Value
+	if lastUsed.Valid {
+		lastUsedAt = lastUsed.Time
+	}
+	f.tokens[hex.EncodeToString(hash[:])] = []driver.Value{
+		int64(len(f.tokens) + 1), int64(userID), "test", plainText[:6], hex.EncodeToString(hash[:]),
+		strings.Join(data.AllScopes, ","), time.Now().Add(time.Hour), lastUsedAt, time.Now(),
+	}
+}
+
+func (f *fakeAPITokenDB) writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.touches
+}
+
+func (f *fakeAPITokenDB) open(t *testing.T) *sql.DB {
+	registerFakeAPITokenDB.Do(func() { sql.Register("fakeapitokens", fakeAPITokenDriver{}) })
+	fakeAPITokenDBs.Store(t.Name(), f)
+	db, err := sql.Open("fakeapitokens", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+		fakeAPITokenDBs.Delete(t.Name())
+	})
+	return db
+}
+
+type fakeAPITokenDriver struct{}
+
+func (fakeAPITokenDriver) Open(name string) (driver.Conn, error) {
+	f, ok := fakeAPITokenDBs.Load(name)
+	if !ok {
+		return nil, errors.New("no such database " + name)
+	}
+	return f.(*fakeAPITokenDB), nil
+}
+
+func (f *fakeAPITokenDB) Prepare(query string) (driver.Stmt, error) {
+	return fakeAPITokenStmt{db: f, query: query}, nil
+}
+
+func (f *fakeAPITokenDB) Close() error { return nil }
+func (f *fakeAPITokenDB) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeAPITokenStmt struct {
+	db    *fakeAPITokenDB
+	query string
+}
+
+func (s fakeAPITokenStmt) Close() error  { return nil }
+func (s fakeAPITokenStmt) NumInput() int { return -1 }
+
+func (s fakeAPITokenStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(s.query, "update api_tokens set last_used_at") {
+		return nil, errors.New("unexpected statement " + s.query)
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.touches++
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeAPITokenStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.Contains(s.query, "where token_hash = $1") {
+		return nil, errors.New("unexpected query " + s.query)
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	rows := &fakeAPITokenRows{}
+	if row, ok := s.db.tokens[args[0].(string)]; ok {
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+type fakeAPITokenRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeAPITokenRows) Columns() []string {
+	return []string{"id", "user_id", "name", "prefix", "token_hash", "scopes", "expires_at", "last_used_at", "created_at"}
+}
+
+func (r *fakeAPITokenRows) Close() error { return nil }
+
+func (r *fakeAPITokenRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
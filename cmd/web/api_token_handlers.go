@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription_service/data"
+	"time"
+)
+
+// apiTokenLifetimes are the choices of how long a new API token lasts, in days
+var apiTokenLifetimes = []int{7, 30, 90, 365}
+
+// maxAPITokens is how many API tokens one user may have at a time
+const maxAPITokens = 20
+
+func (app *Config) APITokensPage(w http.ResponseWriter, r *http.Request) {
+	app.renderAPITokens(w, r, "")
+}
+
+func (app *Config) PostCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	// a token would let whoever holds it act as the user long after the impersonation ends
+	if app.IsImpersonating(r) {
+		app.audit(r, app.actorID(r), user.ID, "impersonation.blocked", "API token creation")
+		app.Session.Put(r.Context(), "warning", "API tokens can't be created while impersonating a user")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > 100 {
+		app.Session.Put(r.Context(), "error", "give the token a name of up to 100 characters")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	var scopes []string
+	for _, s := range data.AllScopes {
+		for _, chosen := range r.Form["scopes"] {
+			if chosen == s {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		app.Session.Put(r.Context(), "error", "choose at least one scope")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.Form.Get("days"))
+	valid := false
+	for _, d := range apiTokenLifetimes {
+		if d == days {
+			valid = true
+		}
+	}
+	if !valid {
+		app.Session.Put(r.Context(), "error", "choose how long the token lasts")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	existing, err := app.Models.APIToken.GetAllForUser(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if len(existing) >= maxAPITokens {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("you can have at most %d API tokens. revoke one you no longer use first.", maxAPITokens))
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+
+	plainText, err := app.Models.APIToken.New(user.ID, name, scopes, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to create the token")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), user.ID, "api_token.created", fmt.Sprintf("%s (%s)", name, strings.Join(scopes, ", ")))
+
+	// the token is shown this one time only, so render it rather than redirecting
+	app.Session.Put(r.Context(), "flash", "token created. copy it now, it will not be shown again.")
+	app.renderAPITokens(w, r, plainText)
+}
+
+func (app *Config) PostRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	id, _ := strconv.Atoi(r.PostFormValue("id"))
+
+	err := app.Models.APIToken.Revoke(user.ID, id)
+	if err != nil {
+		if !errors.Is(err, data.ErrTokenInvalid) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "unable to revoke the token")
+		http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), user.ID, "api_token.revoked", strconv.Itoa(id))
+	app.Session.Put(r.Context(), "flash", "token revoked")
+	http.Redirect(w, r, "/members/api-tokens", http.StatusSeeOther)
+}
+
+func (app *Config) renderAPITokens(w http.ResponseWriter, r *http.Request, newToken string) {
+	tokens, err := app.Models.APIToken.GetAllForUser(app.currentUser(r).ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get API tokens", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["tokens"] = tokens
+	dataMap["scopes"] = data.AllScopes
+	dataMap["lifetimes"] = apiTokenLifetimes
+	app.render(w, r, "api-tokens.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{"newToken": newToken},
+		Data:       dataMap,
+	})
+}
@@ -3,21 +3,42 @@ package main
 import (
 	"database/sql"
 	"log"
+	"net"
+	"net/http"
 	"sync"
+	"time"
 
 	"subscription_service/data"
+	"subscription_service/events"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
 )
 
 type Config struct {
 	Session       *scs.SessionManager
 	DB            *sql.DB
+	Redis         *redis.Pool
 	InfoLog       *log.Logger
 	ErrorLog      *log.Logger
 	Wait          *sync.WaitGroup
 	Models        data.Models
+	Events        *events.Bus
 	Mailer        Mail
+	URLs          *URLBuilder
 	ErrorChan     chan error
 	ErrorChanDone chan bool
+	ActivationTTL time.Duration
+	UserCache     *userCache
+	WebhookClient *http.Client
+	WebhookDone   chan bool
+	OutboxDone    chan bool
+	JobsDone      chan bool
+	SchedulerDone chan bool
+	// InstanceID tells this instance of the application apart from any others running scheduled tasks
+	InstanceID string
+	// PaymentWebhookSecrets are the secrets webhooks from the payment provider may be signed with
+	PaymentWebhookSecrets []string
+	// TrustedProxies are the proxies in front of the application, whose X-Forwarded-For headers are believed
+	TrustedProxies []*net.IPNet
 }
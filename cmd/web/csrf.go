@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfSessionKey is where the session keeps its csrf token
+	csrfSessionKey = "csrfToken"
+	// csrfFormField and csrfHeader are where a request may carry the token
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// CSRF rejects any request which may change state unless it carries the csrf
+// token of its session, either as the csrf_token form field or in the
+// X-CSRF-Token header. Every form which posts back to the site must include
+// the token, which render makes available to templates as .CSRFToken. API
+// clients using a token in the Authorization header do not need one, and
+// neither do the webhook receivers under /webhooks/, which check signatures.
+func (app *Config) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers never send an Authorization header to another site without its
+		// consent, so requests carrying an API token cannot be forged this way
+		if _, ok := bearerToken(r.Header.Get("Authorization")); ok || !isDestructive(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// webhooks come from servers, not browsers, and carry a signature instead
+		if strings.HasPrefix(r.URL.Path, "/webhooks/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.PostFormValue(csrfFormField)
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			app.ErrorLog.Printf("csrf token missing or invalid: %s %s", r.Method, r.URL.Path)
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				app.errorJSON(w, http.StatusForbidden, "csrf_failed", "send the X-CSRF-Token header from an earlier response")
+				return
+			}
+			http.Error(w, "Your session has expired or the form is out of date. Please go back, reload the page and try again.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the csrf token for the session, creating one if it has none yet
+func (app *Config) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), csrfSessionKey)
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return ""
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(r.Context(), csrfSessionKey, token)
+	return token
+}
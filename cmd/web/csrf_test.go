@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+func TestCSRF(t *testing.T) {
+	app := &Config{
+		Session:  scs.New(),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	const token = "the-session-token"
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		session   string
+		form      string
+		header    map[string]string
+		wantAllow bool
+		wantJSON  bool
+	}{
+		{name: "get needs no token", method: "GET", path: "/members/plans", wantAllow: true},
+		{name: "head needs no token", method: "HEAD", path: "/", wantAllow: true},
+		{name: "post without a token", method: "POST", path: "/members/subscribe", session: token},
+		{name: "post with the form field", method: "POST", path: "/members/subscribe", session: token, form: "csrf_token=" + token, wantAllow: true},
+		{name: "post with the header", method: "POST", path: "/members/subscribe", session: token, header: map[string]string{"X-CSRF-Token": token}, wantAllow: true},
+		{name: "post with a wrong token", method: "POST", path: "/members/subscribe", session: token, form: "csrf_token=guess"},
+		{name: "wrong header is not rescued by the form", method: "POST", path: "/members/subscribe", session: token, form: "csrf_token=" + token, header: map[string]string{"X-CSRF-Token": "guess"}},
+		{name: "session without a token", method: "POST", path: "/logout", form: "csrf_token="},
+		{name: "delete without a token", method: "DELETE", path: "/admin/users/1", session: token},
+		{name: "put without a token", method: "PUT", path: "/members/security/password", session: token},
+		{name: "api post without a token", method: "POST", path: "/api/v1/subscription", session: token, wantJSON: true},
+		{name: "api post with a bearer token", method: "POST", path: "/api/v1/subscription", header: map[string]string{"Authorization": "Bearer sk_abc"}, wantAllow: true},
+		{name: "empty bearer token", method: "POST", path: "/api/v1/subscription", session: token, header: map[string]string{"Authorization": "Bearer "}, wantJSON: true},
+		{name: "payment webhook", method: "POST", path: "/webhooks/payments", wantAllow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := false
+			handler := app.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				allowed = true
+			}))
+
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.form))
+			if tt.form != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			ctx, err := app.Session.Load(r.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.session != "" {
+				app.Session.Put(ctx, csrfSessionKey, tt.session)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r.WithContext(ctx))
+
+			if allowed != tt.wantAllow {
+				t.Fatalf("got allowed %t, want %t", allowed, tt.wantAllow)
+			}
+			if tt.wantAllow {
+				return
+			}
+			if w.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+			isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+			if isJSON != tt.wantJSON {
+				t.Errorf("got a JSON response %t, want %t", isJSON, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	app := &Config{Session: scs.New(), ErrorLog: log.New(io.Discard, "", 0)}
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx, err := app.Session.Load(r.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = r.WithContext(ctx)
+
+	first := app.csrfToken(r)
+	if len(first) < 40 {
+		t.Fatalf("token %q is too short", first)
+	}
+	if again := app.csrfToken(r); again != first {
+		t.Error("the token changed within a session")
+	}
+
+	// the token the page was rendered with is accepted when the form is posted
+	handler := app.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	form := url.Values{csrfFormField: {first}}
+	post := httptest.NewRequest("POST", "/logout", strings.NewReader(form.Encode())).WithContext(ctx)
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, post)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d posting the rendered token", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"subscription_service/data"
+	"sync"
+	"time"
+)
+
+// userCache keeps recently loaded users for a short while, so that loading the
+// logged in user on every request does not mean a database round trip on
+// every request. Changes made through this process are seen at once, because
+// whatever changes a user forgets it; changes made elsewhere are seen once
+// the entry expires.
+type userCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int]userCacheEntry
+}
+
+type userCacheEntry struct {
+	user    data.User
+	expires time.Time
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		ttl:     ttl,
+		entries: make(map[int]userCacheEntry),
+	}
+}
+
+// get returns a copy of the cached user, if there is a fresh one
+func (c *userCache) get(id int) (*data.User, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	u := e.user
+	return &u, true
+}
+
+func (c *userCache) put(u *data.User) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[u.ID] = userCacheEntry{user: *u, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *userCache) forget(id int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+}
+
+// LoadUser loads the logged in user for every request, and makes it available
+// to handlers through currentUser. A session whose user has been deleted or
+// deactivated is logged out.
+func (app *Config) LoadUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.IsAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// sessions used to carry a copy of the user, which is never read any more
+		if app.Session.Exists(r.Context(), "user") {
+			app.Session.Remove(r.Context(), "user")
+		}
+
+		user, err := app.loadUser(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil || user.Active != 1 {
+			if err != nil {
+				app.ErrorLog.Println(err)
+			}
+			_ = app.Session.Destroy(r.Context())
+			_ = app.Session.RenewToken(r.Context())
+			app.Session.Put(r.Context(), "warning", "your account is no longer available, please log in again")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextUserKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// loadUser returns a user from the cache, or from the database
+func (app *Config) loadUser(id int) (*data.User, error) {
+	if u, ok := app.UserCache.get(id); ok {
+		return u, nil
+	}
+	u, err := app.Models.User.GetOne(id)
+	if err != nil {
+		return nil, err
+	}
+	app.UserCache.put(u)
+	return u, nil
+}
+
+// forgetUser drops a user from the cache after they have been changed, so
+// that the change applies from their next request
+func (app *Config) forgetUser(id int) {
+	app.UserCache.forget(id)
+}
+
+// currentUser returns the logged in user, or an empty user if nobody is logged in
+func (app *Config) currentUser(r *http.Request) *data.User {
+	if u, ok := r.Context().Value(contextUserKey).(*data.User); ok {
+		return u
+	}
+	return &data.User{}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
-	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"subscription_service/data"
+	"subscription_service/forms"
 	"time"
 )
 
@@ -27,11 +29,29 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 		app.ErrorLog.Println(err)
 	}
 	// get email and password
-	email := r.Form.Get("email")
+	email := forms.NormalizeEmail(r.Form.Get("email"))
 	password := r.Form.Get("password")
 
+	if !app.loginIPAllowed(r) {
+		app.audit(r, 0, 0, "login.throttled", fmt.Sprintf("too many attempts from %s", clientIP(r)))
+		app.Session.Put(r.Context(), "error", "too many log in attempts. please try again later.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if lock := app.loginLockedFor(email); lock > 0 {
+		app.Session.Put(r.Context(), "error", lockoutMessage(lock))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	user, err := app.Models.User.GetByEmail(email)
 	if err != nil {
+		app.audit(r, 0, 0, "login.failed", fmt.Sprintf("unknown email %s", email))
+		if lock := app.recordLoginFailure(r, email, nil); lock > 0 {
+			app.Session.Put(r.Context(), "error", lockoutMessage(lock))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
 		app.Session.Put(r.Context(), "error", "Invalid Credentials")
 		app.InfoLog.Println("cannot get user by email")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -45,26 +65,56 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !validPassword {
-		msg := Message{
-			To:      email,
-			Subject: "Failed log in attempt",
-			Data:    "invalid login attempt!",
+		app.audit(r, 0, user.ID, "login.failed", "wrong password")
+		if lock := app.recordLoginFailure(r, email, user); lock > 0 {
+			app.Session.Put(r.Context(), "error", lockoutMessage(lock))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
 		}
-		app.sendEmail(msg)
 		app.Session.Put(r.Context(), "error", "Invalid Credentials")
 		app.InfoLog.Println("password does not match")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if user.Active != 1 {
+		app.audit(r, 0, user.ID, "login.failed", "account not activated")
+		app.Session.Put(r.Context(), "error", "your account has not been activated yet. check your email for the activation link, or request a new one.")
+		http.Redirect(w, r, "/resend-activation", http.StatusSeeOther)
+		return
+	}
+	if user.TOTPEnabled == 1 {
+		// the password was right, but the user is not logged in until they enter a code as well
+		app.Session.Put(r.Context(), "pendingUserID", user.ID)
+		app.Session.Put(r.Context(), "pendingAt", time.Now().Unix())
+		app.Session.Put(r.Context(), "pendingAttempts", 0)
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+	app.completeLogin(w, r, user, "")
+}
+
+// completeLogin logs a user in whose credentials have been checked
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, detail string) {
 	// logging user
-	app.Session.Put(r.Context(), "userID", user.ID)
-	app.Session.Put(r.Context(), "user", user)
+	err := app.clearLoginFailures(user.Email)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	app.startAuthenticatedSession(r, user.ID)
+	app.audit(r, user.ID, user.ID, "login.succeeded", detail)
 	app.Session.Put(r.Context(), "flash", "Successful login")
 	// redirect the user
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	if app.IsAuthenticated(r) {
+		app.audit(r, app.actorID(r), app.Session.GetInt(r.Context(), "userID"), "logout", "")
+		err := app.revokeSession(app.Session.GetInt(r.Context(), "sessionOwnerID"), app.Session.GetString(r.Context(), "sessionID"))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
 	// clean up the session
 	_ = app.Session.Destroy(r.Context())
 	_ = app.Session.RenewToken(r.Context())
@@ -80,56 +130,99 @@ func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		app.ErrorLog.Println(err)
 	}
-	// TODO - validate data
+
+	// validate data
+	form := forms.New(r.PostForm)
+	form.Trim("email", "first-name", "last-name")
+	form.Required("email", "password", "verify-password", "first-name", "last-name")
+	form.IsEmail("email")
+	form.MaxLength("email", 255)
+	form.MaxLength("first-name", 255)
+	form.MaxLength("last-name", 255)
+	form.Password("password", "email")
+	form.Matches("password", "verify-password", "passwords do not match")
+	if !form.Valid() {
+		app.renderRegisterForm(w, r, form)
+		return
+	}
+
 	// create a user
 	u := data.User{
-		Email:     r.Form.Get("email"),
-		FirstName: r.Form.Get("first-name"),
-		LastName:  r.Form.Get("last-name"),
-		Password:  r.Form.Get("password"),
+		Email:     form.Get("email"),
+		FirstName: form.Get("first-name"),
+		LastName:  form.Get("last-name"),
+		Password:  form.Get("password"),
 		Active:    0,
-		IsAdmin:   0,
 	}
-	_, err = u.Insert(u)
+	// the user, and the email with the link to activate their account, are saved together
+	u.ID, err = u.Register(u, app.ActivationTTL, app.activationEmail(u.Email))
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		form.Errors.Add("email", "an account with this email address already exists")
+		app.renderRegisterForm(w, r, form)
+		return
+	}
 	if err != nil {
+		app.ErrorLog.Println(err)
 		app.Session.Put(r.Context(), "error", "unable to create user")
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
 	}
-	// send an activation email
-	url := fmt.Sprintf("http://localhost:8090/activate?email=%s", u.Email)
-	signedUrl := GenerateTokenFromString(url)
-	app.InfoLog.Println(signedUrl)
-
-	msg := Message{
-		To:       u.Email,
-		Subject:  "Activate your account",
-		Template: "confirmation-email",
-		Data:     template.HTML(signedUrl),
-	}
-	app.sendEmail(msg)
+	app.auditChange(r, u.ID, u.ID, "user.registered", "", nil, userState(&u))
 	app.Session.Put(r.Context(), "flash", "confirmation email sent. Check your email.")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 
 	// subscribe the user to an account
 }
 
+// renderRegisterForm shows the registration form again with its errors. The
+// passwords are never sent back to the browser.
+func (app *Config) renderRegisterForm(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	form.Del("password")
+	form.Del("verify-password")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	app.render(w, r, "register.page.gohtml", &TemplateData{
+		Form: form,
+	})
+}
+
 func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 	// validate url
-	url := r.RequestURI
-	testURL := fmt.Sprintf("http://localhost:8090%s", url)
-	okay := VerifyToken(testURL)
+	okay := app.URLs.VerifyRequest(data.TokenActivation, r, app.ActivationTTL)
 	if !okay {
-		app.Session.Put(r.Context(), "error", "invalid token")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		app.Session.Put(r.Context(), "error", "this activation link is invalid or has expired. you can request a new one below.")
+		http.Redirect(w, r, "/resend-activation", http.StatusSeeOther)
 		return
 	}
-	// activate account
-	u, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
+	token, err := app.Models.Token.GetValid(data.TokenActivation, r.URL.Query().Get("token"))
 	if err != nil {
+		if !errors.Is(err, data.ErrTokenInvalid) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "this activation link has expired or has already been used")
+		http.Redirect(w, r, "/resend-activation", http.StatusSeeOther)
+		return
+	}
+	// activate account
+	u, err := app.Models.User.GetOne(token.UserID)
+	if err != nil || !strings.EqualFold(u.Email, r.URL.Query().Get("email")) {
 		app.Session.Put(r.Context(), "error", "no user found")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	if u.Active == 1 {
+		_ = app.Models.Token.DeleteAllForUser(u.ID, data.TokenActivation)
+		app.Session.Put(r.Context(), "warning", "this account has already been activated")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	err = token.Use()
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "this activation link has already been used")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	before := userState(u)
 	u.Active = 1
 	err = u.Update()
 	if err != nil {
@@ -137,96 +230,208 @@ func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	// any other activation links are no longer needed
+	err = app.Models.Token.DeleteAllForUser(u.ID, data.TokenActivation)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	app.auditChange(r, u.ID, u.ID, "user.activated", "", before, userState(u))
 	app.Session.Put(r.Context(), "flash", "account activated. you can now login")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
-	// get the id of the plan that is chosen
-	id := r.URL.Query().Get("id")
+func (app *Config) ResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "resend-activation.page.gohtml", nil)
+}
 
-	planID, err := strconv.Atoi(id)
+func (app *Config) PostResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
-		app.ErrorLog.Println("Error getting plan id: ", err)
+		app.ErrorLog.Println(err)
 	}
+	email := forms.NormalizeEmail(r.Form.Get("email"))
 
-	// get the plan from the database
-	plan, err := app.Models.Plan.GetOne(planID)
+	// as with password resets, don't reveal whether the account exists
+	app.Session.Put(r.Context(), "flash", "if that account exists and is not yet active, we have sent a new activation link")
+
+	u, err := app.Models.User.GetByEmail(email)
+	if err != nil || u.Active == 1 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// only the newest link should work
+	err = app.Models.Token.DeleteAllForUser(u.ID, data.TokenActivation)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "unable to find the plan")
+		app.ErrorLog.Println(err)
+	}
+	err = app.Models.Token.Send(u.ID, data.TokenActivation, app.ActivationTTL, app.activationEmail(u.Email))
+	if err != nil {
+		app.ErrorLog.Println(err)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-	// get the user from the session
-	user, ok := app.Session.Get(r.Context(), "user").(data.User)
-	if !ok {
-		app.Session.Put(r.Context(), "error", "login first!")
+	app.audit(r, 0, u.ID, "user.activation_resent", "")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// activationEmail is the email which sends a user the signed, single use link
+// to activate their account
+func (app *Config) activationEmail(to string) data.TokenEmail {
+	return app.tokenEmail(to, data.TokenActivation, "/activate", "Activate your account", "confirmation-email")
+}
+
+// passwordResetTTL is how long a password reset link stays valid
+const passwordResetTTL = 60 * time.Minute
+
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+func (app *Config) PostForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	email := forms.NormalizeEmail(r.Form.Get("email"))
+
+	// the same message is shown whether or not the account exists, so that this
+	// page cannot be used to find out who has an account
+	app.Session.Put(r.Context(), "flash", "if an account exists for that email, we have sent a link to reset the password")
+
+	u, err := app.Models.User.GetByEmail(email)
+	if err != nil {
+		app.InfoLog.Println("password reset requested for unknown email")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// generate an invoice
-	app.Wait.Add(1)
+	msg := app.tokenEmail(u.Email, data.TokenPasswordReset, "/reset-password", "Reset your password", "password-reset")
+	err = app.Models.Token.Send(u.ID, data.TokenPasswordReset, passwordResetTTL, msg)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, 0, u.ID, "password.reset_requested", "")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
 
-	go func() {
-		defer app.Wait.Done()
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.verifyPasswordResetLink(w, r); !ok {
+		return
+	}
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{"action": app.URLs.Absolute(app.URLs.Relative(r))},
+	})
+}
 
-		invoice, err := app.getInvoice(user, plan)
-		if err != nil {
-			app.ErrorLog.Println(err)
-			// send this to a chanel
-			app.ErrorChan <- err
-		}
+func (app *Config) PostResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	token, ok := app.verifyPasswordResetLink(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
 
-		msg := Message{
-			To:       user.Email,
-			Subject:  "your invoice",
-			Data:     invoice,
-			Template: "invoice",
-		}
-		app.sendEmail(msg)
-	}()
-	app.Wait.Add(1)
-	// send an email with attachments
-	// generate a manual
-	// send an email with manual attached
-	go func() {
-		defer app.Wait.Done()
-
-		pdf := app.generateManual(user, plan)
-		err := pdf.OutputFileAndClose(fmt.Sprintf("./tmp/%d_manual.pdf", user.ID))
-		if err != nil {
+	password := r.Form.Get("password")
+	if problem := forms.PasswordProblem(password); problem != "" {
+		app.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, app.URLs.Absolute(app.URLs.Relative(r)), http.StatusSeeOther)
+		return
+	}
+	if password != r.Form.Get("verify-password") {
+		app.Session.Put(r.Context(), "error", "passwords do not match")
+		http.Redirect(w, r, app.URLs.Absolute(app.URLs.Relative(r)), http.StatusSeeOther)
+		return
+	}
+
+	u, err := app.Models.User.GetOne(token.UserID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "no user found")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// claim the token before changing anything, so a link can only ever be used once
+	err = token.Use()
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "this link has already been used")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = u.ResetPassword(password)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to reset the password")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(u.ID)
+
+	// log out everywhere, and throw away any other reset links
+	err = app.revokeSessions(u.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	err = app.Models.Token.DeleteAllForUser(u.ID, data.TokenPasswordReset)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	app.audit(r, u.ID, u.ID, "password.reset", "")
+	_ = app.Session.Destroy(r.Context())
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "flash", "password changed. you can now login")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// verifyPasswordResetLink checks that the request is for a correctly signed,
+// unexpired and unused password reset link, and returns its token
+func (app *Config) verifyPasswordResetLink(w http.ResponseWriter, r *http.Request) (*data.Token, bool) {
+	if !app.URLs.VerifyRequest(data.TokenPasswordReset, r, passwordResetTTL) {
+		app.Session.Put(r.Context(), "error", "this link is invalid or has expired")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return nil, false
+	}
+
+	token, err := app.Models.Token.GetValid(data.TokenPasswordReset, r.URL.Query().Get("token"))
+	if err != nil {
+		if !errors.Is(err, data.ErrTokenInvalid) {
 			app.ErrorLog.Println(err)
-			app.ErrorChan <- err
-			return
 		}
+		app.Session.Put(r.Context(), "error", "this link is invalid, has expired or has already been used")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return nil, false
+	}
+	return token, true
+}
 
-		msg := Message{
-			To:      user.Email,
-			Subject: "your manual",
-			Data:    "your user manual is attached",
-			AttachmentMap: map[string]string{
-				"Manual.pdf": fmt.Sprintf("./tmp/%d_manual.pdf", user.ID),
-			},
-		}
-		app.sendEmail(msg)
+func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
+	// get the id of the plan that is chosen
+	id := r.PostFormValue("id")
 
-	}()
+	planID, err := strconv.Atoi(id)
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan id: ", err)
+	}
 
 	// subscribe the user to a plan
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
-	if err != nil {
-		app.Session.Put(r.Context(), "error", "error subscribing to plan")
-		http.Redirect(w, r, "/members/plan", http.StatusSeeOther)
+	_, err = app.subscribeUser(r, *app.currentUser(r), planID)
+	if errors.Is(err, errPlanUnavailable) {
+		app.Session.Put(r.Context(), "error", "unable to find the plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
-	u, err := app.Models.User.GetOne(user.ID)
 	if err != nil {
+		app.ErrorLog.Println(err)
 		app.Session.Put(r.Context(), "error", "error subscribing to plan")
-		http.Redirect(w, r, "/members/plan", http.StatusSeeOther)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
-	app.Session.Put(r.Context(), "user", u)
 	// redirect
 	app.Session.Put(r.Context(), "flash", "subscribed")
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
@@ -238,8 +443,6 @@ func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
 
 	importer := gofpdi.NewImporter()
 
-	time.Sleep(5 * time.Second)
-
 	t := importer.ImportPage(pdf, "./pdf/manual.pdf", 1, "/MediaBox")
 	pdf.AddPage()
 
@@ -253,9 +456,6 @@ func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
 	pdf.MultiCell(0, 4, fmt.Sprintf("%s User Guide", plan.PlanName), "", "C", false)
 	return pdf
 }
-func (app *Config) getInvoice(u data.User, plan *data.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil
-}
 func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 	plans, err := app.Models.Plan.GetAll()
 	if err != nil {
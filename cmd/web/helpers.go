@@ -1,6 +1,138 @@
 package main
 
-func (app *Config) sendEmail(msg Message) {
-	app.Wait.Add(1)
-	app.Mailer.MailerChan <- msg
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"subscription_service/data"
+	"time"
+)
+
+// sendEmail puts msg in the outbox on its own, from where it is sent in the
+// background. Once it is in the outbox it is sent even if the application
+// stops first. An email which belongs to a change, such as one carrying a new
+// token, is put in the outbox by the model in the transaction making the
+// change instead.
+func (app *Config) sendEmail(msg Message) error {
+	err := app.Models.Outbox.Insert(data.OutboxEmail, msg.Subject, emailForOutbox(msg))
+	if err != nil {
+		return fmt.Errorf("unable to queue email %q to %s: %w", msg.Subject, msg.To, err)
+	}
+	return nil
+}
+
+// tokenEmail returns the email which sends a user a signed link to path,
+// carrying a new token for purpose
+func (app *Config) tokenEmail(to, purpose, path, subject, tmpl string) data.TokenEmail {
+	return func(token string) (string, any) {
+		signedUrl := app.URLs.Signed(purpose, path, url.Values{
+			"email": {to},
+			"token": {token},
+		})
+		msg := Message{
+			To:       to,
+			Subject:  subject,
+			Template: tmpl,
+			Data:     template.HTML(signedUrl),
+		}
+		return msg.Subject, emailForOutbox(msg)
+	}
+}
+
+// backoff is how long to wait before trying something again, after attempts
+// failed attempts: first after the first failure, doubling after each failure
+// after that, up to longest
+func backoff(attempts int, first, longest time.Duration) time.Duration {
+	delay := first
+	for i := 1; i < attempts && delay < longest; i++ {
+		delay *= 2
+	}
+	if delay > longest {
+		delay = longest
+	}
+	return delay
+}
+
+// audit records an action in the audit log. Failing to write the audit log
+// should not fail the request, so errors are only reported.
+func (app *Config) audit(r *http.Request, actorID, targetID int, action, detail string) {
+	app.auditChange(r, actorID, targetID, action, detail, nil, nil)
+}
+
+// auditChange records an action in the audit log along with the state of the
+// thing that was changed before and after the action
+func (app *Config) auditChange(r *http.Request, actorID, targetID int, action, detail string, before, after any) {
+	event := data.AuditEvent{
+		ActorID:   actorID,
+		TargetID:  targetID,
+		Action:    action,
+		Detail:    detail,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if before != nil {
+		b, _ := json.Marshal(before)
+		event.Before = string(b)
+	}
+	if after != nil {
+		b, _ := json.Marshal(after)
+		event.After = string(b)
+	}
+
+	_, err := app.Models.Audit.Insert(event)
+	if err != nil {
+		app.ErrorLog.Println("unable to write audit log:", action, err)
+	}
+}
+
+// actorID returns the id of the person really making the request, which is
+// the admin rather than the user when impersonating
+func (app *Config) actorID(r *http.Request) int {
+	if app.IsImpersonating(r) {
+		return app.Session.GetInt(r.Context(), "impersonatorID")
+	}
+	return app.Session.GetInt(r.Context(), "userID")
+}
+
+// clientIP returns the address of the client, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userState is what the audit log records about a user. It deliberately
+// leaves out the password hash.
+func userState(u *data.User) map[string]any {
+	roles := []string{}
+	for _, role := range u.Roles {
+		roles = append(roles, role.Name)
+	}
+	state := map[string]any{
+		"email":      u.Email,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"active":     u.Active,
+		"roles":      roles,
+		"plan":       "",
+	}
+	if u.Plan != nil {
+		state["plan"] = u.Plan.PlanName
+	}
+	return state
+}
+
+// planState is what the audit log records about a plan
+func planState(p *data.Plan) map[string]any {
+	return map[string]any{
+		"plan_name":   p.PlanName,
+		"plan_amount": p.PlanAmount,
+		"archived":    p.Archived,
+		"trial_days":  p.TrialDays,
+	}
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// idempotencyHeader and idempotencyFormField are where a request may carry its idempotency key
+	idempotencyHeader    = "Idempotency-Key"
+	idempotencyFormField = "idempotency_key"
+	// idempotencyReplayedHeader is set on responses which are a replay of an earlier response
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	// idempotencyMaxKeyLength is the longest idempotency key accepted
+	idempotencyMaxKeyLength = 255
+	// idempotencyTTL is how long a response is kept for replaying
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyLockTTL is how long a request holds its key while it runs; if
+	// it dies without finishing, the key may be used again after this
+	idempotencyLockTTL = time.Minute
+	// idempotencyWait is how long a repeat of a request which is still running
+	// waits for it to finish, before it is refused
+	idempotencyWait = 5 * time.Second
+	// idempotencyMaxBodyBytes is the largest request body accepted with an idempotency key
+	idempotencyMaxBodyBytes = 1 << 20
+)
+
+var errIdempotencyMismatch = errors.New("idempotency key was used for a different request")
+
+// idempotentResponse is what is kept in redis for an idempotency key. While
+// the first request with the key runs, only the fingerprint is set.
+type idempotentResponse struct {
+	Fingerprint string              `json:"fingerprint"`
+	Done        bool                `json:"done"`
+	Status      int                 `json:"status"`
+	Header      map[string][]string `json:"header"`
+	Body        []byte              `json:"body"`
+}
+
+// replayedHeaders are the response headers which are kept and replayed
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// Idempotent makes a request which carries an idempotency key, in the
+// Idempotency-Key header or the idempotency_key form field, run at most once.
+// Repeating the request with the same key returns the response of the first
+// request instead of running it again, so that double clicks and retries
+// after a timeout do not, for example, subscribe someone twice. Keys belong
+// to the logged in user and the method and path of the request, and reusing
+// a key for a different body is refused. Responses with a 5xx status are not
+// kept, so that those requests can be retried. Requests without a key run as
+// they always did. If redis is unavailable the request runs anyway.
+func (app *Config) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBodyBytes))
+		if err != nil {
+			app.idempotencyError(w, r, http.StatusRequestEntityTooLarge, "invalid_request", "the request is too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			key = r.PostFormValue(idempotencyFormField)
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKeyLength {
+			app.idempotencyError(w, r, http.StatusBadRequest, "invalid_request",
+				fmt.Sprintf("the idempotency key must be at most %d characters", idempotencyMaxKeyLength))
+			return
+		}
+
+		redisKey := app.idempotencyRedisKey(r, key)
+		fingerprint := requestFingerprint(r, body)
+
+		conn := app.Redis.Get()
+		defer conn.Close()
+
+		locked, err := app.lockIdempotencyKey(conn, redisKey, fingerprint)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !locked {
+			app.replayIdempotent(w, r, conn, redisKey, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		kept := false
+		defer func() {
+			// a request which panics, or which fails on our side, may be tried again
+			if !kept {
+				_, err := conn.Do("DEL", redisKey)
+				if err != nil {
+					app.ErrorLog.Println(err)
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		if rec.status >= 500 {
+			return
+		}
+
+		stored := idempotentResponse{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      rec.status,
+			Header:      make(map[string][]string),
+			Body:        rec.body.Bytes(),
+		}
+		for _, h := range replayedHeaders {
+			if v := rec.Header().Values(h); len(v) > 0 {
+				stored.Header[h] = v
+			}
+		}
+		value, err := json.Marshal(stored)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			return
+		}
+		_, err = conn.Do("SET", redisKey, value, "EX", int(idempotencyTTL.Seconds()))
+		if err != nil {
+			app.ErrorLog.Println(err)
+			return
+		}
+		kept = true
+	})
+}
+
+// lockIdempotencyKey claims an idempotency key for a request which is about
+// to run, and reports whether it was claimed
+func (app *Config) lockIdempotencyKey(conn redis.Conn, redisKey, fingerprint string) (bool, error) {
+	value, err := json.Marshal(idempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return false, err
+	}
+	reply, err := conn.Do("SET", redisKey, value, "NX", "EX", int(idempotencyLockTTL.Seconds()))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// replayIdempotent writes the response kept for an idempotency key. If the
+// request which claimed the key is still running, it waits a little for it.
+func (app *Config) replayIdempotent(w http.ResponseWriter, r *http.Request, conn redis.Conn, redisKey, fingerprint string) {
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		stored, err := getIdempotentResponse(conn, redisKey)
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+			app.idempotencyError(w, r, http.StatusServiceUnavailable, "unavailable", "unable to check the idempotency key, try again")
+			return
+		}
+		if err == nil && stored.Fingerprint != fingerprint {
+			app.idempotencyError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", errIdempotencyMismatch.Error())
+			return
+		}
+		if err == nil && stored.Done {
+			for h, v := range stored.Header {
+				w.Header()[h] = v
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+		// still running, or it failed and let go of the key
+		if time.Now().After(deadline) || errors.Is(err, redis.ErrNil) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	w.Header().Set("Retry-After", "1")
+	app.idempotencyError(w, r, http.StatusConflict, "idempotency_key_in_use", "a request with this idempotency key is still being processed, try again")
+}
+
+func getIdempotentResponse(conn redis.Conn, redisKey string) (*idempotentResponse, error) {
+	value, err := redis.Bytes(conn.Do("GET", redisKey))
+	if err != nil {
+		return nil, err
+	}
+	var stored idempotentResponse
+	err = json.Unmarshal(value, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// idempotencyRedisKey scopes an idempotency key to the logged in user, and to the method and path of the request
+func (app *Config) idempotencyRedisKey(r *http.Request, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("idempotency:%d:%s:%s:%s", app.currentUser(r).ID, r.Method, r.URL.Path, hex.EncodeToString(h[:]))
+}
+
+// requestFingerprint identifies the content of a request, so that a key
+// reused for another request can be told apart from a repeat. Forms are
+// compared field by field, leaving out the csrf token, since it does not
+// change what the request does.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	if form, ok := submittedForm(r, body); ok {
+		form.Del(csrfFormField)
+		form.Del(idempotencyFormField)
+		// Encode sorts by field name, which makes this stable
+		h.Write([]byte(form.Encode()))
+	} else {
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// submittedForm returns a copy of the fields of a form submitted in the body
+// of r, and false if the body is not a form. The form may already have been
+// parsed, by the csrf check for one, in which case body is empty and the
+// fields are taken from r.PostForm.
+func submittedForm(r *http.Request, body []byte) (url.Values, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data":
+		return nil, false
+	case r.PostForm != nil:
+		form := make(url.Values, len(r.PostForm))
+		for k, v := range r.PostForm {
+			form[k] = v
+		}
+		return form, true
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		return form, err == nil
+	}
+	return nil, false
+}
+
+// idempotencyBrowserMessages are shown to people using the site in place of
+// the errors API clients get
+var idempotencyBrowserMessages = map[string]string{
+	"idempotency_key_reused": "that form has already been sent. reload the page to start again.",
+	"idempotency_key_in_use": "that form is still being sent. wait a moment, then check whether it went through before trying again.",
+	"unavailable":            "unable to send that form just now. please try again.",
+}
+
+// idempotencyError reports a problem with an idempotency key as JSON to API
+// clients, and to people using the site as an error on the page they came from
+func (app *Config) idempotencyError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/webhooks/") {
+		app.errorJSON(w, status, code, message)
+		return
+	}
+	if m, ok := idempotencyBrowserMessages[code]; ok {
+		message = m
+	}
+	app.Session.Put(r.Context(), "error", message)
+	http.Redirect(w, r, app.refererPath(r, "/"), http.StatusSeeOther)
+}
+
+// refererPath returns the path of the page on this site a request came from,
+// or fallback if it did not come from one
+func (app *Config) refererPath(r *http.Request, fallback string) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return fallback
+	}
+	if u.Host != r.Host && (app.URLs == nil || u.Host != app.URLs.base.Host) {
+		return fallback
+	}
+	return u.RequestURI()
+}
+
+// newIdempotencyKey returns a random key for forms to send, so that submitting
+// the same form twice only does it once
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// responseRecorder passes a response through to the client, keeping a copy of
+// its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
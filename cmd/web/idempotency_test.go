@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	fingerprint := func(contentType, body string) string {
+		r := httptest.NewRequest("POST", "/members/subscribe", strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return requestFingerprint(r, []byte(body))
+	}
+
+	tests := []struct {
+		name      string
+		aType     string
+		a         string
+		bType     string
+		b         string
+		wantEqual bool
+	}{
+		{"same form", form, "id=1&csrf_token=x", form, "id=1&csrf_token=x", true},
+		{"csrf token differs", form, "id=1&csrf_token=x", form, "id=1&csrf_token=y", true},
+		{"csrf token missing", form, "id=1&csrf_token=x", form, "id=1", true},
+		{"key sent in the form or the header", form, "id=1&idempotency_key=k", form, "id=1", true},
+		{"fields in another order", form, "id=1&note=a", form, "note=a&id=1", true},
+		{"charset given", form, "id=1", form + "; charset=utf-8", "id=1", true},
+		{"other plan", form, "id=1&csrf_token=x", form, "id=2&csrf_token=x", false},
+		{"extra field", form, "id=1", form, "id=1&coupon=x", false},
+		{"same JSON", "application/json", `{"plan_id":1}`, "application/json", `{"plan_id":1}`, true},
+		{"other JSON", "application/json", `{"plan_id":1}`, "application/json", `{"plan_id":2}`, false},
+		{"csrf_token in JSON is content", "application/json", `{"csrf_token":"x"}`, "application/json", `{"csrf_token":"y"}`, false},
+		{"form body sent as JSON", form, "id=1&csrf_token=x", "application/json", "id=1&csrf_token=x", false},
+	}
+	for _, tt := range tests {
+		equal := fingerprint(tt.aType, tt.a) == fingerprint(tt.bType, tt.b)
+		if equal != tt.wantEqual {
+			t.Errorf("%s: got equal %t, want %t", tt.name, equal, tt.wantEqual)
+		}
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	store := &fakeRedisStore{values: make(map[string][]byte)}
+	app := &Config{
+		Session:  scs.New(),
+		ErrorLog: log.New(io.Discard, "", 0),
+		Redis:    &redis.Pool{Dial: func() (redis.Conn, error) { return store, nil }},
+	}
+	runs := 0
+	handler := app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		if r.PostFormValue("id") == "fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/members/plans?run=%d", runs), http.StatusSeeOther)
+	}))
+
+	tests := []struct {
+		name         string
+		path         string
+		form         url.Values
+		header       string
+		wantRuns     int
+		wantStatus   int
+		wantLocation string
+		wantReplayed bool
+	}{
+		{"without a key", "/members/subscribe", url.Values{"id": {"1"}}, "", 1, http.StatusSeeOther, "/members/plans?run=1", false},
+		{"first with a key", "/members/subscribe", url.Values{"id": {"1"}, "idempotency_key": {"a"}, "csrf_token": {"x"}}, "", 2, http.StatusSeeOther, "/members/plans?run=2", false},
+		{"repeated", "/members/subscribe", url.Values{"id": {"1"}, "idempotency_key": {"a"}, "csrf_token": {"x"}}, "", 2, http.StatusSeeOther, "/members/plans?run=2", true},
+		{"repeated with a new csrf token", "/members/subscribe", url.Values{"id": {"1"}, "idempotency_key": {"a"}, "csrf_token": {"y"}}, "", 2, http.StatusSeeOther, "/members/plans?run=2", true},
+		{"repeated with the key in the header", "/members/subscribe", url.Values{"id": {"1"}, "csrf_token": {"z"}}, "a", 2, http.StatusSeeOther, "/members/plans?run=2", true},
+		{"another plan with its own key", "/members/subscribe", url.Values{"id": {"2"}, "idempotency_key": {"b"}}, "", 3, http.StatusSeeOther, "/members/plans?run=3", false},
+		{"key reused for another plan", "/members/subscribe", url.Values{"id": {"3"}, "idempotency_key": {"a"}}, "", 3, http.StatusSeeOther, "/members/plans", false},
+		{"same key on another path", "/members/cancel", url.Values{"id": {"1"}, "idempotency_key": {"a"}}, "", 4, http.StatusSeeOther, "/members/plans?run=4", false},
+		{"server error", "/members/subscribe", url.Values{"id": {"fail"}, "idempotency_key": {"c"}}, "", 5, http.StatusInternalServerError, "", false},
+		{"server error is not kept", "/members/subscribe", url.Values{"id": {"fail"}, "idempotency_key": {"c"}}, "", 6, http.StatusInternalServerError, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Referer", "http://example.com/members/plans")
+		if tt.header != "" {
+			r.Header.Set(idempotencyHeader, tt.header)
+		}
+		ctx, err := app.Session.Load(r.Context(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+
+		if runs != tt.wantRuns {
+			t.Errorf("%s: the handler has run %d times, want %d", tt.name, runs, tt.wantRuns)
+		}
+		if w.Code != tt.wantStatus || w.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s: got %d to %q, want %d to %q", tt.name, w.Code, w.Header().Get("Location"), tt.wantStatus, tt.wantLocation)
+		}
+		if replayed := w.Header().Get(idempotencyReplayedHeader) == "true"; replayed != tt.wantReplayed {
+			t.Errorf("%s: got replayed %t, want %t", tt.name, replayed, tt.wantReplayed)
+		}
+		if tt.name == "key reused for another plan" && app.Session.GetString(ctx, "error") == "" {
+			t.Errorf("%s: no error was shown", tt.name)
+		}
+	}
+}
+
+// TestIdempotentAfterCSRF runs Idempotent behind CSRF, as the routes do. The
+// csrf check parses the form, so the body is gone by the time Idempotent
+// reads it, and the fields must still tell requests apart.
+func TestIdempotentAfterCSRF(t *testing.T) {
+	store := &fakeRedisStore{values: make(map[string][]byte)}
+	app := &Config{
+		Session:  scs.New(),
+		ErrorLog: log.New(io.Discard, "", 0),
+		Redis:    &redis.Pool{Dial: func() (redis.Conn, error) { return store, nil }},
+	}
+	const token = "the-session-token"
+	runs := 0
+	handler := app.CSRF(app.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		http.Redirect(w, r, fmt.Sprintf("/members/plans?run=%d", runs), http.StatusSeeOther)
+	})))
+
+	tests := []struct {
+		name         string
+		form         url.Values
+		wantRuns     int
+		wantReplayed bool
+		wantError    string
+	}{
+		{"first", url.Values{"id": {"1"}, "idempotency_key": {"a"}}, 1, false, ""},
+		{"repeated", url.Values{"id": {"1"}, "idempotency_key": {"a"}}, 1, true, ""},
+		{"key reused for another plan", url.Values{"id": {"2"}, "idempotency_key": {"a"}}, 1, false, idempotencyBrowserMessages["idempotency_key_reused"]},
+		{"another plan with its own key", url.Values{"id": {"2"}, "idempotency_key": {"b"}}, 2, false, ""},
+	}
+	for _, tt := range tests {
+		tt.form.Set(csrfFormField, token)
+		r := httptest.NewRequest("POST", "/members/subscribe", strings.NewReader(tt.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx, err := app.Session.Load(r.Context(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Session.Put(ctx, csrfSessionKey, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+
+		if runs != tt.wantRuns {
+			t.Errorf("%s: the handler has run %d times, want %d", tt.name, runs, tt.wantRuns)
+		}
+		if replayed := w.Header().Get(idempotencyReplayedHeader) == "true"; replayed != tt.wantReplayed {
+			t.Errorf("%s: got replayed %t, want %t", tt.name, replayed, tt.wantReplayed)
+		}
+		if got := app.Session.GetString(ctx, "error"); got != tt.wantError {
+			t.Errorf("%s: got error %q, want %q", tt.name, got, tt.wantError)
+		}
+	}
+}
+
+func TestIdempotencyErrorForAPI(t *testing.T) {
+	app := &Config{Session: scs.New(), ErrorLog: log.New(io.Discard, "", 0)}
+	r := httptest.NewRequest("POST", "/api/v1/subscription", nil)
+	w := httptest.NewRecorder()
+	app.idempotencyError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", errIdempotencyMismatch.Error())
+
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"idempotency_key_reused"`) {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRefererPath(t *testing.T) {
+	urls, err := NewURLBuilder("https://subs.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Config{URLs: urls}
+
+	tests := []struct {
+		name    string
+		referer string
+		want    string
+	}{
+		{"same host", "http://example.com/members/plans?page=2", "/members/plans?page=2"},
+		{"public url", "https://subs.example.com/admin/users/1", "/admin/users/1"},
+		{"another site", "https://evil.example.org/members/plans", "/"},
+		{"none", "", "/"},
+		{"not a url", "::", "/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/members/subscribe", nil)
+		if tt.referer != "" {
+			r.Header.Set("Referer", tt.referer)
+		}
+		if got := app.refererPath(r, "/"); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeRedisStore understands the GET, SET and DEL commands idempotency keys
+// are kept with, ignoring expiry
+type fakeRedisStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *fakeRedisStore) Do(cmd string, args ...any) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "":
+		return nil, nil
+	case "GET":
+		v, ok := s.values[args[0].(string)]
+		if !ok {
+			return nil, nil
+		}
+		return v, nil
+	case "DEL":
+		delete(s.values, args[0].(string))
+		return int64(1), nil
+	case "SET":
+		key := args[0].(string)
+		for _, a := range args[2:] {
+			if a == "NX" {
+				if _, exists := s.values[key]; exists {
+					return nil, nil
+				}
+			}
+		}
+		s.values[key] = args[1].([]byte)
+		return "OK", nil
+	}
+	return nil, errors.New("unexpected command " + cmd)
+}
+
+func (s *fakeRedisStore) Close() error              { return nil }
+func (s *fakeRedisStore) Err() error                { return nil }
+func (s *fakeRedisStore) Send(string, ...any) error { return nil }
+func (s *fakeRedisStore) Flush() error              { return nil }
+func (s *fakeRedisStore) Receive() (any, error)     { return nil, nil }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"subscription_service/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// StartImpersonation lets an authorized admin act as another user. The admin's
+// id is kept in the session under impersonatorID so that they can get back to
+// their own account with StopImpersonation.
+func (app *Config) StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	admin := app.currentUser(r)
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	target, err := app.Models.User.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "user not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	// impersonating other staff would let support staff borrow their permissions
+	if target.ID == admin.ID || target.IsStaff() {
+		app.Session.Put(r.Context(), "error", "staff accounts cannot be impersonated")
+		http.Redirect(w, r, app.adminUserURL(target.ID), http.StatusSeeOther)
+		return
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "impersonatorID", admin.ID)
+	app.Session.Put(r.Context(), "impersonatorName", fmt.Sprintf("%s %s", admin.FirstName, admin.LastName))
+	app.Session.Put(r.Context(), "impersonationWrite", admin.HasPermission(data.PermImpersonateWrite))
+	app.Session.Put(r.Context(), "userID", target.ID)
+
+	app.audit(r, admin.ID, target.ID, "impersonation.start", "")
+	app.InfoLog.Printf("admin %d started impersonating user %d", admin.ID, target.ID)
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("you are now viewing the site as %s", target.Email))
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// StopImpersonation ends an impersonation session and logs the admin back in as themselves
+func (app *Config) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	if !app.IsImpersonating(r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	adminID := app.Session.GetInt(r.Context(), "impersonatorID")
+	targetID := app.Session.GetInt(r.Context(), "userID")
+
+	admin, err := app.Models.User.GetOne(adminID)
+	if err != nil {
+		// the admin account has gone away, so there is nobody to go back to
+		_ = app.Session.Destroy(r.Context())
+		_ = app.Session.RenewToken(r.Context())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), "impersonatorID")
+	app.Session.Remove(r.Context(), "impersonatorName")
+	app.Session.Remove(r.Context(), "impersonationWrite")
+	app.Session.Put(r.Context(), "userID", admin.ID)
+
+	app.audit(r, admin.ID, targetID, "impersonation.stop", "")
+	app.InfoLog.Printf("admin %d stopped impersonating user %d", admin.ID, targetID)
+	app.Session.Put(r.Context(), "flash", "impersonation ended")
+	http.Redirect(w, r, app.adminUserURL(targetID), http.StatusSeeOther)
+}
+
+// IsImpersonating reports whether the current session belongs to an admin acting as another user
+func (app *Config) IsImpersonating(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "impersonatorID")
+}
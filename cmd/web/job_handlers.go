@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"subscription_service/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const jobsPerPage = 50
+
+func (app *Config) AdminJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := data.JobFilter{
+		Queue:  q.Get("queue"),
+		Status: q.Get("status"),
+		Type:   q.Get("type"),
+		Limit:  jobsPerPage + 1,
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter.Offset = (page - 1) * jobsPerPage
+
+	jobs, err := app.Models.Job.GetAll(filter)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get jobs", http.StatusInternalServerError)
+		return
+	}
+	// one more job than needed was fetched to find out if there is a next page
+	hasNext := len(jobs) > jobsPerPage
+	if hasNext {
+		jobs = jobs[:jobsPerPage]
+	}
+
+	counts, err := app.Models.Job.Counts()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	// the query string without the page, for building pagination links
+	q.Del("page")
+
+	dataMap := make(map[string]any)
+	dataMap["jobs"] = jobs
+	dataMap["jobQueues"] = jobQueueSummaries(counts)
+	dataMap["jobTypes"] = app.jobTypes()
+	dataMap["jobStatuses"] = data.JobStatuses
+	dataMap["query"] = template.URL(q.Encode())
+
+	app.render(w, r, "admin-jobs.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{
+			"queue":  q.Get("queue"),
+			"status": q.Get("status"),
+			"type":   q.Get("type"),
+		},
+		IntMap: map[string]int{
+			"page":     page,
+			"prevPage": page - 1,
+			"nextPage": page + 1,
+			"hasNext":  map[bool]int{true: 1}[hasNext],
+		},
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.adminGetJob(w, r)
+	if !ok {
+		return
+	}
+	dataMap := make(map[string]any)
+	dataMap["job"] = job
+
+	app.render(w, r, "admin-job.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminRetryJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.adminGetJob(w, r)
+	if !ok {
+		return
+	}
+
+	err := job.Retry()
+	if errors.Is(err, data.ErrJobRunning) {
+		app.Session.Put(r.Context(), "error", "the job is running, so it cannot be retried")
+		http.Redirect(w, r, jobURL(job.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to retry the job")
+		http.Redirect(w, r, jobURL(job.ID), http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), 0, "admin.job.retried", fmt.Sprintf("job %d, %s, was %s", job.ID, job.Type, job.Status))
+	app.Session.Put(r.Context(), "flash", "job queued to run again")
+	http.Redirect(w, r, jobURL(job.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminDeleteJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.adminGetJob(w, r)
+	if !ok {
+		return
+	}
+
+	err := job.Delete()
+	if errors.Is(err, data.ErrJobRunning) {
+		app.Session.Put(r.Context(), "error", "the job is running, so it cannot be deleted")
+		http.Redirect(w, r, jobURL(job.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to delete the job")
+		http.Redirect(w, r, jobURL(job.ID), http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), 0, "admin.job.deleted", fmt.Sprintf("job %d, %s, was %s", job.ID, job.Type, job.Status))
+	app.Session.Put(r.Context(), "flash", "job deleted")
+	http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+}
+
+// adminGetJob loads the job named by the id url parameter, redirecting back
+// to the job list if there is no such job
+func (app *Config) adminGetJob(w http.ResponseWriter, r *http.Request) (*data.Job, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	job, err := app.Models.Job.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "job not found")
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+		return nil, false
+	}
+	return job, true
+}
+
+// jobQueueSummary is one row of the summary at the top of the jobs page
+type jobQueueSummary struct {
+	Queue       string
+	Concurrency int
+	Counts      map[string]int
+}
+
+// jobQueueSummaries counts the jobs of each status in every queue, including
+// queues which have no jobs, and queues which have jobs but are not run here
+func jobQueueSummaries(counts []data.JobCount) []jobQueueSummary {
+	byQueue := make(map[string]map[string]int)
+	for queue := range jobQueues {
+		byQueue[queue] = make(map[string]int)
+	}
+	for _, c := range counts {
+		if byQueue[c.Queue] == nil {
+			byQueue[c.Queue] = make(map[string]int)
+		}
+		byQueue[c.Queue][c.Status] = c.Count
+	}
+
+	var summaries []jobQueueSummary
+	for queue, counts := range byQueue {
+		summaries = append(summaries, jobQueueSummary{
+			Queue:       queue,
+			Concurrency: jobQueues[queue],
+			Counts:      counts,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Queue < summaries[j].Queue
+	})
+	return summaries
+}
+
+func jobURL(id int) string {
+	return fmt.Sprintf("/admin/jobs/%d", id)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"subscription_service/data"
+	"time"
+)
+
+const (
+	// jobPollInterval is how often the queues are checked for jobs which are due
+	jobPollInterval = time.Second
+	// jobLease is how long a job may run before it is assumed that whoever ran it died
+	jobLease = 10 * time.Minute
+	// jobFirstRetry is the wait after the first failure; it doubles after each failure after that
+	jobFirstRetry = 30 * time.Second
+	// jobMaxRetry caps the wait between two attempts
+	jobMaxRetry = time.Hour
+)
+
+// Job queues
+const (
+	pdfQueue = "pdf"
+)
+
+// jobQueues lists the queues jobs are run from, and how many jobs of each
+// queue may run at once in one instance of the application
+var jobQueues = map[string]int{
+	data.DefaultJobQueue: 4,
+	// generating pdfs is slow and heavy, so only a couple at a time
+	pdfQueue: 2,
+}
+
+// Job types
+const (
+	jobManual = "manual"
+)
+
+// errJobUnrecoverable wraps errors from job handlers which no amount of
+// retrying will fix, such as a job for a user who no longer exists. Such jobs
+// are failed straight away rather than tried again.
+var errJobUnrecoverable = errors.New("job cannot be run")
+
+// jobHandler runs one job, given its payload
+type jobHandler func(payload string) error
+
+// jobHandlers returns the handler for each type of job. A job may run more
+// than once, if the instance running it dies before recording the outcome.
+func (app *Config) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobManual: typedJob(app.runManualJob),
+	}
+}
+
+// typedJob turns a handler taking a payload of type T into a jobHandler,
+// which decodes the payload first
+func typedJob[T any](handler func(T) error) jobHandler {
+	return func(payload string) error {
+		var p T
+		err := json.Unmarshal([]byte(payload), &p)
+		if err != nil {
+			return fmt.Errorf("%w: invalid payload: %s", errJobUnrecoverable, err)
+		}
+		return handler(p)
+	}
+}
+
+// jobTypes lists the types of job there are handlers for, sorted
+func (app *Config) jobTypes() []string {
+	var types []string
+	for t := range app.jobHandlers() {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// listenForJobs runs jobs from every queue until it is told to stop. Several
+// instances of the application may run this at once; each job is only
+// claimed by one of them at a time. Running jobs are tracked by the wait
+// group, so that shutting down waits for them.
+func (app *Config) listenForJobs() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	// one slot for each job which may run at once, per queue
+	slots := make(map[string]chan struct{})
+	for queue, concurrency := range jobQueues {
+		slots[queue] = make(chan struct{}, concurrency)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			for queue, s := range slots {
+				app.startJobs(queue, s)
+			}
+		case <-app.JobsDone:
+			return
+		}
+	}
+}
+
+// startJobs claims as many jobs from queue as there are free slots, and
+// starts them. Only listenForJobs takes slots, so the count of free slots
+// cannot go down while this runs.
+func (app *Config) startJobs(queue string, slots chan struct{}) {
+	free := cap(slots) - len(slots)
+	if free == 0 {
+		return
+	}
+	jobs, err := app.Models.Job.Claim(queue, free, jobLease)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	for _, job := range jobs {
+		slots <- struct{}{}
+		app.Wait.Add(1)
+		go func(job *data.Job) {
+			defer app.Wait.Done()
+			defer func() { <-slots }()
+			app.runJob(job)
+		}(job)
+	}
+}
+
+// runJob runs one claimed job, and records the outcome
+func (app *Config) runJob(job *data.Job) {
+	err := app.callJob(job)
+	if err == nil {
+		err = job.Succeeded()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	var retryAt time.Time
+	if job.Attempts < job.MaxAttempts && !errors.Is(err, errJobUnrecoverable) {
+		retryAt = time.Now().Add(backoff(job.Attempts, jobFirstRetry, jobMaxRetry))
+		app.ErrorLog.Printf("job %d (%s) failed, trying again at %s: %s", job.ID, job.Type, retryAt.Format(time.RFC3339), err)
+	} else {
+		app.ErrorLog.Printf("job %d (%s) failed after %d attempts, giving up: %s", job.ID, job.Type, job.Attempts, err)
+	}
+	err = job.Failed(err.Error(), retryAt)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// callJob hands a job to the handler for its type, turning a panic into an error
+func (app *Config) callJob(job *data.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	handler, ok := app.jobHandlers()[job.Type]
+	if !ok {
+		return fmt.Errorf("%w: unknown job type %q", errJobUnrecoverable, job.Type)
+	}
+	return handler(job.Payload)
+}
+
+// manualJob is the payload of a job which generates the manual for a plan,
+// and emails it to a user
+type manualJob struct {
+	UserID int `json:"user_id"`
+	PlanID int `json:"plan_id"`
+}
+
+func (app *Config) runManualJob(job manualJob) error {
+	u, err := app.Models.User.GetOne(job.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no user %d", errJobUnrecoverable, job.UserID)
+	}
+	if err != nil {
+		return err
+	}
+	plan, err := app.Models.Plan.GetOne(job.PlanID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no plan %d", errJobUnrecoverable, job.PlanID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the manual goes into the email itself rather than a file, since the
+	// email may be sent by another instance, after the plan changes again
+	var manual bytes.Buffer
+	pdf := app.generateManual(*u, plan)
+	err = pdf.Output(&manual)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:      u.Email,
+		Subject: "your manual",
+		Data:    "your user manual is attached",
+		AttachmentData: map[string][]byte{
+			"Manual.pdf": manual.Bytes(),
+		},
+	}
+	return app.sendEmail(msg)
+}
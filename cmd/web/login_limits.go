@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"subscription_service/data"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// loginIPLimit is how many login attempts one ip address may make per loginIPWindow
+	loginIPLimit  = 20
+	loginIPWindow = 15 * time.Minute
+	// loginFreeFailures is how many wrong passwords an account allows before it is locked
+	loginFreeFailures = 5
+	// the first lockout lasts loginLockBase, and each further failure doubles it up to loginLockMax
+	loginLockBase = time.Minute
+	loginLockMax  = time.Hour
+	// loginFailureMemory is how long failures count towards a lockout
+	loginFailureMemory = 24 * time.Hour
+	// loginAlertInterval is the least time between two security alerts to the same user
+	loginAlertInterval = time.Hour
+)
+
+// loginIPAllowed counts a login attempt from the client's ip address, and
+// reports whether it is within the limit. If redis is unavailable the attempt
+// is allowed, so that an outage does not lock everybody out.
+func (app *Config) loginIPAllowed(r *http.Request) bool {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	key := "login_ip:" + clientIP(r)
+	attempts, err := redis.Int(conn.Do("INCR", key))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return true
+	}
+	if attempts == 1 {
+		_, err = conn.Do("EXPIRE", key, int(loginIPWindow.Seconds()))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+	return attempts <= loginIPLimit
+}
+
+// loginLockedFor returns how much longer logins to the account with email are
+// locked, or 0 if they are not
+func (app *Config) loginLockedFor(email string) time.Duration {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int(conn.Do("TTL", loginLockKey(email)))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return 0
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// recordLoginFailure counts a failed login to the account with email, locking
+// it once it has failed too often, and returns how long it is now locked for.
+// Failures are counted by email, whether or not an account exists, so that
+// locking does not reveal which emails are registered. user is nil when there
+// is no such account.
+func (app *Config) recordLoginFailure(r *http.Request, email string, user *data.User) time.Duration {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	failures, err := redis.Int(conn.Do("INCR", loginFailuresKey(email)))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return 0
+	}
+	_, err = conn.Do("EXPIRE", loginFailuresKey(email), int(loginFailureMemory.Seconds()))
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if failures < loginFreeFailures {
+		return 0
+	}
+
+	lock := loginLockBase
+	for i := loginFreeFailures; i < failures && lock < loginLockMax; i++ {
+		lock *= 2
+	}
+	if lock > loginLockMax {
+		lock = loginLockMax
+	}
+	_, err = conn.Do("SET", loginLockKey(email), failures, "EX", int(lock.Seconds()))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return 0
+	}
+
+	if user != nil {
+		app.audit(r, 0, user.ID, "login.locked", fmt.Sprintf("%d failed attempts, locked for %s", failures, lock))
+		app.sendLoginAlert(conn, user)
+	}
+	return lock
+}
+
+// sendLoginAlert warns a user that someone is trying to log in to their
+// account, at most once every loginAlertInterval
+func (app *Config) sendLoginAlert(conn redis.Conn, user *data.User) {
+	_, err := redis.String(conn.Do("SET", fmt.Sprintf("login_alert:%d", user.ID), 1, "NX", "EX", int(loginAlertInterval.Seconds())))
+	if err != nil {
+		if err != redis.ErrNil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Failed log in attempts",
+		Data:    "there have been several failed attempts to log in to your account, so it has been locked for a while. if this wasn't you, consider changing your password.",
+	}
+	err = app.sendEmail(msg)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// clearLoginFailures forgets the failed logins to the account with email, and unlocks it
+func (app *Config) clearLoginFailures(email string) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", loginFailuresKey(email), loginLockKey(email))
+	return err
+}
+
+func loginFailuresKey(email string) string {
+	return "login_failures:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginLockKey(email string) string {
+	return "login_lock:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// lockoutMessage tells the user how long to wait before trying again
+func lockoutMessage(d time.Duration) string {
+	return fmt.Sprintf("too many failed log in attempts. please try again in %s.", d.Round(time.Second))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func newLoginLimitsApp() *Config {
+	store := &fakeRedisCounters{values: make(map[string]int), ttls: make(map[string]int)}
+	return &Config{
+		ErrorLog: log.New(io.Discard, "", 0),
+		Redis:    &redis.Pool{Dial: func() (redis.Conn, error) { return store, nil }},
+	}
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	app := newLoginLimitsApp()
+	r := httptest.NewRequest("POST", "/login", nil)
+	const email = "Someone@Example.com"
+
+	for i := 1; i < loginFreeFailures; i++ {
+		if lock := app.recordLoginFailure(r, email, nil); lock != 0 {
+			t.Fatalf("failure %d locked the account for %s", i, lock)
+		}
+	}
+	if lock := app.loginLockedFor(email); lock != 0 {
+		t.Fatalf("locked for %s before the threshold", lock)
+	}
+
+	// each further failure doubles the lockout, until it reaches the maximum
+	want := []time.Duration{
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute,
+		32 * time.Minute, time.Hour, time.Hour,
+	}
+	for i, w := range want {
+		if lock := app.recordLoginFailure(r, email, nil); lock != w {
+			t.Errorf("failure %d: locked for %s, want %s", loginFreeFailures+i, lock, w)
+		}
+		// emails are counted however they are written
+		if lock := app.loginLockedFor("someone@example.com "); lock != w {
+			t.Errorf("failure %d: loginLockedFor returned %s, want %s", loginFreeFailures+i, lock, w)
+		}
+	}
+	if lock := app.loginLockedFor("someone.else@example.com"); lock != 0 {
+		t.Errorf("another account is locked for %s", lock)
+	}
+
+	// a successful login starts the count over
+	if err := app.clearLoginFailures(email); err != nil {
+		t.Fatal(err)
+	}
+	if lock := app.loginLockedFor(email); lock != 0 {
+		t.Errorf("still locked for %s after a successful login", lock)
+	}
+	if lock := app.recordLoginFailure(r, email, nil); lock != 0 {
+		t.Errorf("the first failure after a successful login locked the account for %s", lock)
+	}
+}
+
+func TestLoginIPAllowed(t *testing.T) {
+	app := newLoginLimitsApp()
+	request := func(ip string) bool {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = ip + ":1234"
+		return app.loginIPAllowed(r)
+	}
+
+	for i := 1; i <= loginIPLimit; i++ {
+		if !request("192.0.2.1") {
+			t.Fatalf("attempt %d was refused", i)
+		}
+	}
+	if request("192.0.2.1") {
+		t.Error("an attempt over the limit was allowed")
+	}
+	if !request("192.0.2.2") {
+		t.Error("another address was refused")
+	}
+
+	app.Redis = &redis.Pool{Dial: func() (redis.Conn, error) { return &fakeRedisConn{err: errors.New("connection refused")}, nil }}
+	if !request("192.0.2.1") {
+		t.Error("an attempt was refused while redis is unavailable")
+	}
+}
+
+// fakeRedisCounters understands just enough of INCR, SET, EXPIRE, TTL and
+// DEL to test login limits without a redis server. Keys never expire.
+type fakeRedisCounters struct {
+	values map[string]int
+	ttls   map[string]int
+}
+
+func (c *fakeRedisCounters) Do(cmd string, args ...any) (any, error) {
+	switch cmd {
+	case "":
+		return nil, nil
+	case "INCR":
+		key := args[0].(string)
+		c.values[key]++
+		return int64(c.values[key]), nil
+	case "EXPIRE":
+		c.ttls[args[0].(string)] = args[1].(int)
+		return int64(1), nil
+	case "SET":
+		key := args[0].(string)
+		c.values[key] = args[1].(int)
+		if len(args) == 4 && args[2] == "EX" {
+			c.ttls[key] = args[3].(int)
+		}
+		return "OK", nil
+	case "TTL":
+		key := args[0].(string)
+		if _, ok := c.values[key]; !ok {
+			return int64(-2), nil
+		}
+		if ttl, ok := c.ttls[key]; ok {
+			return int64(ttl), nil
+		}
+		return int64(-1), nil
+	case "DEL":
+		for _, a := range args {
+			delete(c.values, a.(string))
+			delete(c.ttls, a.(string))
+		}
+		return int64(len(args)), nil
+	}
+	return nil, errors.New("unexpected command " + cmd)
+}
+
+func (c *fakeRedisCounters) Close() error              { return nil }
+func (c *fakeRedisCounters) Err() error                { return nil }
+func (c *fakeRedisCounters) Send(string, ...any) error { return nil }
+func (c *fakeRedisCounters) Flush() error              { return nil }
+func (c *fakeRedisCounters) Receive() (any, error)     { return nil, nil }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Email is a message which has been built from its templates, and is ready
+// to be handed to a transport
+type Email struct {
+	From        string
+	FromName    string
+	To          string
+	Subject     string
+	PlainBody   string
+	HTMLBody    string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to an email, under the name the recipient
+// sees. Its content is Data, or the file at Path if Data is nil.
+type Attachment struct {
+	Name string
+	Path string
+	Data []byte
+}
+
+// Transport sends emails somewhere: to a mail server, to files, or nowhere
+// but memory
+type Transport interface {
+	Send(e *Email) error
+}
+
+// Mail transports, as named by MAIL_TRANSPORT
+const (
+	transportSMTP   = "smtp"
+	transportFile   = "file"
+	transportMemory = "memory"
+)
+
+// newTransport returns the transport named by kind. Mail written to files
+// goes into dir.
+func newTransport(kind, dir string) (Transport, error) {
+	switch kind {
+	case transportSMTP, "":
+		return &SMTPTransport{
+			Host:       envString("MAIL_HOST", "localhost"),
+			Port:       envInt("MAIL_PORT", 1025),
+			Username:   os.Getenv("MAIL_USERNAME"),
+			Password:   os.Getenv("MAIL_PASSWORD"),
+			Encryption: envString("MAIL_ENCRYPTION", "none"),
+		}, nil
+	case transportFile:
+		return NewFileTransport(dir)
+	case transportMemory:
+		return &MemoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q, want %s, %s or %s", kind, transportSMTP, transportFile, transportMemory)
+	}
+}
+
+// FileTransport writes each email to a .eml file in a directory, where it
+// can be opened by a mail client or read by a test
+type FileTransport struct {
+	Dir string
+}
+
+// NewFileTransport returns a transport writing into dir, which is created
+// if it does not exist
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransport{Dir: dir}, nil
+}
+
+// Send writes email to a new file, named so that the files sort in the order
+// they were sent. The file is written under another name and then renamed,
+// so that anything watching the directory never sees half an email.
+func (t *FileTransport) Send(e *Email) error {
+	b, err := e.bytes()
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	path := filepath.Join(t.Dir, name)
+
+	err = os.WriteFile(path+".tmp", b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// MemoryTransport keeps emails in memory instead of sending them, so that
+// tests can check what would have been sent
+type MemoryTransport struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+// Send keeps a copy of email
+func (t *MemoryTransport) Send(e *Email) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	email := *e
+	email.Attachments = append([]Attachment(nil), e.Attachments...)
+	t.sent = append(t.sent, email)
+	return nil
+}
+
+// Sent returns the emails sent so far, oldest first
+func (t *MemoryTransport) Sent() []Email {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Email(nil), t.sent...)
+}
+
+// Reset forgets the emails sent so far
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = nil
+}
+
+// bytes returns the email as a MIME message: the plain text and html bodies
+// as alternatives, followed by any attachments
+func (e *Email) bytes() ([]byte, error) {
+	var body bytes.Buffer
+	mixed := multipart.NewWriter(&body)
+
+	var alternatives bytes.Buffer
+	alt := multipart.NewWriter(&alternatives)
+	err := writeTextPart(alt, "text/plain", e.PlainBody)
+	if err != nil {
+		return nil, err
+	}
+	err = writeTextPart(alt, "text/html", e.HTMLBody)
+	if err != nil {
+		return nil, err
+	}
+	err = alt.Close()
+	if err != nil {
+		return nil, err
+	}
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = part.Write(alternatives.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range e.Attachments {
+		err = writeAttachment(mixed, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = mixed.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	from := netmail.Address{Name: e.FromName, Address: e.From}
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", e.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}))
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write([]byte(text))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeAttachment(w *multipart.Writer, a Attachment) error {
+	content := a.Data
+	if content == nil {
+		var err error
+		content, err = os.ReadFile(a.Path)
+		if err != nil {
+			return err
+		}
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(a.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// base64 in lines of 76 characters, as MIME asks for
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		_, err = fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		if err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(part, "%s\r\n", encoded)
+	return err
+}
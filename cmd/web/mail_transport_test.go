@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentDataKeptInOutbox(t *testing.T) {
+	manual := []byte("%PDF-1.3 the manual")
+	msg := Message{
+		To:             "me@here.com",
+		Subject:        "your manual",
+		AttachmentData: map[string][]byte{"Manual.pdf": manual},
+	}
+
+	payload, err := json.Marshal(emailForOutbox(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var email outboxEmail
+	err = json.Unmarshal(payload, &email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(email.AttachmentData["Manual.pdf"], manual) {
+		t.Errorf("got attachment %q back from the outbox, want %q", email.AttachmentData["Manual.pdf"], manual)
+	}
+}
+
+func TestEmailBytesAttachmentData(t *testing.T) {
+	manual := []byte("%PDF-1.3 the manual")
+	e := &Email{
+		To:          "me@here.com",
+		Subject:     "your manual",
+		PlainBody:   "your user manual is attached",
+		HTMLBody:    "<p>your user manual is attached</p>",
+		Attachments: []Attachment{{Name: "Manual.pdf", Path: "./no/such/file.pdf", Data: manual}},
+	}
+
+	b, err := e.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`filename=Manual.pdf`, "application/pdf", base64.StdEncoding.EncodeToString(manual)} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("email does not contain %q:\n%s", want, b)
+		}
+	}
+
+	e.Attachments = []Attachment{{Name: "Manual.pdf", Path: "./no/such/file.pdf"}}
+	_, err = e.bytes()
+	if err == nil {
+		t.Error("an attachment without data must be read from its path")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
-	"sync"
+	"path/filepath"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -13,17 +13,10 @@ import (
 
 type Mail struct {
 	Domain      string
-	Host        string
-	Port        int
-	Username    string
-	Password    string
-	Encryption  string
 	FromAddress string
 	FromName    string
-	Wait        *sync.WaitGroup
-	MailerChan  chan Message
-	ErrorChan   chan error
-	DoneChan    chan bool
+	// Transport is what actually sends mail once it has been built
+	Transport Transport
 }
 
 type Message struct {
@@ -33,28 +26,17 @@ type Message struct {
 	Subject       string
 	Attachments   []string
 	AttachmentMap map[string]string
-	Data          any
-	DataMap       map[string]any
-	Template      string
+	// AttachmentData holds attachments by name with their content, rather
+	// than the path of a file, for files generated for the message; they
+	// are kept in the outbox with it, so any instance can send it
+	AttachmentData map[string][]byte
+	Data           any
+	DataMap        map[string]any
+	Template       string
 }
 
-// function to listen for messages to the MailerChan
-func (app *Config) listenForMail() {
-	for {
-		select {
-		case msg := <-app.Mailer.MailerChan:
-			go app.Mailer.sendMail(msg, app.Mailer.ErrorChan)
-		case err := <-app.Mailer.ErrorChan:
-			app.ErrorLog.Println(err)
-		case <-app.Mailer.DoneChan:
-			return
-		}
-	}
-}
-
-func (m *Mail) sendMail(msg Message, errChan chan error) {
-	defer m.Wait.Done()
-
+// sendMail builds one message, and returns once the transport has sent it
+func (m *Mail) sendMail(msg Message) error {
 	if msg.Template == "" {
 		msg.Template = "mail"
 	}
@@ -76,50 +58,35 @@ func (m *Mail) sendMail(msg Message, errChan chan error) {
 	// build html mail
 	formattedMessage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		errChan <- err
+		return err
 	}
 	// build plain text mail
 	plainMessage, err := m.buildPlainTextMessage(msg)
 	if err != nil {
-		errChan <- err
+		return err
 	}
-	server := mail.NewSMTPClient()
-	server.Host = m.Host
-	server.Port = m.Port
-	server.Username = m.Username
-	server.Password = m.Password
-	server.Encryption = m.getEncryption(m.Encryption)
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
 
-	smptClient, err := server.Connect()
-	if err != nil {
-		errChan <- err
+	email := &Email{
+		From:      msg.From,
+		FromName:  msg.FromName,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		PlainBody: plainMessage,
+		HTMLBody:  formattedMessage,
 	}
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).
-		AddTo(msg.To).
-		SetSubject(msg.Subject)
-	email.SetBody(mail.TextPlain, plainMessage)
-	email.AddAlternative(mail.TextHTML, formattedMessage)
-	if len(msg.Attachments) > 0 {
-		for _, i := range msg.Attachments {
-			email.AddAttachment(i)
-		}
+	for _, path := range msg.Attachments {
+		email.Attachments = append(email.Attachments, Attachment{Name: filepath.Base(path), Path: path})
 	}
-
-	if len(msg.AttachmentMap) > 0 {
-		for key, value := range msg.AttachmentMap {
-			email.AddAttachment(value, key)
-		}
+	for name, path := range msg.AttachmentMap {
+		email.Attachments = append(email.Attachments, Attachment{Name: name, Path: path})
 	}
-	// send email
-	err = email.Send(smptClient)
-	if err != nil {
-		errChan <- err
+	for name, content := range msg.AttachmentData {
+		email.Attachments = append(email.Attachments, Attachment{Name: name, Data: content})
 	}
+	// send email
+	return m.Transport.Send(email)
 }
+
 func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
 	templateToRender := fmt.Sprintf("./cmd/web/templates/%s.html.gohtml", msg.Template)
 
@@ -158,22 +125,6 @@ func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
 	return plainMessage, nil
 }
 
-func (m *Mail) getEncryption(s string) mail.Encryption {
-	switch s {
-	case "tls":
-		return mail.EncryptionTLS
-
-	case "ssl":
-		return mail.EncryptionSSLTLS
-
-	case "none", "":
-		return mail.EncryptionNone
-
-	default:
-		return mail.EncryptionSTARTTLS
-	}
-}
-
 func (m *Mail) inlineCSS(s string) (string, error) {
 	options := premailer.Options{
 		RemoveClasses:     false,
@@ -190,3 +141,60 @@ func (m *Mail) inlineCSS(s string) (string, error) {
 	}
 	return html, nil
 }
+
+// SMTPTransport sends mail to an SMTP server
+type SMTPTransport struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+}
+
+// Send hands email to the SMTP server
+func (t *SMTPTransport) Send(e *Email) error {
+	server := mail.NewSMTPClient()
+	server.Host = t.Host
+	server.Port = t.Port
+	server.Username = t.Username
+	server.Password = t.Password
+	server.Encryption = getEncryption(t.Encryption)
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	smptClient, err := server.Connect()
+	if err != nil {
+		return err
+	}
+	email := mail.NewMSG()
+	email.SetFrom(e.From).
+		AddTo(e.To).
+		SetSubject(e.Subject)
+	email.SetBody(mail.TextPlain, e.PlainBody)
+	email.AddAlternative(mail.TextHTML, e.HTMLBody)
+	for _, a := range e.Attachments {
+		if a.Data != nil {
+			email.Attach(&mail.File{Name: a.Name, Data: a.Data})
+			continue
+		}
+		email.AddAttachment(a.Path, a.Name)
+	}
+	return email.Send(smptClient)
+}
+
+func getEncryption(s string) mail.Encryption {
+	switch s {
+	case "tls":
+		return mail.EncryptionTLS
+
+	case "ssl":
+		return mail.EncryptionSSLTLS
+
+	case "none", "":
+		return mail.EncryptionNone
+
+	default:
+		return mail.EncryptionSTARTTLS
+	}
+}
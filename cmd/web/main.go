@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"subscription_service/data"
+	"subscription_service/events"
 	"sync"
 	"syscall"
 	"time"
@@ -27,8 +30,27 @@ func main() {
 	// connect to the database
 	db := initDB()
 
+	// connect to redis
+	redisPool := initRedis()
+
 	// create sessions
-	session := initSession()
+	session := initSession(redisPool)
+
+	// set up url signing
+	signer, err := NewURLSigner(os.Getenv("SIGNING_KEYS"), os.Getenv("SIGNING_KEY_ID"), envString("SIGNING_AUDIENCE", "subscription_service"))
+	if err != nil {
+		log.Panic(err)
+	}
+	urls, err := NewURLBuilder(envString("PUBLIC_URL", fmt.Sprintf("http://localhost:%s", PORT)), signer)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// the proxies whose X-Forwarded-For headers say who the client is
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Panic(err)
+	}
 
 	// create loggers
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
@@ -37,20 +59,84 @@ func main() {
 
 	// create a wait group
 	wg := sync.WaitGroup{}
+	// create the event bus, which the outbox relay hands events to;
+	// subscribers are tracked by the wait group, so that shutting down waits
+	// for them
+	bus := events.New(&wg, func(subscriber string, e events.Event, err error) {
+		errorLog.Printf("%s subscriber failed on %s: %s", subscriber, e.EventName(), err)
+	})
 	// set up the application config
 	app := Config{
 		Session:       session,
 		DB:            db,
+		Redis:         redisPool,
+		URLs:          urls,
 		Wait:          &wg,
 		InfoLog:       infoLog,
 		ErrorLog:      errorLog,
+		Events:        bus,
 		Models:        data.New(db),
 		ErrorChan:     make(chan error),
 		ErrorChanDone: make(chan bool),
+		ActivationTTL: envDuration("ACTIVATION_LINK_TTL", 24*time.Hour),
+		UserCache:     newUserCache(envDuration("USER_CACHE_TTL", 5*time.Second)),
+		WebhookClient: newWebhookClient(),
+		WebhookDone:   make(chan bool),
+		OutboxDone:    make(chan bool),
+		JobsDone:      make(chan bool),
+		SchedulerDone: make(chan bool),
+		InstanceID:    newInstanceID(),
+		// comma separated, so that a new secret can be added before the old one is removed
+		PaymentWebhookSecrets: parseSecrets(os.Getenv("PAYMENT_WEBHOOK_SECRETS")),
+		TrustedProxies:        proxies,
+	}
+	// register what follows from changes made through the models
+	app.subscribe()
+
+	// refuse to run against a database which is missing changes to the schema
+	pending, err := data.PendingMigrations()
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(pending) > 0 {
+		log.Panicf("the database is missing migrations %s; run make migrate", strings.Join(pending, ", "))
+	}
+
+	// set up encryption of the secrets kept in the database, and encrypt any
+	// stored before they were encrypted
+	err = data.SetEncryptionKeys(os.Getenv("ENCRYPTION_KEYS"), os.Getenv("ENCRYPTION_KEY_ID"))
+	if err != nil {
+		log.Panic(err)
 	}
+	n, err := app.Models.User.EncryptTOTPSecrets()
+	if err != nil {
+		log.Panic(err)
+	}
+	if n > 0 {
+		app.InfoLog.Printf("encrypted %d two factor secrets", n)
+	}
+
 	// set up mail
-	app.Mailer = app.createMail()
-	go app.listenForMail()
+	app.Mailer, err = app.createMail()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// send email and events from the outbox
+	go app.listenForOutbox()
+
+	// run background jobs
+	go app.listenForJobs()
+
+	// run recurring maintenance tasks
+	err = app.registerSchedule()
+	if err != nil {
+		log.Panic(err)
+	}
+	go app.listenForSchedule()
+
+	// send webhooks
+	go app.listenForWebhooks()
 
 	// listen for signals
 	go app.listenForShutdown()
@@ -82,6 +168,45 @@ func (app *Config) serve() {
 		log.Panic(err)
 	}
 }
+
+// envString reads an environment variable, falling back to def if it is not set
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads a number from an environment variable, falling back to def
+// if it is not set or cannot be parsed
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid number %q for %s, using %d", v, key, def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration such as "48h" or "90m" from an environment
+// variable, falling back to def if it is not set or cannot be parsed
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid duration %q for %s, using %s", v, key, def)
+		return def
+	}
+	return d
+}
+
 func initDB() *sql.DB {
 	conn := connectToDB()
 	if conn == nil {
@@ -130,11 +255,13 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func initSession() *scs.SessionManager {
+func initSession(redisPool *redis.Pool) *scs.SessionManager {
+	// sessions no longer store the user, but older ones still in redis do, and
+	// they must still decode until they expire
 	gob.Register(data.User{})
 	// set up session
 	session := scs.New()
-	session.Store = redisstore.New(initRedis())
+	session.Store = redisstore.New(redisPool)
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
@@ -168,37 +295,44 @@ func (app *Config) shutdown() {
 	// perform any clean up tasks
 	app.InfoLog.Println("would run clean up tasks")
 
+	// stop taking jobs, and let the running ones finish
+	app.JobsDone <- true
+	// stop starting scheduled tasks, and ask the running ones to finish early
+	app.SchedulerDone <- true
+
+	// stop relaying the outbox once the batch being sent is done, since
+	// the subscribers it runs are added to the wait group
+	app.OutboxDone <- true
+
 	// block until wait group is empty
 	app.Wait.Wait()
 
-	app.Mailer.DoneChan <- true
+	app.WebhookDone <- true
 	app.ErrorChanDone <- true
 
 	app.InfoLog.Println("closing channels and shutting down application...")
-	close(app.Mailer.MailerChan)
-	close(app.Mailer.ErrorChan)
-	close(app.Mailer.DoneChan)
+	close(app.OutboxDone)
+	close(app.JobsDone)
+	close(app.SchedulerDone)
+	close(app.WebhookDone)
 	close(app.ErrorChanDone)
 	close(app.ErrorChan)
 }
 
-func (app *Config) createMail() Mail {
-	// create channels
-	errorChan := make(chan error)
-	mailerChan := make(chan Message, 100)
-	mailerDoneChan := make(chan bool)
-
+// createMail sets up mail to go through the transport named by
+// MAIL_TRANSPORT: smtp, the default, sends it to the server at MAIL_HOST and
+// MAIL_PORT; file writes it to .eml files in MAIL_DIR; and memory keeps it
+// in memory, for tests
+func (app *Config) createMail() (Mail, error) {
+	transport, err := newTransport(os.Getenv("MAIL_TRANSPORT"), envString("MAIL_DIR", "./tmp/mail"))
+	if err != nil {
+		return Mail{}, err
+	}
 	m := Mail{
 		Domain:      "localhost",
-		Host:        "localhost",
-		Port:        1025,
-		Encryption:  "none",
 		FromName:    "Info",
 		FromAddress: "info@test.net",
-		Wait:        app.Wait,
-		MailerChan:  mailerChan,
-		DoneChan:    mailerDoneChan,
-		ErrorChan:   errorChan,
+		Transport:   transport,
 	}
-	return m
+	return m, nil
 }
@@ -1,11 +1,33 @@
 package main
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+)
+
+type contextKey string
+
+const contextUserKey contextKey = "user"
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 }
 
+// SessionRevocation logs out sessions which have been revoked, e.g. from the
+// security page or because the user's password was reset
+func (app *Config) SessionRevocation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.IsAuthenticated(r) && !app.checkSession(r) {
+			_ = app.Session.Destroy(r.Context())
+			_ = app.Session.RenewToken(r.Context())
+			app.Session.Put(r.Context(), "warning", "your session has expired, please log in again")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *Config) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userID") {
@@ -17,3 +39,81 @@ func (app *Config) Auth(next http.Handler) http.Handler {
 	})
 
 }
+
+// AdminOnly only lets staff, that is users with at least one role, through. The
+// user is loaded from the database rather than the session, so that revoking a
+// role takes effect immediately, and is made available to later handlers
+// through the request context.
+func (app *Config) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "userID") {
+			app.Session.Put(r.Context(), "error", "log in first")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		user := app.currentUser(r)
+		if !user.IsStaff() || user.Active != 1 {
+			app.Session.Put(r.Context(), "error", "you are not authorized to view that page")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		// staff must protect their accounts with two factor authentication
+		if user.TOTPEnabled != 1 {
+			app.Session.Put(r.Context(), "warning", "staff accounts must enable two factor authentication before using the admin console")
+			http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission only lets users whose roles grant permission p through. It
+// must be used after AdminOnly.
+func (app *Config) RequirePermission(p string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.currentUser(r).HasPermission(p) {
+				app.InfoLog.Printf("user %d denied %s %s: missing %s", app.Session.GetInt(r.Context(), "userID"), r.Method, r.URL.Path, p)
+				app.Session.Put(r.Context(), "error", "you do not have permission to do that")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Impersonation records every request made while an admin is impersonating
+// a user in the audit log, and blocks requests which change state unless the
+// admin is allowed to make changes on the user's behalf.
+func (app *Config) Impersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.IsImpersonating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		adminID := app.Session.GetInt(r.Context(), "impersonatorID")
+		targetID := app.Session.GetInt(r.Context(), "userID")
+		detail := fmt.Sprintf("%s %s", r.Method, r.URL.RequestURI())
+
+		if r.URL.Path != "/impersonation/stop" && !app.Session.GetBool(r.Context(), "impersonationWrite") && isDestructive(r) {
+			app.audit(r, adminID, targetID, "impersonation.blocked", detail)
+			app.Session.Put(r.Context(), "warning", "that action is not allowed while impersonating a user")
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+
+		app.audit(r, adminID, targetID, "impersonation.request", detail)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isDestructive reports whether a request may change state. Routes which
+// change state must never be served over GET.
+func isDestructive(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
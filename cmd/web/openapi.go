@@ -0,0 +1,106 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// openAPIPath is where the OpenAPI document is served, relative to /api
+const openAPIPath = "/openapi.json"
+
+// openAPIFiles holds the OpenAPI document describing every /api endpoint. It
+// is written by hand; whoever adds, removes or changes an endpoint updates it
+// in the same change, and TestAPISpec fails until they do.
+//
+//go:embed openapi/openapi.json
+var openAPIFiles embed.FS
+
+// openAPIDocument is the part of the OpenAPI document checkAPISpec reads
+type openAPIDocument struct {
+	OpenAPI string                                `json:"openapi"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// OpenAPISpec serves the OpenAPI document. It needs no authentication.
+func (app *Config) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	spec, err := openAPIFiles.ReadFile("openapi/openapi.json")
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to read the API description")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_, _ = w.Write(spec)
+}
+
+// checkAPISpec compares the routes registered on the API router with the
+// operations in the OpenAPI document, and returns an error listing every
+// endpoint that one has and the other does not.
+func (app *Config) checkAPISpec() error {
+	spec, err := openAPIFiles.ReadFile("openapi/openapi.json")
+	if err != nil {
+		return err
+	}
+	routes, ok := app.apiRouter().(chi.Routes)
+	if !ok {
+		return fmt.Errorf("the API router cannot be walked")
+	}
+	return diffAPISpec(spec, routes)
+}
+
+// diffAPISpec compares the routes of a router mounted at /api with the
+// operations in an OpenAPI document
+func diffAPISpec(spec []byte, routes chi.Routes) error {
+	var doc openAPIDocument
+	err := json.Unmarshal(spec, &doc)
+	if err != nil {
+		return fmt.Errorf("openapi.json: %w", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return fmt.Errorf("openapi.json: expected an OpenAPI 3 document, got version %q", doc.OpenAPI)
+	}
+
+	documented := make(map[string]bool)
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			switch method {
+			case "parameters", "summary", "description", "servers":
+				continue
+			}
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	registered := make(map[string]bool)
+	err = chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		registered[method+" /api"+strings.TrimSuffix(route, "/")] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for endpoint := range registered {
+		if !documented[endpoint] {
+			problems = append(problems, endpoint+" is routed but not in openapi.json")
+		}
+	}
+	for endpoint := range documented {
+		if !registered[endpoint] {
+			problems = append(problems, endpoint+" is in openapi.json but not routed")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("the API and its OpenAPI document disagree:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
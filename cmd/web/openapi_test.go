@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestAPISpec fails when the API routes and openapi.json drift apart. Update
+// openapi.json in the same change as the routes.
+func TestAPISpec(t *testing.T) {
+	app := &Config{}
+	if err := app.checkAPISpec(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffAPISpec(t *testing.T) {
+	router := chi.NewRouter()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	router.Get("/v1/plans", noop)
+	router.Post("/v1/subscription", noop)
+
+	tests := []struct {
+		name     string
+		spec     string
+		problems []string
+	}{
+		{
+			name: "matching",
+			spec: `{"openapi": "3.0.3", "paths": {
+				"/api/v1/plans": {"summary": "Plans", "get": {}},
+				"/api/v1/subscription": {"parameters": [], "post": {}}}}`,
+		},
+		{
+			name:     "route missing from the document",
+			spec:     `{"openapi": "3.0.3", "paths": {"/api/v1/plans": {"get": {}}}}`,
+			problems: []string{"POST /api/v1/subscription is routed but not in openapi.json"},
+		},
+		{
+			name: "documented operation not routed",
+			spec: `{"openapi": "3.0.3", "paths": {
+				"/api/v1/plans": {"get": {}},
+				"/api/v1/subscription": {"post": {}, "delete": {}}}}`,
+			problems: []string{"DELETE /api/v1/subscription is in openapi.json but not routed"},
+		},
+		{
+			name:     "not OpenAPI 3",
+			spec:     `{"swagger": "2.0", "paths": {}}`,
+			problems: []string{"expected an OpenAPI 3 document"},
+		},
+		{
+			name:     "not JSON",
+			spec:     `openapi: 3.0.3`,
+			problems: []string{"openapi.json"},
+		},
+	}
+	for _, tt := range tests {
+		err := diffAPISpec([]byte(tt.spec), router)
+		if len(tt.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		for _, p := range tt.problems {
+			if !strings.Contains(err.Error(), p) {
+				t.Errorf("%s: error %q does not mention %q", tt.name, err, p)
+			}
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	app := &Config{ErrorLog: log.New(io.Discard, "", 0)}
+	w := httptest.NewRecorder()
+	app.OpenAPISpec(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Paths) == 0 {
+		t.Error("the served document describes no paths")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"subscription_service/data"
+	"sync"
+	"time"
+)
+
+const (
+	// outboxPollInterval is how often the outbox is checked for messages which are due
+	outboxPollInterval = time.Second
+	// outboxBatchSize is how many messages are sent at once
+	outboxBatchSize = 20
+	// outboxLease is how long a claimed message is held before another relay may try it
+	outboxLease = 2 * time.Minute
+	// outboxMaxAttempts is how many times a message is tried before it is given up on
+	outboxMaxAttempts = 10
+	// outboxFirstRetry is the wait after the first failure; it doubles after each failure after that
+	outboxFirstRetry = 10 * time.Second
+	// outboxMaxRetry caps the wait between two attempts
+	outboxMaxRetry = time.Hour
+)
+
+// outboxEmail is how an email is kept in the outbox
+type outboxEmail struct {
+	Message
+	// HTML is set when the data of the message is template.HTML, which
+	// would otherwise come back out of JSON as a string and be escaped
+	HTML bool
+}
+
+func emailForOutbox(msg Message) outboxEmail {
+	_, html := msg.Data.(template.HTML)
+	return outboxEmail{Message: msg, HTML: html}
+}
+
+// listenForOutbox relays messages from the outbox until it is told to stop.
+// Several instances of the application may run this at once; each message is
+// only claimed by one of them at a time.
+func (app *Config) listenForOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.relayOutbox()
+		case <-app.OutboxDone:
+			return
+		}
+	}
+}
+
+// relayOutbox claims the messages which are due, and sends them in parallel
+func (app *Config) relayOutbox() {
+	messages, err := app.Models.Outbox.ClaimDue(outboxBatchSize, outboxLease)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range messages {
+		wg.Add(1)
+		go func(m *data.OutboxMessage) {
+			defer wg.Done()
+			app.relayMessage(m)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// relayMessage makes one attempt to send a message, and records the outcome.
+// When an event fails, only the subscribers which have not handled it yet are
+// run again. A subscriber which stops between acting on an event and being
+// marked as having handled it runs again too, so they still see each event
+// at least once rather than exactly once.
+func (app *Config) relayMessage(m *data.OutboxMessage) {
+	err := app.deliverOutbox(m)
+	if err == nil {
+		err = m.Delivered()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	var retryAt time.Time
+	if m.Attempts+1 < outboxMaxAttempts {
+		retryAt = time.Now().Add(backoff(m.Attempts+1, outboxFirstRetry, outboxMaxRetry))
+		app.ErrorLog.Printf("outbox message %d (%s %s) failed, trying again at %s: %s",
+			m.ID, m.Kind, m.Name, retryAt.Format(time.RFC3339), err)
+	} else {
+		app.ErrorLog.Printf("giving up on outbox message %d (%s %s) after %d attempts: %s",
+			m.ID, m.Kind, m.Name, m.Attempts+1, err)
+	}
+	err = m.Failed(err.Error(), retryAt)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// deliverOutbox sends one message: an email to the mail server, or an event
+// to its subscribers
+func (app *Config) deliverOutbox(m *data.OutboxMessage) error {
+	switch m.Kind {
+	case data.OutboxEmail:
+		var email outboxEmail
+		err := json.Unmarshal([]byte(m.Payload), &email)
+		if err != nil {
+			return err
+		}
+		if s, ok := email.Data.(string); ok && email.HTML {
+			email.Data = template.HTML(s)
+		}
+		return app.Mailer.sendMail(email.Message)
+	case data.OutboxEvent:
+		e, err := data.DecodeEvent(m.ID, m.Name, m.Payload)
+		if err != nil {
+			return err
+		}
+		handled, err := m.HandledBy()
+		if err != nil {
+			return err
+		}
+		return app.Events.Dispatch(e, &outboxProgress{message: m, handled: handled})
+	default:
+		return fmt.Errorf("unknown kind of outbox message %q", m.Kind)
+	}
+}
+
+// outboxProgress records which subscribers have handled the event in an
+// outbox message
+type outboxProgress struct {
+	message *data.OutboxMessage
+	handled map[string]bool
+}
+
+func (p *outboxProgress) Handled(subscriber string) bool {
+	return p.handled[subscriber]
+}
+
+func (p *outboxProgress) MarkHandled(subscriber string) error {
+	return p.message.MarkHandled(subscriber)
+}
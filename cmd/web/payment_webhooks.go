@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"subscription_service/data"
+	"subscription_service/webhooks"
+	"time"
+)
+
+const (
+	// paymentSignatureHeader carries the signature of webhooks from the payment provider
+	paymentSignatureHeader = "Payment-Signature"
+	// paymentSignatureTolerance is how old a signed webhook may be before it is refused
+	paymentSignatureTolerance = 5 * time.Minute
+	// paymentMaxBodyBytes is the largest webhook body which is read
+	paymentMaxBodyBytes = 1 << 20
+)
+
+// Events sent by the payment provider
+const (
+	paymentSucceeded            = "payment.succeeded"
+	paymentFailed               = "payment.failed"
+	paymentRefunded             = "payment.refunded"
+	paymentSubscriptionCanceled = "subscription.canceled"
+)
+
+// errUnprocessable wraps errors from payment event handlers which no amount of
+// retrying will fix, such as an event about an invoice which does not exist.
+// Such events are recorded as failed, but acknowledged, so that the provider
+// stops sending them; they need someone to look at them.
+var errUnprocessable = errors.New("payment event cannot be processed")
+
+// paymentEvent is the body of every webhook from the payment provider
+type paymentEvent struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      paymentEventData `json:"data"`
+}
+
+// paymentEventData is what a payment event is about. Which fields are set
+// depends on the type of the event.
+type paymentEventData struct {
+	InvoiceID int    `json:"invoice_id"`
+	UserID    int    `json:"user_id"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+}
+
+// paymentHandlers returns the handler for each type of payment event. Every
+// handler must be idempotent, since the provider may send an event more than
+// once, and a failed event is processed again when it is redelivered.
+func (app *Config) paymentHandlers() map[string]func(*http.Request, *paymentEvent) error {
+	return map[string]func(*http.Request, *paymentEvent) error{
+		paymentSucceeded:            app.handlePaymentSucceeded,
+		paymentFailed:               app.handlePaymentFailed,
+		paymentRefunded:             app.handlePaymentRefunded,
+		paymentSubscriptionCanceled: app.handleProviderCanceledSubscription,
+	}
+}
+
+// PaymentWebhook receives webhooks from the payment provider. Each webhook is
+// checked against its signature, stored as it was received, and then handed to
+// the handler for its type, at most once no matter how often it is sent.
+func (app *Config) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(app.PaymentWebhookSecrets) == 0 {
+		app.ErrorLog.Println("payment webhook received, but PAYMENT_WEBHOOK_SECRETS is not set")
+		app.errorJSON(w, http.StatusServiceUnavailable, "not_configured", "payment webhooks are not configured")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, paymentMaxBodyBytes))
+	if err != nil {
+		app.errorJSON(w, http.StatusRequestEntityTooLarge, "invalid_request", "the body is too large")
+		return
+	}
+	err = webhooks.Verify(r.Header.Get(paymentSignatureHeader), body, app.PaymentWebhookSecrets, paymentSignatureTolerance, time.Now())
+	if err != nil {
+		app.ErrorLog.Printf("refused payment webhook from %s: %s", clientIP(r), err)
+		app.errorJSON(w, http.StatusBadRequest, "invalid_signature", err.Error())
+		return
+	}
+
+	var event paymentEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil || event.ID == "" || event.Type == "" {
+		app.errorJSON(w, http.StatusBadRequest, "invalid_request", "the body must be an event with an id and a type")
+		return
+	}
+
+	stored, _, err := app.Models.Payment.Record(event.ID, event.Type, string(body))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to store the event")
+		return
+	}
+
+	claimed, err := stored.Claim()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to process the event")
+		return
+	}
+	if !claimed {
+		if stored.Status == data.PaymentEventProcessing {
+			// it is being processed right now; the provider will send it again
+			app.errorJSON(w, http.StatusConflict, "in_progress", "the event is already being processed")
+			return
+		}
+		app.writeJSON(w, http.StatusOK, map[string]string{"status": "duplicate"})
+		return
+	}
+
+	handler, ok := app.paymentHandlers()[event.Type]
+	if !ok {
+		app.finishPaymentEvent(stored, data.PaymentEventIgnored, "")
+		app.writeJSON(w, http.StatusOK, map[string]string{"status": data.PaymentEventIgnored})
+		return
+	}
+
+	err = handler(r, &event)
+	switch {
+	case err == nil:
+		app.finishPaymentEvent(stored, data.PaymentEventProcessed, "")
+		app.writeJSON(w, http.StatusOK, map[string]string{"status": data.PaymentEventProcessed})
+	case errors.Is(err, errUnprocessable):
+		app.ErrorLog.Printf("payment event %s: %s", event.ID, err)
+		app.finishPaymentEvent(stored, data.PaymentEventFailed, err.Error())
+		app.writeJSON(w, http.StatusOK, map[string]string{"status": data.PaymentEventFailed})
+	default:
+		// a temporary failure, so ask the provider to send the event again
+		app.ErrorLog.Printf("payment event %s: %s", event.ID, err)
+		app.finishPaymentEvent(stored, data.PaymentEventFailed, err.Error())
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "unable to process the event")
+	}
+}
+
+func (app *Config) finishPaymentEvent(event *data.PaymentEvent, status, lastError string) {
+	err := event.Finish(status, lastError)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// handlePaymentSucceeded marks the invoice paid
+func (app *Config) handlePaymentSucceeded(r *http.Request, event *paymentEvent) error {
+	invoice, u, err := app.paymentInvoice(event)
+	if err != nil {
+		return err
+	}
+	switch invoice.Status {
+	case data.InvoicePaid:
+		return nil
+	case data.InvoicePending:
+	default:
+		return fmt.Errorf("%w: invoice %d is %s and cannot be paid", errUnprocessable, invoice.ID, invoice.Status)
+	}
+	if event.Data.Amount != 0 && event.Data.Amount != invoice.Amount {
+		return fmt.Errorf("%w: paid %d for invoice %d of %d", errUnprocessable, event.Data.Amount, invoice.ID, invoice.Amount)
+	}
+
+	err = invoice.UpdateStatus(data.InvoicePaid)
+	if err != nil {
+		return err
+	}
+	app.auditChange(r, 0, u.ID, "payment.invoice_paid", fmt.Sprintf("invoice %d, payment event %s", invoice.ID, event.ID),
+		map[string]any{"status": data.InvoicePending}, map[string]any{"status": invoice.Status})
+	return nil
+}
+
+// handlePaymentFailed leaves the invoice pending, and lets the member know
+// their payment did not go through
+func (app *Config) handlePaymentFailed(r *http.Request, event *paymentEvent) error {
+	invoice, u, err := app.paymentInvoice(event)
+	if err != nil {
+		return err
+	}
+	if invoice.Status != data.InvoicePending {
+		// a late failure for an invoice which has since been settled
+		return nil
+	}
+
+	app.audit(r, 0, u.ID, "payment.failed", fmt.Sprintf("invoice %d, payment event %s: %s", invoice.ID, event.ID, event.Data.Reason))
+	msg := Message{
+		To:      u.Email,
+		Subject: "your payment did not go through",
+		Data: fmt.Sprintf("We could not take the payment of %s for your %s invoice. Please check your payment details.",
+			invoice.AmountFormatted, invoice.PlanName),
+	}
+	return app.sendEmail(msg)
+}
+
+// handlePaymentRefunded marks the invoice refunded
+func (app *Config) handlePaymentRefunded(r *http.Request, event *paymentEvent) error {
+	invoice, u, err := app.paymentInvoice(event)
+	if err != nil {
+		return err
+	}
+	switch invoice.Status {
+	case data.InvoiceRefunded:
+		return nil
+	case data.InvoicePaid:
+	default:
+		return fmt.Errorf("%w: invoice %d is %s and cannot be refunded", errUnprocessable, invoice.ID, invoice.Status)
+	}
+
+	err = invoice.UpdateStatus(data.InvoiceRefunded)
+	if err != nil {
+		return err
+	}
+	app.auditChange(r, 0, u.ID, "payment.invoice_refunded", fmt.Sprintf("invoice %d, payment event %s", invoice.ID, event.ID),
+		map[string]any{"status": data.InvoicePaid}, map[string]any{"status": invoice.Status})
+	return nil
+}
+
+// handleProviderCanceledSubscription cancels the subscription of a member
+// whose subscription the provider has ended, for example after repeated
+// failed payments
+func (app *Config) handleProviderCanceledSubscription(r *http.Request, event *paymentEvent) error {
+	u, err := app.Models.User.GetOne(event.Data.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no user %d", errUnprocessable, event.Data.UserID)
+	}
+	if err != nil {
+		return err
+	}
+	if u.Plan == nil {
+		return nil
+	}
+
+	err = app.Models.Plan.CancelUserPlan(*u)
+	if err != nil {
+		return err
+	}
+	app.forgetUser(u.ID)
+	updated, err := app.Models.User.GetOne(u.ID)
+	if err != nil {
+		return err
+	}
+	app.auditChange(r, 0, u.ID, "payment.subscription_canceled", fmt.Sprintf("payment event %s: %s", event.ID, event.Data.Reason),
+		userState(u), userState(updated))
+	return nil
+}
+
+// paymentInvoice loads the invoice a payment event is about, and its user
+func (app *Config) paymentInvoice(event *paymentEvent) (*data.Invoice, *data.User, error) {
+	invoice, err := app.Models.Invoice.GetOne(event.Data.InvoiceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("%w: no invoice %d", errUnprocessable, event.Data.InvoiceID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if event.Data.UserID != 0 && event.Data.UserID != invoice.UserID {
+		return nil, nil, fmt.Errorf("%w: invoice %d does not belong to user %d", errUnprocessable, invoice.ID, event.Data.UserID)
+	}
+	u, err := app.Models.User.GetOne(invoice.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return invoice, u, nil
+}
+
+// parseSecrets splits a comma separated list of secrets, such as the value of PAYMENT_WEBHOOK_SECRETS
+func parseSecrets(s string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(s, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
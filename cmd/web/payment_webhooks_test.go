@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"subscription_service/webhooks"
+	"testing"
+	"time"
+)
+
+// TestPaymentWebhookRefused covers the webhooks which are refused before
+// anything is stored
+func TestPaymentWebhookRefused(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"payment.succeeded","data":{"invoice_id":1}}`)
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		secrets    []string
+		body       []byte
+		signature  string
+		wantStatus int
+		wantCode   string
+	}{
+		{"not configured", nil, body, webhooks.Sign("whsec_a", now, body), http.StatusServiceUnavailable, "not_configured"},
+		{"unsigned", []string{"whsec_a"}, body, "", http.StatusBadRequest, "invalid_signature"},
+		{"wrong secret", []string{"whsec_a"}, body, webhooks.Sign("whsec_b", now, body), http.StatusBadRequest, "invalid_signature"},
+		{"signed for another body", []string{"whsec_a"}, body, webhooks.Sign("whsec_a", now, []byte(`{}`)), http.StatusBadRequest, "invalid_signature"},
+		{"replayed", []string{"whsec_a"}, body, webhooks.Sign("whsec_a", now.Add(-time.Hour), body), http.StatusBadRequest, "invalid_signature"},
+		{"signed but not an event", []string{"whsec_a"}, []byte(`{"id":""}`), webhooks.Sign("whsec_a", now, []byte(`{"id":""}`)), http.StatusBadRequest, "invalid_request"},
+		{"signed but not JSON", []string{"whsec_a"}, []byte(`nope`), webhooks.Sign("whsec_a", now, []byte(`nope`)), http.StatusBadRequest, "invalid_request"},
+	}
+	for _, tt := range tests {
+		app := &Config{
+			ErrorLog:              log.New(io.Discard, "", 0),
+			PaymentWebhookSecrets: tt.secrets,
+		}
+		r := httptest.NewRequest("POST", "/webhooks/payments", bytes.NewReader(tt.body))
+		if tt.signature != "" {
+			r.Header.Set(paymentSignatureHeader, tt.signature)
+		}
+		w := httptest.NewRecorder()
+		app.PaymentWebhook(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		var resp apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if resp.Error.Code != tt.wantCode {
+			t.Errorf("%s: got code %s, want %s", tt.name, resp.Error.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"whsec_a", 1},
+		{" whsec_a , whsec_b ,", 2},
+	}
+	for _, tt := range tests {
+		if got := parseSecrets(tt.value); len(got) != tt.want {
+			t.Errorf("%q: got %d secrets, want %d", tt.value, len(got), tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies reads a comma separated list of the addresses, or CIDR
+// ranges, of the proxies in front of the application
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR range", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR range", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// RealIP sets the remote address of a request which came through one of our
+// trusted proxies to the address of the client, so that rate limits, the audit
+// log and the sessions page see who really made it. Each proxy appends the
+// address it received the request from to X-Forwarded-For, so the client is
+// the last address which is not one of our proxies; anything before that was
+// sent by the client, and can't be believed. Requests which did not come
+// through a trusted proxy keep the address they connected from.
+func (app *Config) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedClientIP(r, app.TrustedProxies); ip != "" {
+			r.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the address of the client a trusted proxy
+// forwarded a request for, or "" if it did not come through one
+func forwardedClientIP(r *http.Request, proxies []*net.IPNet) string {
+	if !isTrustedProxy(clientIP(r), proxies) {
+		return ""
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// a proxy we trust would not have written this, so stop here
+			return ""
+		}
+		if !isTrustedProxy(hops[i], proxies) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func isTrustedProxy(addr string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
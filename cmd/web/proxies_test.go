@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		count int
+		ok    bool
+	}{
+		{"none", "", 0, true},
+		{"addresses", "10.0.0.1, ::1", 2, true},
+		{"ranges", "10.0.0.0/8,fd00::/8", 2, true},
+		{"not an address", "proxy.internal", 0, false},
+		{"bad range", "10.0.0.0/99", 0, false},
+	}
+	for _, tt := range tests {
+		proxies, err := parseTrustedProxies(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if len(proxies) != tt.count {
+			t.Errorf("%s: got %d proxies, want %d", tt.name, len(proxies), tt.count)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Config{TrustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxy", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer can't claim an address", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"through a trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"through two trusted proxies", "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"client supplied hops are ignored", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"several headers", "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"ipv6 client", "10.0.0.2:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"trusted proxy without the header", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"garbage from the proxy", "10.0.0.2:5000", []string{"not-an-ip"}, "10.0.0.2"},
+		{"only proxies", "10.0.0.2:5000", []string{"10.0.0.4"}, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		var got string
+		handler := app.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = clientIP(r)
+		}))
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
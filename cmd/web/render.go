@@ -6,11 +6,26 @@ import (
 	"net/http"
 	"path/filepath"
 	"subscription_service/data"
+	"subscription_service/forms"
 	"time"
 )
 
 var pathToTemplates, _ = filepath.Abs("./cmd/web/templates")
 
+var functions = template.FuncMap{
+	"can":            can,
+	"idempotencyKey": newIdempotencyKey,
+}
+
+// can is used in templates to show or hide things depending on the permissions
+// of the logged in user, e.g. {{if can .User "plans.manage"}}
+func can(u *data.User, p string) bool {
+	if u == nil {
+		return false
+	}
+	return u.HasPermission(p)
+}
+
 type TemplateData struct {
 	StringMaps    map[string]string
 	IntMap        map[string]int
@@ -20,6 +35,9 @@ type TemplateData struct {
 	Warning       string
 	Error         string
 	Authenticated bool
+	CSRFToken     string
+	Impersonator  string
+	Form          *forms.Form
 	Now           time.Time
 	User          *data.User
 }
@@ -43,7 +61,7 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	tmpl, err := template.New(t).Funcs(functions).ParseFiles(templateSlice...)
 	if err != nil {
 		app.ErrorLog.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -60,15 +78,19 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	td.Error = app.Session.PopString(r.Context(), "error")
+	td.CSRFToken = app.csrfToken(r)
+	if td.Form == nil {
+		td.Form = forms.New(nil)
+	}
 	if app.IsAuthenticated(r) {
 		td.Authenticated = true
-		user, ok := app.Session.Get(r.Context(), "user").(data.User)
-		if !ok {
-			app.ErrorLog.Println("cant get user from session")
-		} else {
-			td.User = &user
+		if u := app.currentUser(r); u.ID != 0 {
+			td.User = u
 		}
 	}
+	if app.IsImpersonating(r) {
+		td.Impersonator = app.Session.GetString(r.Context(), "impersonatorName")
+	}
 	td.Now = time.Now()
 	return td
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
+	"subscription_service/data"
 )
 
 func (app *Config) routes() http.Handler {
@@ -11,37 +12,36 @@ func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	// setup middleware
+	mux.Use(app.RealIP)
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.SessionLoad)
+	mux.Use(app.SessionRevocation)
+	mux.Use(app.LoadUser)
+	mux.Use(app.CSRF)
+	mux.Use(app.Impersonation)
 
 	// define application routes
 	mux.Get("/", app.HomePage)
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
-	mux.Get("/logout", app.Logout)
+	mux.Get("/login/two-factor", app.TwoFactorLoginPage)
+	mux.Post("/login/two-factor", app.PostTwoFactorLoginPage)
+	mux.Post("/logout", app.Logout)
 	mux.Get("/register", app.RegisterPage)
 	mux.Post("/register", app.PostRegisterPage)
 	mux.Get("/activate", app.ActivateAccount)
-
-	mux.Get("/test-email", func(w http.ResponseWriter, r *http.Request) {
-		m := Mail{
-			Domain:      "localhost",
-			Host:        "localhost",
-			Port:        1025,
-			Encryption:  "none",
-			FromAddress: "test@company.com",
-			FromName:    "pratik",
-			ErrorChan:   make(chan error),
-		}
-		msg := Message{
-			To:      "me@here.com",
-			Subject: "test mail",
-			Data:    "Hello world",
-		}
-		m.sendMail(msg, make(chan error))
-	})
+	mux.Get("/resend-activation", app.ResendActivationPage)
+	mux.Post("/resend-activation", app.PostResendActivationPage)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.PostForgotPasswordPage)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.PostResetPasswordPage)
+	mux.Post("/impersonation/stop", app.StopImpersonation)
+	mux.With(app.Idempotent).Post("/webhooks/payments", app.PaymentWebhook)
 
 	mux.Mount("/members", app.authRouter())
+	mux.Mount("/admin", app.adminRouter())
+	mux.Mount("/api", app.apiRouter())
 	return mux
 }
 
@@ -49,7 +49,86 @@ func (app *Config) authRouter() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(app.Auth)
 	mux.Get("/plans", app.ChooseSubscription)
-	mux.Get("/subscribe", app.SubscribeToPlan)
+	mux.With(app.Idempotent).Post("/subscribe", app.SubscribeToPlan)
+	mux.Get("/security", app.SecurityPage)
+	mux.Post("/security/sessions/revoke", app.PostRevokeSession)
+	mux.Post("/security/sessions/revoke-others", app.PostRevokeOtherSessions)
+	mux.Post("/security/password", app.PostChangePassword)
+	mux.Get("/api-tokens", app.APITokensPage)
+	mux.Post("/api-tokens", app.PostCreateAPIToken)
+	mux.Post("/api-tokens/revoke", app.PostRevokeAPIToken)
+	mux.Get("/two-factor", app.TwoFactorPage)
+	mux.Post("/two-factor/enable", app.PostEnableTwoFactor)
+	mux.Post("/two-factor/disable", app.PostDisableTwoFactor)
+	mux.Post("/two-factor/recovery-codes", app.PostRegenerateRecoveryCodes)
+
+	return mux
+}
+
+func (app *Config) adminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.AdminOnly)
+	mux.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermUsersView))
+		mux.Get("/users", app.AdminUsers)
+		mux.Get("/users/{id}", app.AdminUser)
+	})
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermUsersManage))
+		mux.Post("/users/{id}", app.AdminPostUser)
+		mux.Post("/users/{id}/toggle-active", app.AdminToggleUserActive)
+		mux.Post("/users/{id}/delete", app.AdminDeleteUser)
+		mux.Post("/users/{id}/unlock", app.AdminUnlockUser)
+	})
+	mux.With(app.RequirePermission(data.PermImpersonate)).Post("/users/{id}/impersonate", app.StartImpersonation)
+	mux.With(app.RequirePermission(data.PermRolesManage)).Post("/users/{id}/roles", app.AdminPostUserRoles)
+	mux.With(app.RequirePermission(data.PermSubscriptionsManage), app.Idempotent).Post("/users/{id}/subscription", app.AdminPostUserSubscription)
+	mux.With(app.RequirePermission(data.PermInvoicesManage), app.Idempotent).Post("/users/{id}/invoices/{invoiceID}", app.AdminPostInvoiceStatus)
+	mux.With(app.RequirePermission(data.PermInvoicesRefund), app.Idempotent).Post("/users/{id}/invoices/{invoiceID}/refund", app.AdminRefundInvoice)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermPlansManage))
+		mux.Get("/plans", app.AdminPlans)
+		mux.Get("/plans/new", app.AdminPlan)
+		mux.Post("/plans/new", app.AdminPostPlan)
+		mux.Get("/plans/{id}", app.AdminPlan)
+		mux.Post("/plans/{id}", app.AdminPostPlan)
+		mux.Post("/plans/{id}/toggle-archived", app.AdminToggleArchivePlan)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermWebhooksManage))
+		mux.Get("/webhooks", app.AdminWebhooks)
+		mux.Get("/webhooks/new", app.AdminWebhook)
+		mux.Post("/webhooks/new", app.AdminPostWebhook)
+		mux.Get("/webhooks/deliveries", app.AdminWebhookDeliveries)
+		mux.Get("/webhooks/deliveries/{id}", app.AdminWebhookDelivery)
+		mux.Post("/webhooks/deliveries/{id}/redeliver", app.AdminRedeliverWebhook)
+		mux.Get("/webhooks/{id}", app.AdminWebhook)
+		mux.Post("/webhooks/{id}", app.AdminPostWebhook)
+		mux.Post("/webhooks/{id}/delete", app.AdminDeleteWebhook)
+		mux.Post("/webhooks/{id}/rotate-secret", app.AdminRotateWebhookSecret)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermJobsManage))
+		mux.Get("/jobs", app.AdminJobs)
+		mux.Get("/jobs/{id}", app.AdminJob)
+		mux.Post("/jobs/{id}/retry", app.AdminRetryJob)
+		mux.Post("/jobs/{id}/delete", app.AdminDeleteJob)
+		mux.Get("/tasks", app.AdminTasks)
+		mux.Post("/tasks/{name}/run", app.AdminRunTask)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequirePermission(data.PermAuditView))
+		mux.Get("/audit", app.AdminAudit)
+		mux.Post("/audit/verify", app.AdminVerifyAudit)
+	})
 
 	return mux
 }
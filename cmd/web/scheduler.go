@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"subscription_service/schedule"
+	"time"
+)
+
+// tmpDir is where earlier releases wrote the manuals they generated, and left
+// them. Manuals are now generated straight into the email which sends them,
+// so cleanTmp only has old files to clear out.
+const tmpDir = "./tmp"
+
+const (
+	// schedulePollInterval is how often the scheduled tasks are checked for ones which are due
+	schedulePollInterval = 15 * time.Second
+	// scheduleLeaseMargin is added to the timeout of a task to give how long a
+	// run is held, so that a run which times out is still recorded before
+	// another instance may take the task over
+	scheduleLeaseMargin = time.Minute
+	// renewalBatchSize is how many subscriptions are renewed in one transaction
+	renewalBatchSize = 50
+	// trialReminderLead is how long before a trial ends its subscriber is reminded
+	trialReminderLead = 3 * 24 * time.Hour
+)
+
+// scheduledTask is a task which runs on a cron schedule, in UTC. However
+// many instances of the application there are, each run of a task happens
+// in only one of them. Times are stored in local time, like every other time
+// in the database; only the schedule itself is read in UTC.
+type scheduledTask struct {
+	name string
+	// spec is the cron expression the task runs on
+	spec string
+	// timeout is how long a run may take before its context is cancelled
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// scheduledTasks returns the recurring maintenance tasks
+func (app *Config) scheduledTasks() []scheduledTask {
+	return []scheduledTask{
+		{name: "renew-subscriptions", spec: "*/15 * * * *", timeout: 5 * time.Minute, run: app.renewSubscriptions},
+		{name: "trial-reminders", spec: "0 9 * * *", timeout: 5 * time.Minute, run: app.remindTrialsEnding},
+		{name: "purge-tokens", spec: "@hourly", timeout: time.Minute, run: app.purgeTokens},
+		{name: "clean-tmp", spec: "0 3 * * *", timeout: 5 * time.Minute, run: app.cleanTmp},
+		{name: "purge-history", spec: "30 3 * * *", timeout: 5 * time.Minute, run: app.purgeHistory},
+	}
+}
+
+// newInstanceID returns a name for this instance of the application, which
+// is shown against the runs it makes and tells it apart from the others
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// registerSchedule records every scheduled task in the database, so that the
+// instances share when each is next due
+func (app *Config) registerSchedule() error {
+	now := time.Now().UTC()
+	for _, task := range app.scheduledTasks() {
+		s, err := schedule.Parse(task.spec)
+		if err != nil {
+			return fmt.Errorf("scheduled task %s: %w", task.name, err)
+		}
+		err = app.Models.Task.Register(task.name, task.spec, s.Next(now).Local())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenForSchedule runs scheduled tasks as they fall due until it is told
+// to stop. Running tasks are tracked by the wait group, so that shutting
+// down waits for them; they are asked to stop early by cancelling their
+// context.
+func (app *Config) listenForSchedule() {
+	ticker := time.NewTicker(schedulePollInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, task := range app.scheduledTasks() {
+				app.startScheduledTask(ctx, task)
+			}
+		case <-app.SchedulerDone:
+			return
+		}
+	}
+}
+
+// startScheduledTask claims a task if it is due and no other instance holds
+// it, and runs it
+func (app *Config) startScheduledTask(ctx context.Context, task scheduledTask) {
+	s, err := schedule.Parse(task.spec)
+	if err != nil {
+		app.ErrorLog.Printf("scheduled task %s: %s", task.name, err)
+		return
+	}
+	ok, err := app.Models.Task.Claim(task.name, app.InstanceID, task.timeout+scheduleLeaseMargin)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	app.Wait.Add(1)
+	go func() {
+		defer app.Wait.Done()
+		app.runScheduledTask(ctx, task)
+
+		err := app.Models.Task.Release(task.name, app.InstanceID, s.Next(time.Now().UTC()).Local())
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}()
+}
+
+// runScheduledTask runs one claimed task, and records the run
+func (app *Config) runScheduledTask(ctx context.Context, task scheduledTask) {
+	run, err := app.Models.TaskRun.Start(task.name, app.InstanceID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, task.timeout)
+	defer cancel()
+	runErr := callScheduledTask(ctx, task)
+
+	err = run.Finish(runErr)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if runErr != nil {
+		app.ErrorLog.Printf("scheduled task %s failed after %dms: %s", task.name, run.DurationMS, runErr)
+		return
+	}
+	app.InfoLog.Printf("scheduled task %s took %dms", task.name, run.DurationMS)
+}
+
+// callScheduledTask runs a task, turning a panic into an error
+func callScheduledTask(ctx context.Context, task scheduledTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return task.run(ctx)
+}
+
+// renewSubscriptions invoices the subscriptions which are due to renew. The
+// invoice emails, audit entries and webhooks follow from the InvoiceCreated
+// events this publishes.
+func (app *Config) renewSubscriptions(ctx context.Context) error {
+	renewed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := app.Models.Plan.RenewDue(renewalBatchSize)
+		if err != nil {
+			return err
+		}
+		renewed += n
+		if n < renewalBatchSize {
+			break
+		}
+	}
+	app.InfoLog.Printf("renewed %d subscriptions", renewed)
+	return nil
+}
+
+// remindTrialsEnding warns the subscribers whose free trial is about to end;
+// the emails follow from the TrialEnding events this publishes
+func (app *Config) remindTrialsEnding(ctx context.Context) error {
+	reminded := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := app.Models.Plan.RemindTrialsEnding(trialReminderLead, renewalBatchSize)
+		if err != nil {
+			return err
+		}
+		reminded += n
+		if n < renewalBatchSize {
+			break
+		}
+	}
+	app.InfoLog.Printf("reminded %d subscribers that their trial is ending", reminded)
+	return nil
+}
+
+// purgeTokens removes password reset, activation and API tokens which can no
+// longer be used
+func (app *Config) purgeTokens(ctx context.Context) error {
+	now := time.Now()
+	n, err := app.Models.Token.DeleteExpired(now)
+	if err != nil {
+		return err
+	}
+	m, err := app.Models.APIToken.DeleteExpired(now)
+	if err != nil {
+		return err
+	}
+	app.InfoLog.Printf("purged %d expired tokens and %d expired API tokens", n, m)
+	return nil
+}
+
+// cleanTmp removes the files left in tmpDir for more than a day. Directories
+// in it, such as the one the file mail transport writes to, are left alone.
+func (app *Config) cleanTmp(ctx context.Context) error {
+	removed, err := removeOldFiles(ctx, tmpDir, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	app.InfoLog.Printf("removed %d old files from %s", removed, tmpDir)
+	return nil
+}
+
+// removeOldFiles removes the regular files directly in dir which were last
+// changed before cutoff, and returns how many it removed. A dir which does not
+// exist has nothing to remove.
+func removeOldFiles(ctx context.Context, dir string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// purgeHistory removes delivered outbox messages, finished jobs and old task
+// runs, which are only kept for a while to help with debugging
+func (app *Config) purgeHistory(ctx context.Context) error {
+	now := time.Now()
+	messages, err := app.Models.Outbox.DeleteDelivered(now.Add(-7 * 24 * time.Hour))
+	if err != nil {
+		return err
+	}
+	jobs, err := app.Models.Job.DeleteDone(now.Add(-7 * 24 * time.Hour))
+	if err != nil {
+		return err
+	}
+	runs, err := app.Models.TaskRun.DeleteBefore(now.Add(-30 * 24 * time.Hour))
+	if err != nil {
+		return err
+	}
+	app.InfoLog.Printf("purged %d outbox messages, %d jobs and %d task runs", messages, jobs, runs)
+	return nil
+}
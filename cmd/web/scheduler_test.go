@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveOldFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(name string, modified time.Time) {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old.pdf", old)
+	write("new.pdf", time.Now())
+	err := os.Mkdir(filepath.Join(dir, "mail"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := removeOldFiles(context.Background(), dir, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{"old.pdf", false},
+		{"new.pdf", true},
+		{"mail", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(dir, tt.name))
+		if exists := err == nil; exists != tt.exists {
+			t.Errorf("%s: got exists %t, want %t", tt.name, exists, tt.exists)
+		}
+	}
+
+	removed, err = removeOldFiles(context.Background(), filepath.Join(dir, "missing"), time.Now())
+	if err != nil || removed != 0 {
+		t.Errorf("a missing directory: got %d, %v", removed, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"subscription_service/data"
+	"subscription_service/forms"
+)
+
+func (app *Config) SecurityPage(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := app.userSessions(r, user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["sessions"] = sessions
+	app.render(w, r, "security.page.gohtml", &TemplateData{
+		IntMap: map[string]int{"twoFactorEnabled": user.TOTPEnabled},
+		Data:   dataMap,
+	})
+}
+
+func (app *Config) PostRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	// sessions are the user's own, like their password, and ending them would log the user out of their devices
+	if app.IsImpersonating(r) {
+		app.audit(r, app.actorID(r), userID, "impersonation.blocked", "session revocation")
+		app.Session.Put(r.Context(), "warning", "sessions can't be logged out while impersonating a user")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	sessionID := r.PostFormValue("session-id")
+	if sessionID == "" || sessionID == app.Session.GetString(r.Context(), "sessionID") {
+		app.Session.Put(r.Context(), "error", "to end this session, log out")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	err := app.revokeSession(userID, sessionID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to log out that session")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), userID, "session.revoked", "")
+	app.Session.Put(r.Context(), "flash", "session logged out")
+	http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+}
+
+func (app *Config) PostRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	if app.IsImpersonating(r) {
+		app.audit(r, app.actorID(r), userID, "impersonation.blocked", "session revocation")
+		app.Session.Put(r.Context(), "warning", "sessions can't be logged out while impersonating a user")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	err := app.revokeOtherSessions(r, userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to log out your other sessions")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), userID, "session.revoked_others", "")
+	app.Session.Put(r.Context(), "flash", "all your other sessions have been logged out")
+	http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+}
+
+func (app *Config) PostChangePassword(w http.ResponseWriter, r *http.Request) {
+	// a password is the user's own, and changing it logs out the user's own sessions
+	if app.IsImpersonating(r) {
+		app.audit(r, app.actorID(r), app.Session.GetInt(r.Context(), "userID"), "impersonation.blocked", "password change")
+		app.Session.Put(r.Context(), "warning", "passwords can't be changed while impersonating a user")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	validPassword, err := user.PasswordMatches(r.Form.Get("current-password"))
+	if err != nil || !validPassword {
+		app.audit(r, app.actorID(r), user.ID, "reauthentication.failed", "wrong password")
+		app.Session.Put(r.Context(), "error", "your current password is not right")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	password := r.Form.Get("password")
+	if problem := forms.PasswordProblem(password); problem != "" {
+		app.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	if password != r.Form.Get("verify-password") {
+		app.Session.Put(r.Context(), "error", "passwords do not match")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	err = user.ResetPassword(password)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to change your password")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(user.ID)
+
+	// whoever else knew the old password is logged out, and old reset links stop working
+	err = app.revokeOtherSessions(r, user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	err = app.Models.Token.DeleteAllForUser(user.ID, data.TokenPasswordReset)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	app.audit(r, app.actorID(r), user.ID, "password.changed", "")
+	app.Session.Put(r.Context(), "flash", "password changed. your other sessions have been logged out.")
+	http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+}
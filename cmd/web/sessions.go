@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// sessionTouchInterval is how often the last seen time of a session is
+// updated, so that not every request has to write to redis
+const sessionTouchInterval = time.Minute
+
+// sessionInfo describes one logged in session of a user. Every user has a
+// redis hash of them, keyed by session id; a session whose entry has gone
+// from the hash has been revoked and is logged out on its next request.
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"-"`
+}
+
+// Device is a short description of the browser and operating system of the session
+func (s *sessionInfo) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+// startAuthenticatedSession logs a user in to the current session, and adds
+// the session to the user's list of sessions
+func (app *Config) startAuthenticatedSession(r *http.Request, userID int) {
+	app.Session.Put(r.Context(), "userID", userID)
+	// forms rendered before logging in should not stay valid afterwards
+	app.Session.Remove(r.Context(), csrfSessionKey)
+
+	err := app.registerSession(r, userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// registerSession gives the current session a new id, and records it against userID
+func (app *Config) registerSession(r *http.Request, userID int) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	info := sessionInfo{
+		ID:        hex.EncodeToString(b),
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+	app.Session.Put(r.Context(), "sessionID", info.ID)
+	app.Session.Put(r.Context(), "sessionOwnerID", userID)
+	return app.saveSession(userID, info)
+}
+
+func (app *Config) saveSession(userID int, info sessionInfo) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", userSessionsKey(userID), info.ID, b)
+	if err != nil {
+		return err
+	}
+	// no session outlives its lifetime, so neither does the list
+	_, err = conn.Do("EXPIRE", userSessionsKey(userID), int(app.Session.Lifetime.Seconds()))
+	return err
+}
+
+// checkSession reports whether the logged in session is still one of its
+// owner's sessions, and keeps its last seen time up to date. Sessions from
+// before sessions were tracked are added to the list the first time they
+// are seen. If redis is unavailable, the session is allowed.
+func (app *Config) checkSession(r *http.Request) bool {
+	// while impersonating, the session belongs to the admin, not to the user being viewed
+	ownerID := app.Session.GetInt(r.Context(), "sessionOwnerID")
+	sessionID := app.Session.GetString(r.Context(), "sessionID")
+	if sessionID == "" || ownerID == 0 {
+		ownerID = app.Session.GetInt(r.Context(), "userID")
+		if app.IsImpersonating(r) {
+			ownerID = app.Session.GetInt(r.Context(), "impersonatorID")
+		}
+		err := app.registerSession(r, ownerID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return true
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("HGET", userSessionsKey(ownerID), sessionID))
+	if err == redis.ErrNil {
+		return false
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return true
+	}
+
+	var info sessionInfo
+	err = json.Unmarshal(b, &info)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return true
+	}
+	if time.Since(info.LastSeen) > sessionTouchInterval {
+		info.LastSeen = time.Now()
+		info.IP = clientIP(r)
+		err = app.saveSession(ownerID, info)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+	return true
+}
+
+// userSessions returns the sessions of a user, most recently used first. The
+// current session, if it is one of them, is marked.
+func (app *Config) userSessions(r *http.Request, userID int) ([]*sessionInfo, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", userSessionsKey(userID)))
+	if err != nil {
+		return nil, err
+	}
+
+	current := app.Session.GetString(r.Context(), "sessionID")
+	var sessions []*sessionInfo
+	for id, v := range values {
+		var info sessionInfo
+		if err := json.Unmarshal([]byte(v), &info); err != nil {
+			app.ErrorLog.Println(err)
+			continue
+		}
+		// sessions expire in redisstore on their own; forget them here too
+		if time.Since(info.CreatedAt) > app.Session.Lifetime {
+			_, _ = conn.Do("HDEL", userSessionsKey(userID), id)
+			continue
+		}
+		info.Current = info.ID == current
+		sessions = append(sessions, &info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions, nil
+}
+
+// revokeSession logs out one session of a user
+func (app *Config) revokeSession(userID int, sessionID string) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", userSessionsKey(userID), sessionID)
+	return err
+}
+
+// revokeSessions logs a user out everywhere
+func (app *Config) revokeSessions(userID int) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", userSessionsKey(userID))
+	return err
+}
+
+// revokeOtherSessions logs a user out everywhere except the current session
+func (app *Config) revokeOtherSessions(r *http.Request, userID int) error {
+	sessions, err := app.userSessions(r, userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.Current {
+			continue
+		}
+		if err := app.revokeSession(userID, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userSessionsKey(userID int) string {
+	return fmt.Sprintf("user_sessions:%d", userID)
+}
+
+// describeUserAgent turns a user agent string into something like "Firefox on
+// Windows". It only knows the common browsers, which is enough for people to
+// recognise their own devices.
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			platform = o.name
+			break
+		}
+	}
+
+	if platform == "" {
+		return browser
+	}
+	return browser + " on " + platform
+}
@@ -1,42 +1,108 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	goalone "github.com/bwmarrin/go-alone"
+	"net/url"
 	"strings"
 	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
 )
 
-const secret = "abc123abc123abc123"
+// minKeyLength is the shortest signing secret we accept
+const minKeyLength = 16
+
+// URLSigner signs urls, and verifies signed urls. It knows every key which is
+// still accepted, identified by key id, so that keys can be rotated without
+// breaking links which are already in someone's inbox: add the new key, make
+// it active, and remove the old one once its links have expired.
+type URLSigner struct {
+	keys     map[string][]byte
+	activeID string
+	audience string
+	// now returns the current time, which tests move forward to expire links
+	now func() time.Time
+}
+
+// NewURLSigner creates a new signer. keys is a comma separated list of
+// id:secret pairs; activeID names the key used to sign new urls, and defaults
+// to the first one. Every signed url is bound to audience, so that links
+// issued by one deployment are not accepted by another sharing its keys.
+func NewURLSigner(keys, activeID, audience string) (*URLSigner, error) {
+	s := &URLSigner{
+		keys:     make(map[string][]byte),
+		activeID: activeID,
+		audience: audience,
+		now:      time.Now,
+	}
 
-var secretKey []byte
+	for _, pair := range strings.Split(keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(pair, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("signing key %q must be in the form id:secret", pair)
+		}
+		if len(secret) < minKeyLength {
+			return nil, fmt.Errorf("signing key %q must be at least %d characters long", id, minKeyLength)
+		}
+		if _, exists := s.keys[id]; exists {
+			return nil, fmt.Errorf("signing key %q is listed twice", id)
+		}
+		s.keys[id] = []byte(secret)
+		if s.activeID == "" {
+			s.activeID = id
+		}
+	}
 
-// NewURLSigner creates a new signer
-func NewURLSigner() {
-	secretKey = []byte(secret)
+	if len(s.keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+	if _, ok := s.keys[s.activeID]; !ok {
+		return nil, fmt.Errorf("active signing key %q is not one of the configured keys", s.activeID)
+	}
+	return s, nil
 }
 
-// GenerateTokenFromString generates a signed token
-func GenerateTokenFromString(data string) string {
+// GenerateTokenFromString generates a signed token for data, which is a url,
+// that is only valid for the given purpose
+func (s *URLSigner) GenerateTokenFromString(purpose, data string) string {
 	var urlToSign string
 
-	s := goalone.New(secretKey, goalone.Timestamp)
+	params := url.Values{}
+	params.Set("purpose", purpose)
+	params.Set("aud", s.audience)
+	params.Set("kid", s.activeID)
+
+	sg := goalone.New(s.keys[s.activeID], goalone.Timestamp)
 	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
+		urlToSign = fmt.Sprintf("%s&%s&hash=", data, params.Encode())
 	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+		urlToSign = fmt.Sprintf("%s?%s&hash=", data, params.Encode())
 	}
 
-	tokenBytes := s.Sign([]byte(urlToSign))
+	tokenBytes := sg.Sign([]byte(urlToSign))
 	token := string(tokenBytes)
 
 	return token
 }
 
-// VerifyToken verifies a signed token
-func VerifyToken(token string) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	_, err := s.Unsign([]byte(token))
+// VerifyToken verifies a signed token, and checks that it was issued for
+// purpose and for our audience
+func (s *URLSigner) VerifyToken(purpose, token string) bool {
+	params, key, ok := s.parse(token)
+	if !ok {
+		return false
+	}
+	if params.Get("purpose") != purpose || params.Get("aud") != s.audience {
+		return false
+	}
+
+	sg := goalone.New(key, goalone.Timestamp)
+	_, err := sg.Unsign([]byte(token))
 
 	if err != nil {
 		// signature is not valid. Token was tampered with, forged, or maybe it's
@@ -45,14 +111,32 @@ func VerifyToken(token string) bool {
 	}
 	// valid hash
 	return true
-
 }
 
-// Expired checks to see if a token has expired
-func Expired(token string, minutesUntilExpire int) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	ts := s.Parse([]byte(token))
+// Expired checks to see if a token has expired. It does not check the
+// signature, so always call VerifyToken as well.
+func (s *URLSigner) Expired(token string, minutesUntilExpire int) bool {
+	_, key, ok := s.parse(token)
+	if !ok {
+		return true
+	}
+	sg := goalone.New(key, goalone.Timestamp)
+	ts := sg.Parse([]byte(token))
 
-	// time.Duration(seconds)*time.Second
-	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
+	return s.now().Sub(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
+}
+
+// parse returns the query parameters of a signed url, and the key it claims to
+// be signed with
+func (s *URLSigner) parse(token string) (url.Values, []byte, bool) {
+	u, err := url.Parse(token)
+	if err != nil {
+		return nil, nil, false
+	}
+	params := u.Query()
+	key, ok := s.keys[params.Get("kid")]
+	if !ok {
+		return nil, nil, false
+	}
+	return params, key, true
 }
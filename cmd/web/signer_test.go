@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewURLSigner(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     string
+		activeID string
+		ok       bool
+	}{
+		{"one key", "a:aaaaaaaaaaaaaaaa", "", true},
+		{"active key named", "a:aaaaaaaaaaaaaaaa,b:bbbbbbbbbbbbbbbb", "b", true},
+		{"no keys", "", "", false},
+		{"not id:secret", "aaaaaaaaaaaaaaaa", "", false},
+		{"short secret", "a:short", "", false},
+		{"listed twice", "a:aaaaaaaaaaaaaaaa,a:bbbbbbbbbbbbbbbb", "", false},
+		{"unknown active key", "a:aaaaaaaaaaaaaaaa", "b", false},
+	}
+	for _, tt := range tests {
+		_, err := NewURLSigner(tt.keys, tt.activeID, "test")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestURLSignerExpired(t *testing.T) {
+	s, err := NewURLSigner("a:aaaaaaaaaaaaaaaa", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := time.Now()
+	token := s.GenerateTokenFromString("activation", "/activate?email=me%40here.com")
+
+	tests := []struct {
+		name    string
+		age     time.Duration
+		minutes int
+		expired bool
+	}{
+		{"just issued", 0, 60, false},
+		{"within its lifetime", 59 * time.Minute, 60, false},
+		{"past its lifetime", 61 * time.Minute, 60, true},
+		{"days old", 48 * time.Hour, 24 * 60, true},
+		{"shorter lifetime", 10 * time.Minute, 5, true},
+	}
+	for _, tt := range tests {
+		s.now = func() time.Time { return issued.Add(tt.age) }
+		if got := s.Expired(token, tt.minutes); got != tt.expired {
+			t.Errorf("%s: got expired %t, want %t", tt.name, got, tt.expired)
+		}
+	}
+
+	s.now = time.Now
+	if !s.Expired("/activate?kid=unknown", 60) {
+		t.Error("a token signed with an unknown key must count as expired")
+	}
+}
+
+func TestURLSignerVerifyToken(t *testing.T) {
+	old, _ := NewURLSigner("a:aaaaaaaaaaaaaaaa", "", "test")
+	s, err := NewURLSigner("b:bbbbbbbbbbbbbbbb,a:aaaaaaaaaaaaaaaa", "b", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewURLSigner("b:bbbbbbbbbbbbbbbb", "", "other")
+	token := s.GenerateTokenFromString("activation", "/activate?email=me%40here.com")
+
+	tests := []struct {
+		name    string
+		signer  *URLSigner
+		purpose string
+		token   string
+		valid   bool
+	}{
+		{"valid", s, "activation", token, true},
+		{"signed with an older key still listed", s, "activation", old.GenerateTokenFromString("activation", "/activate"), true},
+		{"other purpose", s, "password_reset", token, false},
+		{"other audience", other, "activation", token, false},
+		{"tampered", s, "activation", strings.Replace(token, "me%40here.com", "you%40here.com", 1), false},
+		{"unknown key", old, "activation", token, false},
+		{"not a token", s, "activation", "/activate", false},
+	}
+	for _, tt := range tests {
+		if got := tt.signer.VerifyToken(tt.purpose, tt.token); got != tt.valid {
+			t.Errorf("%s: got valid %t, want %t", tt.name, got, tt.valid)
+		}
+	}
+}
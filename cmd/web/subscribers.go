@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"subscription_service/data"
+	"subscription_service/events"
+)
+
+// subscribe registers everything that follows from a change made through the
+// models. Each subscriber runs by itself in the background, so a slow or
+// failing one holds up neither the request nor the others.
+func (app *Config) subscribe() {
+	// mailer
+	events.Subscribe(app.Events, "invoice email", app.emailInvoice)
+	events.Subscribe(app.Events, "manual", app.queueManual)
+	events.Subscribe(app.Events, "trial reminder email", app.emailTrialEnding)
+
+	// audit log
+	events.Subscribe(app.Events, "audit log", app.auditInvoiceCreated)
+
+	// webhooks
+	events.Subscribe(app.Events, "webhooks", app.webhookUserRegistered)
+	events.Subscribe(app.Events, "webhooks", app.webhookSubscriptionChanged)
+	events.Subscribe(app.Events, "webhooks", app.webhookInvoiceCreated)
+	events.Subscribe(app.Events, "webhooks", app.webhookInvoiceStatusChanged)
+}
+
+// emailInvoice sends a new invoice to the user it was issued to
+func (app *Config) emailInvoice(e data.InvoiceCreated) error {
+	u, err := app.Models.User.GetOne(e.Invoice.UserID)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       u.Email,
+		Subject:  "your invoice",
+		Data:     e.Invoice.AmountFormatted,
+		Template: "invoice",
+	}
+	return app.sendEmail(msg)
+}
+
+// emailTrialEnding tells a user their free trial is about to end, and what
+// they will be invoiced when it does
+func (app *Config) emailTrialEnding(e data.TrialEnding) error {
+	msg := Message{
+		To:      e.User.Email,
+		Subject: "your free trial is ending",
+		Data: fmt.Sprintf("your free trial of %s ends on %s, when you will be invoiced %s a month",
+			e.Plan.PlanName, e.EndsAt.Format("January 2, 2006"), e.Plan.PlanAmountFormatted),
+	}
+	return app.sendEmail(msg)
+}
+
+// queueManual queues a job to generate the manual for the plan a user has
+// just moved to, and send it to them
+func (app *Config) queueManual(e data.SubscriptionChanged) error {
+	if e.Plan == nil || (e.User.Plan != nil && e.User.Plan.ID == e.Plan.ID) {
+		return nil
+	}
+
+	_, err := app.Models.Job.Enqueue(jobManual, manualJob{UserID: e.User.ID, PlanID: e.Plan.ID}, data.JobOptions{
+		Queue: pdfQueue,
+	})
+	return err
+}
+
+// auditInvoiceCreated records new invoices in the audit log. There is no
+// request behind an event, so the entry has no actor, ip or user agent.
+func (app *Config) auditInvoiceCreated(e data.InvoiceCreated) error {
+	after, _ := json.Marshal(map[string]any{
+		"plan_id": e.Invoice.PlanID,
+		"amount":  e.Invoice.Amount,
+		"status":  e.Invoice.Status,
+	})
+	_, err := app.Models.Audit.Insert(data.AuditEvent{
+		TargetID: e.Invoice.UserID,
+		Action:   "invoice.created",
+		Detail:   fmt.Sprintf("invoice %d", e.Invoice.ID),
+		After:    string(after),
+	})
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"subscription_service/data"
+)
+
+var (
+	// errPlanUnavailable is returned when subscribing to a plan which does not exist or is archived
+	errPlanUnavailable = errors.New("plan does not exist or is no longer available")
+	// errNoSubscription is returned when canceling the subscription of a user who has none
+	errNoSubscription = errors.New("user has no subscription")
+)
+
+// subscribeUser subscribes a user to a plan, replacing the plan they had, and
+// issues them an invoice for it, unless it starts with a free trial. It
+// returns the user as they are afterwards. Subscribing to the plan the user
+// already has changes nothing. This is shared by every way a member can
+// subscribe, so that they all behave the same.
+func (app *Config) subscribeUser(r *http.Request, user data.User, planID int) (*data.User, error) {
+	// get the plan from the database
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil || plan.Archived == 1 {
+		return nil, errPlanUnavailable
+	}
+	if user.Plan != nil && user.Plan.ID == plan.ID {
+		return &user, nil
+	}
+
+	// the subscription and its invoice are saved together, and the invoice
+	// email, the manual and webhooks follow from the events they publish
+	_, err = app.Models.Plan.PurchasePlan(user, *plan)
+	if err != nil {
+		return nil, err
+	}
+	app.forgetUser(user.ID)
+	u, err := app.Models.User.GetOne(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	app.auditChange(r, app.actorID(r), u.ID, "subscription.changed", "", userState(&user), userState(u))
+
+	return u, nil
+}
+
+// cancelSubscription ends the subscription of a user, and returns the user as they are afterwards
+func (app *Config) cancelSubscription(r *http.Request, user data.User) (*data.User, error) {
+	if user.Plan == nil {
+		return nil, errNoSubscription
+	}
+
+	err := app.Models.Plan.CancelUserPlan(user)
+	if err != nil {
+		return nil, err
+	}
+	app.forgetUser(user.ID)
+	u, err := app.Models.User.GetOne(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	app.auditChange(r, app.actorID(r), u.ID, "subscription.canceled", "", userState(&user), userState(u))
+	return u, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"subscription_service/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const taskRunsPerPage = 50
+
+func (app *Config) AdminTasks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := data.TaskRunFilter{
+		Task:   q.Get("task"),
+		Status: q.Get("status"),
+		Limit:  taskRunsPerPage + 1,
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter.Offset = (page - 1) * taskRunsPerPage
+
+	tasks, err := app.Models.Task.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get scheduled tasks", http.StatusInternalServerError)
+		return
+	}
+	runs, err := app.Models.TaskRun.GetAll(filter)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get task runs", http.StatusInternalServerError)
+		return
+	}
+	// one more run than needed was fetched to find out if there is a next page
+	hasNext := len(runs) > taskRunsPerPage
+	if hasNext {
+		runs = runs[:taskRunsPerPage]
+	}
+
+	// the query string without the page, for building pagination links
+	q.Del("page")
+
+	dataMap := make(map[string]any)
+	dataMap["tasks"] = tasks
+	dataMap["runs"] = runs
+	dataMap["runStatuses"] = data.TaskRunStatuses
+	dataMap["query"] = template.URL(q.Encode())
+
+	app.render(w, r, "admin-tasks.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{
+			"task":     q.Get("task"),
+			"status":   q.Get("status"),
+			"instance": app.InstanceID,
+		},
+		IntMap: map[string]int{
+			"page":     page,
+			"prevPage": page - 1,
+			"nextPage": page + 1,
+			"hasNext":  map[bool]int{true: 1}[hasNext],
+		},
+		Data: dataMap,
+	})
+}
+
+// AdminRunTask makes a scheduled task due straight away; whichever instance
+// next checks the schedule runs it
+func (app *Config) AdminRunTask(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := app.Models.Task.RunNow(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.Session.Put(r.Context(), "error", "scheduled task not found")
+		http.Redirect(w, r, "/admin/tasks", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to run the task")
+		http.Redirect(w, r, "/admin/tasks", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), 0, "admin.task.run_now", name)
+	app.Session.Put(r.Context(), "flash", "task will run shortly")
+	http.Redirect(w, r, "/admin/tasks", http.StatusSeeOther)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// rfc6238Secret is the SHA1 key from the test vectors in RFC 6238 appendix B,
+// "12345678901234567890", base32 encoded
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// the RFC gives eight digit codes; ours are their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		valid    bool
+		wantStep int64
+	}{
+		{"current code", rfc6238Secret, code(step), true, step},
+		{"previous code", rfc6238Secret, code(step - 1), true, step - 1},
+		{"next code", rfc6238Secret, code(step + 1), true, step + 1},
+		{"code from two periods ago", rfc6238Secret, code(step - 2), false, 0},
+		{"code from two periods ahead", rfc6238Secret, code(step + 2), false, 0},
+		{"spaces are ignored", rfc6238Secret, " " + code(step)[:3] + " " + code(step)[3:] + " ", true, step},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code(step), true, step},
+		{"wrong code", rfc6238Secret, "000000", false, 0},
+		{"too short", rfc6238Secret, code(step)[:5], false, 0},
+		{"too long", rfc6238Secret, code(step) + "0", false, 0},
+		{"empty", rfc6238Secret, "", false, 0},
+		{"invalid secret", "not base32!", "123456", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, valid := validateTOTP(tt.secret, tt.code, now)
+			if valid != tt.valid {
+				t.Fatalf("got valid %t, want %t", valid, tt.valid)
+			}
+			if valid && gotStep != tt.wantStep {
+				t.Errorf("got step %d, want %d", gotStep, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestMarkTOTPUsed(t *testing.T) {
+	conn := &fakeRedisConn{keys: make(map[string]bool)}
+
+	tests := []struct {
+		name   string
+		userID int
+		step   int64
+		want   bool
+	}{
+		{"first use", 1, 100, true},
+		{"replayed", 1, 100, false},
+		{"next step", 1, 101, true},
+		{"same step for another user", 2, 100, true},
+		{"replayed again", 1, 100, false},
+	}
+	for _, tt := range tests {
+		got, err := markTOTPUsed(conn, tt.userID, tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	conn.err = errors.New("connection refused")
+	if ok, err := markTOTPUsed(conn, 3, 100); ok || err == nil {
+		t.Error("a redis error must not accept the code")
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		// checkSecondFactor tells recovery codes apart by their length
+		if len(c) != 11 || c[5] != '-' || len(c) <= totpDigits {
+			t.Errorf("code %q is not in the form xxxxx-xxxxx", c)
+		}
+		if seen[c] {
+			t.Errorf("code %q is repeated", c)
+		}
+		seen[c] = true
+	}
+}
+
+// fakeRedisConn understands just enough of SET ... NX to test replay
+// protection without a redis server
+type fakeRedisConn struct {
+	keys map[string]bool
+	err  error
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...any) (any, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if cmd != "SET" || len(args) < 3 || args[2] != "NX" {
+		return nil, errors.New("unexpected command")
+	}
+	key := args[0].(string)
+	if c.keys[key] {
+		return nil, nil
+	}
+	c.keys[key] = true
+	return "OK", nil
+}
+
+func (c *fakeRedisConn) Close() error              { return nil }
+func (c *fakeRedisConn) Err() error                { return c.err }
+func (c *fakeRedisConn) Send(string, ...any) error { return nil }
+func (c *fakeRedisConn) Flush() error              { return nil }
+func (c *fakeRedisConn) Receive() (any, error)     { return nil, nil }
+
+var _ redis.Conn = (*fakeRedisConn)(nil)
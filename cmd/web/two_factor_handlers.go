@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"subscription_service/data"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// twoFactorLoginWindow is how long a user has to enter their code after their password
+	twoFactorLoginWindow = 5 * time.Minute
+	// twoFactorMaxAttempts is how many wrong codes we accept before starting the login over
+	twoFactorMaxAttempts = 5
+	// recoveryCodeCount is how many recovery codes a user gets
+	recoveryCodeCount = 10
+)
+
+func (app *Config) TwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingLogin(w, r); !ok {
+		return
+	}
+	app.render(w, r, "two-factor-login.page.gohtml", nil)
+}
+
+func (app *Config) PostTwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.pendingLogin(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	valid, usedRecoveryCode, err := app.checkSecondFactor(user, r.Form.Get("code"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if !valid {
+		attempts := app.Session.GetInt(r.Context(), "pendingAttempts") + 1
+		app.audit(r, 0, user.ID, "login.failed", "wrong two factor code")
+		// wrong codes count towards locking the account too, or starting over would allow unlimited guesses
+		if lock := app.recordLoginFailure(r, user.Email, user); lock > 0 {
+			app.clearPendingLogin(r)
+			app.Session.Put(r.Context(), "error", lockoutMessage(lock))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if attempts >= twoFactorMaxAttempts {
+			app.clearPendingLogin(r)
+			app.Session.Put(r.Context(), "error", "too many wrong codes. please log in again.")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		app.Session.Put(r.Context(), "pendingAttempts", attempts)
+		app.Session.Put(r.Context(), "error", "invalid code")
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.clearPendingLogin(r)
+	_ = app.Session.RenewToken(r.Context())
+	detail := "two factor code"
+	if usedRecoveryCode {
+		detail = "recovery code"
+	}
+	app.completeLogin(w, r, user, detail)
+}
+
+func (app *Config) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	if user.TOTPEnabled == 1 {
+		remaining, err := user.RecoveryCodesRemaining()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		app.render(w, r, "two-factor.page.gohtml", &TemplateData{
+			IntMap: map[string]int{"enabled": 1, "recoveryCodesRemaining": remaining},
+			Data:   dataMap,
+		})
+		return
+	}
+
+	// the secret is only saved to the user once they have proved they can generate codes with it
+	secret := app.Session.GetString(r.Context(), "totpPendingSecret")
+	if secret == "" {
+		secret, err = newTOTPSecret()
+		if err != nil {
+			app.ErrorLog.Println(err)
+			http.Error(w, "unable to set up two factor authentication", http.StatusInternalServerError)
+			return
+		}
+		app.Session.Put(r.Context(), "totpPendingSecret", secret)
+	}
+
+	qr, err := totpQRCode(totpURI(secret, user.Email))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to set up two factor authentication", http.StatusInternalServerError)
+		return
+	}
+	dataMap["qrCode"] = qr
+
+	app.render(w, r, "two-factor.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{
+			"secret": secret,
+		},
+		IntMap: map[string]int{"enabled": 0},
+		Data:   dataMap,
+	})
+}
+
+func (app *Config) PostEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.twoFactorImpersonationBlocked(w, r, "enabling two factor authentication") {
+		return
+	}
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	secret := app.Session.GetString(r.Context(), "totpPendingSecret")
+	if secret == "" || user.TOTPEnabled == 1 {
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+	if _, ok := validateTOTP(secret, r.Form.Get("code"), time.Now()); !ok {
+		app.Session.Put(r.Context(), "error", "that code is not right. check the time on your device and try again.")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = user.EnableTOTP(secret, codes)
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to enable two factor authentication")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+	app.Session.Remove(r.Context(), "totpPendingSecret")
+	app.forgetUser(user.ID)
+	app.audit(r, app.actorID(r), user.ID, "two_factor.enabled", "")
+
+	// the codes are shown this one time only, so render them rather than redirecting
+	app.renderRecoveryCodes(w, r, codes, "two factor authentication is now enabled")
+}
+
+func (app *Config) PostRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if app.twoFactorImpersonationBlocked(w, r, "recovery code regeneration") {
+		return
+	}
+	user, ok := app.reauthenticate(w, r, false)
+	if !ok {
+		return
+	}
+	secret, err := user.GetTOTPSecret()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = user.EnableTOTP(secret, codes)
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to create new recovery codes")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), user.ID, "two_factor.recovery_codes_regenerated", "")
+	app.renderRecoveryCodes(w, r, codes, "new recovery codes created. your old codes no longer work.")
+}
+
+func (app *Config) PostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.twoFactorImpersonationBlocked(w, r, "disabling two factor authentication") {
+		return
+	}
+	user, ok := app.reauthenticate(w, r, true)
+	if !ok {
+		return
+	}
+	if user.IsStaff() {
+		app.Session.Put(r.Context(), "error", "two factor authentication is required for staff accounts")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err := user.DisableTOTP()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to disable two factor authentication")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+	app.forgetUser(user.ID)
+	app.audit(r, app.actorID(r), user.ID, "two_factor.disabled", "")
+	app.Session.Put(r.Context(), "flash", "two factor authentication is now disabled")
+	http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+}
+
+// twoFactorImpersonationBlocked refuses, and redirects back, when the current
+// request is made while impersonating. How a user proves who they are is
+// theirs alone, and recovery codes would let whoever saw them log in as the
+// user long after the impersonation ends.
+func (app *Config) twoFactorImpersonationBlocked(w http.ResponseWriter, r *http.Request, what string) bool {
+	if !app.IsImpersonating(r) {
+		return false
+	}
+	app.audit(r, app.actorID(r), app.Session.GetInt(r.Context(), "userID"), "impersonation.blocked", what)
+	app.Session.Put(r.Context(), "warning", "two factor authentication can't be changed while impersonating a user")
+	http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+	return true
+}
+
+func (app *Config) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, flash string) {
+	app.Session.Put(r.Context(), "flash", flash)
+	dataMap := make(map[string]any)
+	dataMap["codes"] = codes
+	app.render(w, r, "two-factor-recovery-codes.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// reauthenticate makes a logged in user with two factor authentication prove
+// who they are again before a sensitive change, by checking a current code,
+// and their password as well if withPassword is set. Wrong answers count
+// towards locking the account just as failed logins do, so that a stolen
+// session can't be used to guess the password or code.
+func (app *Config) reauthenticate(w http.ResponseWriter, r *http.Request, withPassword bool) (*data.User, bool) {
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if user.TOTPEnabled != 1 {
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return nil, false
+	}
+	if lock := app.loginLockedFor(user.Email); lock > 0 {
+		app.Session.Put(r.Context(), "error", lockoutMessage(lock))
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return nil, false
+	}
+
+	if withPassword {
+		validPassword, err := user.PasswordMatches(r.Form.Get("password"))
+		if err != nil || !validPassword {
+			app.reauthenticationFailed(w, r, user, "wrong password", "wrong password")
+			return nil, false
+		}
+	}
+
+	valid, _, err := app.checkSecondFactor(user, r.Form.Get("code"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if !valid {
+		app.reauthenticationFailed(w, r, user, "wrong two factor code", "invalid code")
+		return nil, false
+	}
+	return user, true
+}
+
+// reauthenticationFailed records a wrong password or code given to
+// reauthenticate, and redirects back with message, or with how long the
+// account is now locked for
+func (app *Config) reauthenticationFailed(w http.ResponseWriter, r *http.Request, user *data.User, reason, message string) {
+	app.audit(r, app.actorID(r), user.ID, "reauthentication.failed", reason)
+	if lock := app.recordLoginFailure(r, user.Email, user); lock > 0 {
+		message = lockoutMessage(lock)
+	}
+	app.Session.Put(r.Context(), "error", message)
+	http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+}
+
+// checkSecondFactor checks a code from an authenticator app, or failing that a
+// recovery code, for a user. Each code is accepted only once.
+func (app *Config) checkSecondFactor(user *data.User, code string) (valid bool, usedRecoveryCode bool, err error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return false, false, nil
+	}
+
+	// recovery codes are longer than authenticator codes
+	if len(code) > totpDigits {
+		valid, err = user.UseRecoveryCode(code)
+		return valid, valid, err
+	}
+
+	secret, err := user.GetTOTPSecret()
+	if err != nil {
+		return false, false, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, false, nil
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	first, err := markTOTPUsed(conn, user.ID, step)
+	if err != nil {
+		return false, false, err
+	}
+	return first, false, nil
+}
+
+// markTOTPUsed remembers that a user has used the code for a time step, for
+// as long as the code could still be valid, and reports whether this is the
+// first time it has been used, so that a code can't be replayed
+func markTOTPUsed(conn redis.Conn, userID int, step int64) (bool, error) {
+	_, err := redis.String(conn.Do("SET", fmt.Sprintf("totp_used:%d:%d", userID, step), 1, "NX", "EX", totpPeriod*(2*totpSkew+1)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// pendingLogin returns the user who has entered their password, but not yet
+// their two factor code
+func (app *Config) pendingLogin(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	userID := app.Session.GetInt(r.Context(), "pendingUserID")
+	startedAt := time.Unix(app.Session.GetInt64(r.Context(), "pendingAt"), 0)
+	if userID == 0 || time.Since(startedAt) > twoFactorLoginWindow {
+		app.clearPendingLogin(r)
+		app.Session.Put(r.Context(), "error", "please log in again")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil || user.Active != 1 {
+		app.clearPendingLogin(r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	return user, true
+}
+
+func (app *Config) clearPendingLogin(r *http.Request) {
+	app.Session.Remove(r.Context(), "pendingUserID")
+	app.Session.Remove(r.Context(), "pendingAt")
+	app.Session.Remove(r.Context(), "pendingAttempts")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// URLBuilder builds the links we hand out, e.g. in emails, from the public
+// base url of the application, which may differ from the host, scheme and path
+// a request arrives with when running behind a proxy. Signed links are signed
+// over the path relative to the application, so that verifying them does not
+// depend on how the request reached us.
+type URLBuilder struct {
+	base   *url.URL
+	signer *URLSigner
+}
+
+// NewURLBuilder creates a URLBuilder for the public base url, e.g.
+// https://example.com/subscriptions
+func NewURLBuilder(base string, signer *URLSigner) (*URLBuilder, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("public url %q must include a scheme and host", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+	return &URLBuilder{base: u, signer: signer}, nil
+}
+
+// Absolute returns the public url for a path relative to the application,
+// e.g. "/login" or "/activate?email=x"
+func (b *URLBuilder) Absolute(relative string) string {
+	return b.base.String() + relative
+}
+
+// Signed returns a public url for path and params, signed for one purpose
+func (b *URLBuilder) Signed(purpose, path string, params url.Values) string {
+	relative := path
+	if len(params) > 0 {
+		relative = fmt.Sprintf("%s?%s", path, params.Encode())
+	}
+	return b.Absolute(b.signer.GenerateTokenFromString(purpose, relative))
+}
+
+// VerifyRequest reports whether the request is for a url signed by Signed
+// for purpose, which was issued no longer than ttl ago
+func (b *URLBuilder) VerifyRequest(purpose string, r *http.Request, ttl time.Duration) bool {
+	relative := b.Relative(r)
+	return b.signer.VerifyToken(purpose, relative) && !b.signer.Expired(relative, int(ttl.Minutes()))
+}
+
+// Relative returns the path and query of a request relative to the
+// application. A proxy may or may not strip the path prefix of the public
+// url before passing the request on, so both are accepted.
+func (b *URLBuilder) Relative(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if b.base.Path != "" && strings.HasPrefix(path, b.base.Path+"/") {
+		path = strings.TrimPrefix(path, b.base.Path)
+	}
+	if r.URL.RawQuery != "" {
+		path = fmt.Sprintf("%s?%s", path, r.URL.RawQuery)
+	}
+	return path
+}
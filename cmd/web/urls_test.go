@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLBuilderVerifyRequest(t *testing.T) {
+	s, _ := NewURLSigner("a:aaaaaaaaaaaaaaaa", "", "test")
+	b, err := NewURLBuilder("https://example.com/subscriptions/", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := time.Now()
+	link := b.Signed("password_reset", "/reset-password", url.Values{"email": {"me@here.com"}})
+	if !strings.HasPrefix(link, "https://example.com/subscriptions/reset-password?") {
+		t.Fatalf("link %s is not under the public url", link)
+	}
+	withPrefix := strings.TrimPrefix(link, "https://example.com")
+	withoutPrefix := strings.TrimPrefix(link, "https://example.com/subscriptions")
+
+	tests := []struct {
+		name    string
+		target  string
+		purpose string
+		age     time.Duration
+		valid   bool
+	}{
+		{"prefix kept by the proxy", withPrefix, "password_reset", 0, true},
+		{"prefix stripped by the proxy", withoutPrefix, "password_reset", 0, true},
+		{"within its lifetime", withoutPrefix, "password_reset", 59 * time.Minute, true},
+		{"expired", withoutPrefix, "password_reset", 61 * time.Minute, false},
+		{"other purpose", withoutPrefix, "activation", 0, false},
+		{"changed email", strings.Replace(withoutPrefix, "me%40here.com", "you%40here.com", 1), "password_reset", 0, false},
+	}
+	for _, tt := range tests {
+		s.now = func() time.Time { return issued.Add(tt.age) }
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if got := b.VerifyRequest(tt.purpose, r, time.Hour); got != tt.valid {
+			t.Errorf("%s: got valid %t, want %t", tt.name, got, tt.valid)
+		}
+	}
+}
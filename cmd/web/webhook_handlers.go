@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"subscription_service/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const deliveriesPerPage = 50
+
+func (app *Config) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := app.Models.Webhook.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get webhook endpoints", http.StatusInternalServerError)
+		return
+	}
+	dataMap := make(map[string]any)
+	dataMap["endpoints"] = endpoints
+
+	app.render(w, r, "admin-webhooks.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint := &data.WebhookEndpoint{Active: 1}
+	var deliveries []*data.WebhookDelivery
+	if id := chi.URLParam(r, "id"); id != "" {
+		e, ok := app.adminGetWebhook(w, r)
+		if !ok {
+			return
+		}
+		endpoint = e
+
+		var err error
+		deliveries, err = app.Models.Delivery.GetAll(data.DeliveryFilter{EndpointID: endpoint.ID, Limit: 10})
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["endpoint"] = endpoint
+	dataMap["eventTypes"] = data.WebhookEvents
+	dataMap["deliveries"] = deliveries
+
+	app.render(w, r, "admin-webhook.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminPostWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	endpoint := &data.WebhookEndpoint{}
+	if id := chi.URLParam(r, "id"); id != "" {
+		e, ok := app.adminGetWebhook(w, r)
+		if !ok {
+			return
+		}
+		endpoint = e
+	}
+
+	var before map[string]any
+	if endpoint.ID != 0 {
+		before = webhookState(endpoint)
+	}
+
+	endpointURL := strings.TrimSpace(r.Form.Get("url"))
+	if !validWebhookURL(endpointURL) {
+		app.Session.Put(r.Context(), "error", "the endpoint needs a valid http or https url")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	var events []string
+	for _, event := range data.WebhookEvents {
+		if r.Form.Get("event-"+event) != "" {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		app.Session.Put(r.Context(), "error", "choose at least one event to send")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	endpoint.URL = endpointURL
+	endpoint.Description = strings.TrimSpace(r.Form.Get("description"))
+	endpoint.Events = events
+	endpoint.Active = 0
+	if r.Form.Get("active") != "" {
+		endpoint.Active = 1
+	}
+
+	if endpoint.ID == 0 {
+		endpoint.ID, err = app.Models.Webhook.Insert(*endpoint)
+	} else {
+		err = endpoint.Update()
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to save the webhook endpoint")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+	action := "admin.webhook.updated"
+	if before == nil {
+		action = "admin.webhook.created"
+	}
+	app.auditChange(r, app.actorID(r), 0, action, fmt.Sprintf("webhook %d", endpoint.ID), before, webhookState(endpoint))
+	app.Session.Put(r.Context(), "flash", "webhook endpoint saved")
+	http.Redirect(w, r, webhookURL(endpoint.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := app.adminGetWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := endpoint.Delete()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to delete the webhook endpoint")
+		http.Redirect(w, r, webhookURL(endpoint.ID), http.StatusSeeOther)
+		return
+	}
+	app.auditChange(r, app.actorID(r), 0, "admin.webhook.deleted", fmt.Sprintf("webhook %d", endpoint.ID), webhookState(endpoint), nil)
+	app.Session.Put(r.Context(), "flash", "webhook endpoint deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+func (app *Config) AdminRotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := app.adminGetWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := endpoint.RotateSecret()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to change the signing secret")
+		http.Redirect(w, r, webhookURL(endpoint.ID), http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), 0, "admin.webhook.secret_rotated", fmt.Sprintf("webhook %d", endpoint.ID))
+	app.Session.Put(r.Context(), "flash", "signing secret changed. update the receiver before the next webhook is sent.")
+	http.Redirect(w, r, webhookURL(endpoint.ID), http.StatusSeeOther)
+}
+
+func (app *Config) AdminWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := data.DeliveryFilter{
+		Status: q.Get("status"),
+		Event:  q.Get("event"),
+		Limit:  deliveriesPerPage + 1,
+	}
+	filter.EndpointID, _ = strconv.Atoi(q.Get("endpoint"))
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter.Offset = (page - 1) * deliveriesPerPage
+
+	deliveries, err := app.Models.Delivery.GetAll(filter)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "unable to get webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	// one more delivery than needed was fetched to find out if there is a next page
+	hasNext := len(deliveries) > deliveriesPerPage
+	if hasNext {
+		deliveries = deliveries[:deliveriesPerPage]
+	}
+
+	// the query string without the page, for building pagination links
+	q.Del("page")
+
+	dataMap := make(map[string]any)
+	dataMap["deliveries"] = deliveries
+	dataMap["eventTypes"] = data.WebhookEvents
+	dataMap["statuses"] = []string{data.DeliveryPending, data.DeliveryDelivered, data.DeliveryFailed}
+	dataMap["query"] = template.URL(q.Encode())
+
+	app.render(w, r, "admin-webhook-deliveries.page.gohtml", &TemplateData{
+		StringMaps: map[string]string{
+			"endpoint": q.Get("endpoint"),
+			"status":   q.Get("status"),
+			"event":    q.Get("event"),
+		},
+		IntMap: map[string]int{
+			"page":     page,
+			"prevPage": page - 1,
+			"nextPage": page + 1,
+			"hasNext":  map[bool]int{true: 1}[hasNext],
+		},
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := app.adminGetDelivery(w, r)
+	if !ok {
+		return
+	}
+	dataMap := make(map[string]any)
+	dataMap["delivery"] = delivery
+
+	app.render(w, r, "admin-webhook-delivery.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := app.adminGetDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	newID, err := delivery.Redeliver()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "unable to queue the webhook again")
+		http.Redirect(w, r, deliveryURL(delivery.ID), http.StatusSeeOther)
+		return
+	}
+	app.audit(r, app.actorID(r), 0, "admin.webhook.redelivered",
+		fmt.Sprintf("delivery %d as delivery %d, %s to webhook %d", delivery.ID, newID, delivery.Event, delivery.EndpointID))
+	app.Session.Put(r.Context(), "flash", "webhook queued to be sent again")
+	http.Redirect(w, r, deliveryURL(newID), http.StatusSeeOther)
+}
+
+// adminGetWebhook loads the webhook endpoint named by the id url parameter,
+// redirecting back to the endpoint list if there is no such endpoint
+func (app *Config) adminGetWebhook(w http.ResponseWriter, r *http.Request) (*data.WebhookEndpoint, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	endpoint, err := app.Models.Webhook.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "webhook endpoint not found")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return nil, false
+	}
+	return endpoint, true
+}
+
+// adminGetDelivery loads the webhook delivery named by the id url parameter,
+// redirecting back to the delivery log if there is no such delivery
+func (app *Config) adminGetDelivery(w http.ResponseWriter, r *http.Request) (*data.WebhookDelivery, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	delivery, err := app.Models.Delivery.GetOne(id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "webhook delivery not found")
+		http.Redirect(w, r, "/admin/webhooks/deliveries", http.StatusSeeOther)
+		return nil, false
+	}
+	return delivery, true
+}
+
+// validWebhookURL reports whether s is an absolute http or https url
+func validWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// webhookState is what the audit log records about a webhook endpoint. The
+// signing secret is left out on purpose.
+func webhookState(e *data.WebhookEndpoint) map[string]any {
+	return map[string]any{
+		"url":         e.URL,
+		"description": e.Description,
+		"events":      strings.Join(e.Events, ", "),
+		"active":      e.Active,
+	}
+}
+
+func webhookURL(id int) string {
+	return fmt.Sprintf("/admin/webhooks/%d", id)
+}
+
+func deliveryURL(id int) string {
+	return fmt.Sprintf("/admin/webhooks/deliveries/%d", id)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"subscription_service/data"
+	"subscription_service/webhooks"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookPollInterval is how often the queue is checked for deliveries which are due
+	webhookPollInterval = 5 * time.Second
+	// webhookBatchSize is how many deliveries are sent at once
+	webhookBatchSize = 20
+	// webhookTimeout is how long an endpoint has to respond
+	webhookTimeout = 10 * time.Second
+	// webhookLease is how long a claimed delivery is held before another worker may try it
+	webhookLease = 2 * time.Minute
+	// webhookMaxAttempts is how many times a delivery is tried before it is given up on
+	webhookMaxAttempts = 10
+	// webhookFirstRetry is the wait after the first failure; it doubles after each failure after that
+	webhookFirstRetry = 30 * time.Second
+	// webhookMaxRetry caps the wait between two attempts
+	webhookMaxRetry = 6 * time.Hour
+)
+
+// Headers sent with every webhook
+const (
+	webhookIDHeader        = "Webhook-Id"
+	webhookEventHeader     = "Webhook-Event"
+	webhookSignatureHeader = "Webhook-Signature"
+)
+
+// webhookEvent is the body of every webhook
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// webhookUser is how webhooks show the user an event is about
+type webhookUser struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// webhookUserData is the data of user events
+type webhookUserData struct {
+	User webhookUser `json:"user"`
+}
+
+// webhookSubscription is the data of subscription events
+type webhookSubscription struct {
+	User         webhookUser     `json:"user"`
+	Subscription apiSubscription `json:"subscription"`
+	PreviousPlan *apiPlan        `json:"previous_plan"`
+}
+
+// webhookInvoice is the data of invoice events
+type webhookInvoice struct {
+	User    webhookUser `json:"user"`
+	Invoice *apiInvoice `json:"invoice"`
+}
+
+// webhookUserRegistered queues a webhook for a new user
+func (app *Config) webhookUserRegistered(e data.UserRegistered) error {
+	return app.publishWebhook(data.EventUserRegistered, e.OutboxID, webhookUserData{
+		User: userForWebhook(&e.User),
+	})
+}
+
+// webhookSubscriptionChanged queues a webhook for a change to the subscription of a user
+func (app *Config) webhookSubscriptionChanged(e data.SubscriptionChanged) error {
+	before := e.User
+	after := e.User
+	after.Plan = e.Plan
+
+	event := data.EventSubscriptionChanged
+	switch {
+	case before.Plan == nil && after.Plan == nil:
+		return nil
+	case before.Plan == nil:
+		event = data.EventSubscriptionCreated
+	case after.Plan == nil:
+		event = data.EventSubscriptionCanceled
+	case before.Plan.ID == after.Plan.ID:
+		return nil
+	}
+
+	payload := webhookSubscription{
+		User:         userForWebhook(&after),
+		Subscription: subscriptionForAPI(&after),
+	}
+	if before.Plan != nil {
+		payload.PreviousPlan = planForAPI(before.Plan)
+	}
+	return app.publishWebhook(event, e.OutboxID, payload)
+}
+
+// webhookInvoiceCreated queues a webhook for a new invoice. The invoice is
+// loaded again, since the event does not carry the name of its plan.
+func (app *Config) webhookInvoiceCreated(e data.InvoiceCreated) error {
+	invoice, err := app.Models.Invoice.GetOne(e.Invoice.ID)
+	if err != nil {
+		return err
+	}
+	return app.publishInvoiceEvent(data.EventInvoiceCreated, e.OutboxID, invoice)
+}
+
+// webhookInvoiceStatusChanged queues a webhook when an invoice is paid, voided or refunded
+func (app *Config) webhookInvoiceStatusChanged(e data.InvoiceStatusChanged) error {
+	var event string
+	switch e.Invoice.Status {
+	case data.InvoicePaid:
+		event = data.EventInvoicePaid
+	case data.InvoiceVoid:
+		event = data.EventInvoiceVoided
+	case data.InvoiceRefunded:
+		event = data.EventInvoiceRefunded
+	default:
+		return nil
+	}
+	return app.publishInvoiceEvent(event, e.OutboxID, &e.Invoice)
+}
+
+// publishInvoiceEvent queues a webhook for an invoice
+func (app *Config) publishInvoiceEvent(event string, outboxID int, invoice *data.Invoice) error {
+	u, err := app.Models.User.GetOne(invoice.UserID)
+	if err != nil {
+		return err
+	}
+	return app.publishWebhook(event, outboxID, webhookInvoice{
+		User:    userForWebhook(u),
+		Invoice: invoiceForAPI(invoice),
+	})
+}
+
+// publishWebhook queues event, which comes from the outbox message with id
+// outboxID, for every endpoint which subscribes to it. The event is only
+// queued here; listenForWebhooks sends it.
+func (app *Config) publishWebhook(event string, outboxID int, payload any) error {
+	id, err := webhookEventID(outboxID)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(webhookEvent{
+		ID:        id,
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data:      payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = app.Models.Delivery.Enqueue(id, event, string(body))
+	if err != nil {
+		return fmt.Errorf("unable to queue webhook %s: %w", event, err)
+	}
+	return nil
+}
+
+// listenForWebhooks sends queued webhooks until it is told to stop. Several
+// instances of the application may run this at once; each delivery is only
+// claimed by one of them at a time.
+func (app *Config) listenForWebhooks() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.sendDueWebhooks()
+		case <-app.WebhookDone:
+			return
+		}
+	}
+}
+
+// sendDueWebhooks claims the deliveries which are due, and sends them in parallel
+func (app *Config) sendDueWebhooks() {
+	deliveries, err := app.Models.Delivery.ClaimDue(webhookBatchSize, webhookLease)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d *data.WebhookDelivery) {
+			defer wg.Done()
+			app.sendWebhook(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// sendWebhook makes one attempt to send a delivery, and records the outcome.
+// Any 2xx response counts as delivered.
+func (app *Config) sendWebhook(d *data.WebhookDelivery) {
+	status, err := app.postWebhook(d)
+	if err == nil {
+		err = d.Delivered(status)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	var retryAt time.Time
+	if d.Attempts+1 < webhookMaxAttempts {
+		retryAt = time.Now().Add(webhookRetryDelay(d.Attempts + 1))
+	} else {
+		app.ErrorLog.Printf("giving up on webhook delivery %d to %s after %d attempts: %s", d.ID, d.EndpointURL, d.Attempts+1, err)
+	}
+	err = d.Failed(status, err.Error(), retryAt)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+// postWebhook posts a delivery to its endpoint, and returns the status of the response
+func (app *Config) postWebhook(d *data.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.EndpointURL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "subscription_service-webhooks/1.0")
+	req.Header.Set(webhookIDHeader, d.EventID)
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookSignatureHeader, webhooks.Sign(d.EndpointSecret, time.Now(), []byte(d.Payload)))
+
+	client := app.WebhookClient
+	if client == nil {
+		client = newWebhookClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// a little of the body is kept for the delivery log, to help work out what went wrong
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay is how long to wait before the next attempt, after attempts failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	return backoff(attempts, webhookFirstRetry, webhookMaxRetry)
+}
+
+// newWebhookClient returns the client webhooks are sent with. Redirects are
+// not followed, so a redirect counts as a failed delivery, and the endpoint
+// has to be corrected rather than the payload ending up somewhere else.
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func userForWebhook(u *data.User) webhookUser {
+	return webhookUser{
+		ID:        u.ID,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+	}
+}
+
+// webhookEventID returns the id of the webhook for the event delivered from
+// the outbox message with id outboxID. It is the same every time the message
+// is delivered, so that endpoints can tell when they are sent an event they
+// have already seen. Events which did not come from the outbox get a random id.
+func webhookEventID(outboxID int) (string, error) {
+	if outboxID == 0 {
+		return newEventID()
+	}
+	return fmt.Sprintf("evt_%d", outboxID), nil
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
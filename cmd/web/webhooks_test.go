@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription_service/data"
+	"subscription_service/webhooks"
+	"testing"
+	"time"
+)
+
+func TestPostWebhook(t *testing.T) {
+	payload := `{"id":"evt_1","type":"invoice.paid"}`
+
+	tests := []struct {
+		name       string
+		status     int
+		redirect   bool
+		wantStatus int
+		wantErr    bool
+	}{
+		{"accepted", http.StatusOK, false, http.StatusOK, false},
+		{"accepted without content", http.StatusNoContent, false, http.StatusNoContent, false},
+		{"refused", http.StatusBadRequest, false, http.StatusBadRequest, true},
+		{"endpoint down", http.StatusServiceUnavailable, false, http.StatusServiceUnavailable, true},
+		{"redirected", http.StatusOK, true, http.StatusFound, true},
+	}
+	for _, tt := range tests {
+		var received *http.Request
+		var body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/elsewhere" {
+				t.Errorf("%s: the redirect was followed", tt.name)
+				return
+			}
+			if tt.redirect {
+				http.Redirect(w, r, "/elsewhere", http.StatusFound)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			received, body = r, string(b)
+			w.WriteHeader(tt.status)
+		}))
+
+		app := &Config{WebhookClient: newWebhookClient()}
+		d := &data.WebhookDelivery{
+			EndpointURL:    srv.URL + "/hook",
+			EndpointSecret: "whsec_endpoint",
+			EventID:        "evt_1",
+			Event:          data.EventInvoicePaid,
+			Payload:        payload,
+		}
+		status, err := app.postWebhook(d)
+		srv.Close()
+
+		if status != tt.wantStatus || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got status %d and error %v", tt.name, status, err)
+			continue
+		}
+		if received == nil {
+			continue
+		}
+		if body != payload {
+			t.Errorf("%s: got body %s", tt.name, body)
+		}
+		if received.Header.Get(webhookIDHeader) != "evt_1" || received.Header.Get(webhookEventHeader) != data.EventInvoicePaid {
+			t.Errorf("%s: missing event headers", tt.name)
+		}
+		// the receiver can check the signature with the endpoint's secret, and no other
+		signature := received.Header.Get(webhookSignatureHeader)
+		if err := webhooks.Verify(signature, []byte(body), []string{"whsec_endpoint"}, time.Minute, time.Now()); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if err := webhooks.Verify(signature, []byte(body), []string{"whsec_other"}, time.Minute, time.Now()); err == nil {
+			t.Errorf("%s: signature verified with the wrong secret", tt.name)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, webhookMaxRetry},
+		{50, webhookMaxRetry},
+	}
+	for _, tt := range tests {
+		if got := webhookRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("after %d attempts: got %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestNewEventID(t *testing.T) {
+	a, err := newEventID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newEventID()
+	if !strings.HasPrefix(a, "evt_") || len(a) != 36 || a == b {
+		t.Errorf("got ids %s and %s", a, b)
+	}
+}
+
+func TestWebhookEventID(t *testing.T) {
+	// delivering the same outbox message again must not make a new event
+	a, _ := webhookEventID(42)
+	b, _ := webhookEventID(42)
+	c, _ := webhookEventID(43)
+	if a != "evt_42" || a != b || a == c {
+		t.Errorf("got ids %s, %s and %s", a, b, c)
+	}
+
+	a, _ = webhookEventID(0)
+	b, _ = webhookEventID(0)
+	if a == b {
+		t.Errorf("events not from the outbox share the id %s", a)
+	}
+}
@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// API token scopes
+const (
+	ScopePlansRead          = "plans:read"
+	ScopeSubscriptionsRead  = "subscriptions:read"
+	ScopeSubscriptionsWrite = "subscriptions:write"
+	ScopeInvoicesRead       = "invoices:read"
+)
+
+// AllScopes lists every scope an API token can be given, in the order they are shown
+var AllScopes = []string{
+	ScopePlansRead,
+	ScopeSubscriptionsRead,
+	ScopeSubscriptionsWrite,
+	ScopeInvoicesRead,
+}
+
+// apiTokenPrefix starts every API token, so that leaked tokens are easy to recognise
+const apiTokenPrefix = "ss_"
+
+// apiTokenTouchInterval is how often the last used time of a token is updated
+const apiTokenTouchInterval = time.Minute
+
+// APIToken is the type for a personal token a user creates to call the API.
+// Only a hash of the token is stored; Prefix keeps its first few characters
+// so that the user can tell their tokens apart.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string
+	Hash       string
+	Scopes     []string
+	ExpiresAt  time.Time
+	LastUsedAt sql.NullTime
+	CreatedAt  time.Time
+}
+
+// New creates an API token for a user, and returns the plain text token to hand to them
+func (t *APIToken) New(userID int, name string, scopes []string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	plainText := apiTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	stmt := `insert into api_tokens (user_id, name, prefix, token_hash, scopes, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		userID,
+		name,
+		plainText[:len(apiTokenPrefix)+6],
+		hashToken(plainText),
+		strings.Join(scopes, ","),
+		time.Now().Add(ttl),
+		time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// GetAllForUser returns the unexpired API tokens of a user, newest first
+func (t *APIToken) GetAllForUser(userID int) ([]*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, name, prefix, token_hash, scopes, expires_at, last_used_at, created_at
+		from api_tokens
+		where user_id = $1 and expires_at > $2
+		order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// GetValid returns the unexpired API token matching the plain text token, or ErrTokenInvalid
+func (t *APIToken) GetValid(plainText string) (*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if !strings.HasPrefix(plainText, apiTokenPrefix) {
+		return nil, ErrTokenInvalid
+	}
+
+	query := `select id, user_id, name, prefix, token_hash, scopes, expires_at, last_used_at, created_at
+		from api_tokens
+		where token_hash = $1 and expires_at > $2`
+
+	token, err := scanAPIToken(db.QueryRowContext(ctx, query, hashToken(plainText), time.Now()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Touch records that the token in the receiver t has just been used. To keep
+// busy tokens from writing on every request, it is only updated once in a
+// while; a token which was loaded with a recent last use is not written at all.
+func (t *APIToken) Touch() error {
+	if t.LastUsedAt.Valid && time.Since(t.LastUsedAt.Time) < apiTokenTouchInterval {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_tokens set last_used_at = $1
+		where id = $2 and (last_used_at is null or last_used_at < $3)`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), t.ID, time.Now().Add(-apiTokenTouchInterval))
+	return err
+}
+
+// Revoke deletes one API token belonging to a user
+func (t *APIToken) Revoke(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from api_tokens where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// DeleteExpired removes the API tokens which expired before t, and returns how many there were
+func (t *APIToken) DeleteExpired(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from api_tokens where expires_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// HasScope reports whether the token grants scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Prefix,
+		&token.Hash,
+		&scopes,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	return &token, nil
+}
@@ -0,0 +1,288 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// auditLockID is the postgres advisory lock held while appending to the audit
+// log, so that two writers can never chain onto the same previous event
+const auditLockID = 727001
+
+// AuditEvent is the type for one entry in the audit log. Events are chained
+// together by including the hash of the previous event in the hash of each
+// event, so that changing or removing an event is detectable.
+type AuditEvent struct {
+	ID        int
+	ActorID   int
+	TargetID  int
+	Action    string
+	Detail    string
+	Before    string
+	After     string
+	IP        string
+	UserAgent string
+	PrevHash  string
+	Hash      string
+	CreatedAt time.Time
+}
+
+// AuditFilter narrows down the events returned by AuditEvent.GetAll. Zero
+// values are ignored.
+type AuditFilter struct {
+	ActorID  int
+	TargetID int
+	Action   string
+	From     time.Time
+	To       time.Time
+	Limit    int
+	Offset   int
+}
+
+// AuditChange is one field which differs between the before and after state of an event
+type AuditChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// Insert appends an event to the audit log, and returns the ID of the newly inserted row
+func (a *AuditEvent) Insert(event AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, auditLockID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, `select hash from audit_events order by id desc limit 1`).Scan(&event.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// postgres keeps microseconds, so truncate now to hash exactly what is stored
+	event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.Hash = event.computeHash()
+
+	var newID int
+	stmt := `insert into audit_events (actor_id, target_id, action, detail, before_state, after_state,
+			ip, user_agent, prev_hash, hash, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		event.ActorID,
+		event.TargetID,
+		event.Action,
+		event.Detail,
+		event.Before,
+		event.After,
+		event.IP,
+		event.UserAgent,
+		event.PrevHash,
+		event.Hash,
+		event.CreatedAt,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// GetAll returns the events matching filter, newest first
+func (a *AuditEvent) GetAll(filter AuditFilter) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.ActorID != 0 {
+		add("actor_id = $%d", filter.ActorID)
+	}
+	if filter.TargetID != 0 {
+		add("target_id = $%d", filter.TargetID)
+	}
+	if filter.Action != "" {
+		add("action like $%d", filter.Action+"%")
+	}
+	if !filter.From.IsZero() {
+		add("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("created_at < $%d", filter.To)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	query := `select id, actor_id, target_id, action, detail, before_state, after_state,
+		ip, user_agent, prev_hash, hash, created_at from audit_events`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by id desc limit %d offset %d", filter.Limit, filter.Offset)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEvents(rows)
+}
+
+// Verify walks the whole audit log in order, recomputing the hash chain. It
+// returns the id of the first event which does not match, or 0 if the log
+// is intact. Events logged before the log was chained have no hash; they may
+// only come before the chain, and are skipped.
+func (a *AuditEvent) Verify() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout*10)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `select id, actor_id, target_id, action, detail, before_state, after_state,
+		ip, user_agent, prev_hash, hash, created_at from audit_events order by id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	return verifyChain(events), nil
+}
+
+// verifyChain returns the id of the first of events, which must be in the
+// order they were logged, which does not match the hash chain, or 0
+func verifyChain(events []*AuditEvent) int {
+	prev := ""
+	chained := false
+	for _, e := range events {
+		if !chained && e.Hash == "" && e.PrevHash == "" {
+			continue
+		}
+		chained = true
+		if e.PrevHash != prev || e.computeHash() != e.Hash {
+			return e.ID
+		}
+		prev = e.Hash
+	}
+	return 0
+}
+
+// Changes compares the before and after state of an event, which are stored
+// as JSON objects, and returns the fields which differ sorted by name
+func (a *AuditEvent) Changes() []AuditChange {
+	before := make(map[string]any)
+	after := make(map[string]any)
+	_ = json.Unmarshal([]byte(a.Before), &before)
+	_ = json.Unmarshal([]byte(a.After), &after)
+
+	fields := make(map[string]bool)
+	for k := range before {
+		fields[k] = true
+	}
+	for k := range after {
+		fields[k] = true
+	}
+
+	var changes []AuditChange
+	for field := range fields {
+		b, _ := json.Marshal(before[field])
+		f, _ := json.Marshal(after[field])
+		if string(b) != string(f) {
+			changes = append(changes, AuditChange{
+				Field:  field,
+				Before: auditValue(before, field),
+				After:  auditValue(after, field),
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func (a *AuditEvent) computeHash() string {
+	h := sha256.New()
+	for _, part := range []string{
+		a.PrevHash,
+		fmt.Sprint(a.ActorID),
+		fmt.Sprint(a.TargetID),
+		a.Action,
+		a.Detail,
+		a.Before,
+		a.After,
+		a.IP,
+		a.UserAgent,
+		a.CreatedAt.UTC().Format(time.RFC3339Nano),
+	} {
+		// length prefix each part so that moving text between fields changes the hash
+		fmt.Fprintf(h, "%d:%s|", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func auditValue(m map[string]any, field string) string {
+	v, ok := m[field]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func scanAuditEvents(rows *sql.Rows) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.ActorID,
+			&event.TargetID,
+			&event.Action,
+			&event.Detail,
+			&event.Before,
+			&event.After,
+			&event.IP,
+			&event.UserAgent,
+			&event.PrevHash,
+			&event.Hash,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// auditChain returns n events chained together the way Insert chains them,
+// after one event logged before the log was chained
+func auditChain(n int) []*AuditEvent {
+	events := []*AuditEvent{{ID: 1, Action: "user.login"}}
+	prev := ""
+	for i := 0; i < n; i++ {
+		e := &AuditEvent{
+			ID:        i + 2,
+			ActorID:   1,
+			TargetID:  i + 10,
+			Action:    "admin.user.updated",
+			Before:    `{"active":1}`,
+			After:     `{"active":0}`,
+			IP:        "192.0.2.1",
+			PrevHash:  prev,
+			CreatedAt: time.Date(2024, time.March, 5, 12, 0, i, 0, time.UTC),
+		}
+		e.Hash = e.computeHash()
+		prev = e.Hash
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(events []*AuditEvent) []*AuditEvent
+		want   int
+	}{
+		{"intact", func(events []*AuditEvent) []*AuditEvent { return events }, 0},
+		{"field changed", func(events []*AuditEvent) []*AuditEvent {
+			events[2].After = `{"active":1}`
+			return events
+		}, 3},
+		{"time changed", func(events []*AuditEvent) []*AuditEvent {
+			events[3].CreatedAt = events[3].CreatedAt.Add(time.Microsecond)
+			return events
+		}, 4},
+		{"text moved between fields", func(events []*AuditEvent) []*AuditEvent {
+			events[1].Detail, events[1].IP = "192.0.2.1", ""
+			return events
+		}, 2},
+		{"hash recomputed after a change", func(events []*AuditEvent) []*AuditEvent {
+			events[2].Action = "admin.user.viewed"
+			events[2].Hash = events[2].computeHash()
+			return events
+		}, 4},
+		{"event removed", func(events []*AuditEvent) []*AuditEvent {
+			return append(events[:2], events[3:]...)
+		}, 4},
+		{"unchained event after the chain", func(events []*AuditEvent) []*AuditEvent {
+			return append(events, &AuditEvent{ID: 6, Action: "user.login"})
+		}, 6},
+	}
+	for _, tt := range tests {
+		if got := verifyChain(tt.tamper(auditChain(4))); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// minEncryptionKeyLength is the shortest encryption secret we accept
+const minEncryptionKeyLength = 16
+
+// encryptedPrefix marks a value as encrypted, so that values stored before
+// encryption was introduced can be told apart and read as they are
+const encryptedPrefix = "enc:"
+
+// ErrNoEncryptionKey is returned when a secret needs to be encrypted or
+// decrypted, but no key has been configured
+var ErrNoEncryptionKey = errors.New("no encryption keys configured")
+
+// encryptionKeys holds the keys secrets stored in the database, such as TOTP
+// secrets, are encrypted with. They are set once at startup by
+// SetEncryptionKeys.
+var encryptionKeys struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// SetEncryptionKeys sets the keys secrets stored in the database are
+// encrypted with. keys is a comma separated list of id:secret pairs, like the
+// signing keys; activeID names the key used to encrypt, and defaults to the
+// first one. Values encrypted with any listed key can still be read, so keys
+// can be rotated by adding a new one and making it active.
+func SetEncryptionKeys(keys, activeID string) error {
+	aeads := make(map[string]cipher.AEAD)
+	for _, pair := range strings.Split(keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(pair, ":")
+		if !found || id == "" {
+			return fmt.Errorf("encryption key %q must be in the form id:secret", pair)
+		}
+		if len(secret) < minEncryptionKeyLength {
+			return fmt.Errorf("encryption key %q must be at least %d characters long", id, minEncryptionKeyLength)
+		}
+		if _, exists := aeads[id]; exists {
+			return fmt.Errorf("encryption key %q is listed twice", id)
+		}
+
+		// the secret is hashed to give a key of the length AES-256 needs
+		key := sha256.Sum256([]byte(secret))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		aeads[id] = aead
+		if activeID == "" {
+			activeID = id
+		}
+	}
+
+	if len(aeads) == 0 {
+		return ErrNoEncryptionKey
+	}
+	if _, ok := aeads[activeID]; !ok {
+		return fmt.Errorf("active encryption key %q is not one of the configured keys", activeID)
+	}
+	encryptionKeys.keys = aeads
+	encryptionKeys.activeID = activeID
+	return nil
+}
+
+// encryptSecret encrypts plaintext with the active key, as enc:<key id>:<base64>
+func encryptSecret(plaintext string) (string, error) {
+	aead, ok := encryptionKeys.keys[encryptionKeys.activeID]
+	if !ok {
+		return "", ErrNoEncryptionKey
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(encryptionKeys.activeID))
+	return encryptedPrefix + encryptionKeys.activeID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses encryptSecret. A value without the enc: prefix was
+// stored before encryption and has not been encrypted yet, and is returned
+// as it is.
+func decryptSecret(value string) (string, error) {
+	rest, found := cutPrefix(value, encryptedPrefix)
+	if !found {
+		return value, nil
+	}
+	id, encoded, found := strings.Cut(rest, ":")
+	if !found {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, ok := encryptionKeys.keys[id]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown key %q", id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	opened, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(opened), nil
+}
+
+// cutPrefix is strings.CutPrefix, which needs a newer go than go.mod asks for
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
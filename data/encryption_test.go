@@ -0,0 +1,92 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetEncryptionKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     string
+		activeID string
+		ok       bool
+	}{
+		{"one key", "a:aaaaaaaaaaaaaaaa", "", true},
+		{"active key named", "a:aaaaaaaaaaaaaaaa, b:bbbbbbbbbbbbbbbb", "b", true},
+		{"no keys", "", "", false},
+		{"not id:secret", "aaaaaaaaaaaaaaaa", "", false},
+		{"short secret", "a:short", "", false},
+		{"listed twice", "a:aaaaaaaaaaaaaaaa,a:bbbbbbbbbbbbbbbb", "", false},
+		{"unknown active key", "a:aaaaaaaaaaaaaaaa", "b", false},
+	}
+	for _, tt := range tests {
+		err := SetEncryptionKeys(tt.keys, tt.activeID)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	mustSetKeys(t, "old:oooooooooooooooo", "")
+	fromOldKey, err := encryptSecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustSetKeys(t, "old:oooooooooooooooo,new:nnnnnnnnnnnnnnnn", "new")
+	encrypted, err := encryptSecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, "enc:new:") || strings.Contains(encrypted, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("secret is not encrypted with the active key: %s", encrypted)
+	}
+	again, _ := encryptSecret("JBSWY3DPEHPK3PXP")
+	if again == encrypted {
+		t.Error("encrypting the same secret twice gave the same value")
+	}
+
+	// a value whose key id has been changed must not decrypt under the other key
+	movedKey := strings.Replace(fromOldKey, "enc:old:", "enc:new:", 1)
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		ok    bool
+	}{
+		{"active key", encrypted, "JBSWY3DPEHPK3PXP", true},
+		{"older key still listed", fromOldKey, "JBSWY3DPEHPK3PXP", true},
+		{"stored before encryption", "JBSWY3DPEHPK3PXP", "JBSWY3DPEHPK3PXP", true},
+		{"unknown key", "enc:gone:" + strings.TrimPrefix(encrypted, "enc:new:"), "", false},
+		{"key id changed", movedKey, "", false},
+		{"tampered", tampered, "", false},
+		{"no key id", "enc:abc", "", false},
+		{"not base64", "enc:new:!!!", "", false},
+		{"too short", "enc:new:AAAA", "", false},
+	}
+	for _, tt := range tests {
+		got, err := decryptSecret(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func mustSetKeys(t *testing.T, keys, activeID string) {
+	t.Helper()
+	err := SetEncryptionKeys(keys, activeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package data
+
+import "time"
+
+// The events below are what the models publish about the changes they make.
+// They are written to the outbox in the same transaction as the change, and
+// handed to the subscribers of the event bus from there, so they are stored
+// as JSON; users never carry their password hash.
+
+// Delivery identifies the outbox message an event was delivered from. It is
+// not part of the stored event, but is set when the event is read back, so
+// that a subscriber which passes the event on can identify it the same way
+// each time the message is delivered.
+type Delivery struct {
+	OutboxID int `json:"-"`
+}
+
+// UserRegistered is published when a user account is created
+type UserRegistered struct {
+	Delivery
+	User User
+}
+
+// SubscriptionChanged is published when a user subscribes to a plan, moves to
+// another plan or cancels. User is the user as they were before the change,
+// so User.Plan is the plan they had, if any; Plan is the plan they have now,
+// nil when they canceled.
+type SubscriptionChanged struct {
+	Delivery
+	User User
+	Plan *Plan
+}
+
+// InvoiceCreated is published when an invoice is issued. Only the columns of
+// the invoice itself are set, not the plan name.
+type InvoiceCreated struct {
+	Delivery
+	Invoice Invoice
+}
+
+// InvoiceStatusChanged is published when the status of an invoice changes,
+// for example when it is paid
+type InvoiceStatusChanged struct {
+	Delivery
+	Invoice  Invoice
+	Previous string
+}
+
+// TrialEnding is published a few days before the free trial of a
+// subscription ends, and it is first invoiced
+type TrialEnding struct {
+	Delivery
+	User   User
+	Plan   Plan
+	EndsAt time.Time
+}
+
+func (UserRegistered) EventName() string       { return "user.registered" }
+func (SubscriptionChanged) EventName() string  { return "subscription.changed" }
+func (InvoiceCreated) EventName() string       { return "invoice.created" }
+func (InvoiceStatusChanged) EventName() string { return "invoice.status_changed" }
+func (TrialEnding) EventName() string          { return "subscription.trial_ending" }
@@ -0,0 +1,38 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	published := InvoiceStatusChanged{
+		Delivery: Delivery{OutboxID: 99},
+		Invoice:  Invoice{ID: 7, Status: InvoicePaid},
+		Previous: InvoicePending,
+	}
+	payload, err := json.Marshal(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "OutboxID") || strings.Contains(string(payload), "Delivery") {
+		t.Errorf("the outbox id is stored with the event: %s", payload)
+	}
+
+	e, err := DecodeEvent(12, published.EventName(), string(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := e.(InvoiceStatusChanged)
+	if !ok {
+		t.Fatalf("got a %T", e)
+	}
+	if got.OutboxID != 12 || got.Invoice.ID != 7 || got.Previous != InvoicePending {
+		t.Errorf("got %+v", got)
+	}
+
+	if _, err := DecodeEvent(12, "no.such_event", "{}"); err == nil {
+		t.Error("an unknown event was decoded")
+	}
+}
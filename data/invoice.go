@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Invoice statuses
+const (
+	InvoicePending  = "pending"
+	InvoicePaid     = "paid"
+	InvoiceVoid     = "void"
+	InvoiceRefunded = "refunded"
+)
+
+// Invoice is the type for one invoice issued to a user for a plan
+type Invoice struct {
+	ID              int
+	UserID          int
+	PlanID          int
+	PlanName        string
+	Amount          int
+	AmountFormatted string
+	Status          string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// GetAllForUser returns all invoices for one user, newest first
+func (i *Invoice) GetAllForUser(userID int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select i.id, i.user_id, coalesce(i.plan_id, 0), coalesce(p.plan_name, ''), i.amount, i.status, i.created_at, i.updated_at
+		from invoices i
+		left join plans p on (p.id = i.plan_id)
+		where i.user_id = $1
+		order by i.created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		var invoice Invoice
+		err := rows.Scan(
+			&invoice.ID,
+			&invoice.UserID,
+			&invoice.PlanID,
+			&invoice.PlanName,
+			&invoice.Amount,
+			&invoice.Status,
+			&invoice.CreatedAt,
+			&invoice.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		invoice.AmountFormatted = invoice.AmountForDisplay()
+		invoices = append(invoices, &invoice)
+	}
+
+	return invoices, nil
+}
+
+// GetOne returns one invoice by id
+func (i *Invoice) GetOne(id int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select i.id, i.user_id, coalesce(i.plan_id, 0), coalesce(p.plan_name, ''), i.amount, i.status, i.created_at, i.updated_at
+		from invoices i
+		left join plans p on (p.id = i.plan_id)
+		where i.id = $1`
+
+	var invoice Invoice
+	row := db.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.UserID,
+		&invoice.PlanID,
+		&invoice.PlanName,
+		&invoice.Amount,
+		&invoice.Status,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.AmountFormatted = invoice.AmountForDisplay()
+	return &invoice, nil
+}
+
+// Insert inserts a new invoice into the database, and returns the ID of the newly inserted row
+func (i *Invoice) Insert(invoice Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertInvoice(ctx, tx, invoice)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// insertInvoice inserts an invoice through tx, and publishes InvoiceCreated
+func insertInvoice(ctx context.Context, tx *sql.Tx, invoice Invoice) (int, error) {
+	if invoice.Status == "" {
+		invoice.Status = InvoicePending
+	}
+
+	var newID int
+	stmt := `insert into invoices (user_id, plan_id, amount, status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	now := time.Now()
+	err := tx.QueryRowContext(ctx, stmt,
+		invoice.UserID,
+		invoice.PlanID,
+		invoice.Amount,
+		invoice.Status,
+		now,
+		now,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	invoice.ID = newID
+	invoice.AmountFormatted = invoice.AmountForDisplay()
+	invoice.CreatedAt = now
+	invoice.UpdatedAt = now
+	err = publish(ctx, tx, InvoiceCreated{Invoice: invoice})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateStatus sets the status of the invoice in the receiver i
+func (i *Invoice) UpdateStatus(status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update invoices set status = $1, updated_at = $2 where id = $3`
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, stmt, status, now, i.ID)
+	if err != nil {
+		return err
+	}
+
+	updated := *i
+	updated.Status = status
+	updated.UpdatedAt = now
+	if i.Status != status {
+		err = publish(ctx, tx, InvoiceStatusChanged{Invoice: updated, Previous: i.Status})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	*i = updated
+	return nil
+}
+
+// AmountForDisplay formats the invoice amount as a currency string
+func (i *Invoice) AmountForDisplay() string {
+	amount := float64(i.Amount) / 100.0
+	return fmt.Sprintf("$%.2f", amount)
+}
@@ -0,0 +1,364 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Job statuses. A job which has failed as many times as it may is left as
+// failed, out of the way of the queue, until someone retries or deletes it.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// JobStatuses lists every job status, in the order they are shown
+var JobStatuses = []string{JobQueued, JobRunning, JobDone, JobFailed}
+
+// DefaultJobQueue is the queue jobs go on when no other queue is given
+const DefaultJobQueue = "default"
+
+// defaultJobMaxAttempts is how many times a job is tried when no other limit is given
+const defaultJobMaxAttempts = 5
+
+// ErrJobRunning is returned when trying to retry or delete a job which is running
+var ErrJobRunning = errors.New("the job is running")
+
+// Job is the type for one piece of background work. The payload is JSON,
+// whose shape depends on the type of the job.
+type Job struct {
+	ID          int
+	Queue       string
+	Type        string
+	Payload     string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LockedUntil sql.NullTime
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  sql.NullTime
+}
+
+// JobOptions are the optional settings of a new job
+type JobOptions struct {
+	// Queue is the queue the job goes on; DefaultJobQueue if empty
+	Queue string
+	// RunAt is when the job is run at the earliest; straight away if zero
+	RunAt time.Time
+	// MaxAttempts is how many times the job is tried before it is left as failed
+	MaxAttempts int
+}
+
+// JobFilter narrows down which jobs GetAll returns
+type JobFilter struct {
+	Queue  string
+	Status string
+	Type   string
+	Limit  int
+	Offset int
+}
+
+// JobCount is how many jobs of one queue have one status
+type JobCount struct {
+	Queue  string
+	Status string
+	Count  int
+}
+
+const jobColumns = `id, queue, type, payload, status, attempts, max_attempts, run_at, locked_until,
+	last_error, created_at, updated_at, finished_at`
+
+// Enqueue adds a job of type jobType to a queue, and returns the ID of the
+// newly inserted row
+func (j *Job) Enqueue(jobType string, payload any, opts JobOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Queue == "" {
+		opts.Queue = DefaultJobQueue
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = defaultJobMaxAttempts
+	}
+	now := time.Now()
+	if opts.RunAt.IsZero() {
+		opts.RunAt = now
+	}
+
+	var newID int
+	stmt := `insert into jobs (queue, type, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at)
+		values ($1, $2, $3, $4, 0, $5, $6, '', $7, $7) returning id`
+
+	err = db.QueryRowContext(ctx, stmt, opts.Queue, jobType, string(body), JobQueued, opts.MaxAttempts, opts.RunAt, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// Claim marks up to limit jobs from queue which are due as running, and
+// returns them. A running job whose lease has run out is assumed to belong to
+// a worker which died, and is claimed again.
+func (j *Job) Claim(queue string, limit int, lease time.Duration) ([]*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := fmt.Sprintf(`select %s
+		from jobs
+		where queue = $1 and ((status = $2 and run_at <= $3) or (status = $4 and locked_until < $3))
+		order by run_at
+		limit $5
+		for update skip locked`, jobColumns)
+
+	rows, err := tx.QueryContext(ctx, query, queue, JobQueued, now, JobRunning, limit)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scanJobs(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		_, err = tx.ExecContext(ctx, `update jobs set status = $1, attempts = attempts + 1, locked_until = $2, updated_at = $3
+			where id = $4`, JobRunning, now.Add(lease), now, job.ID)
+		if err != nil {
+			return nil, err
+		}
+		job.Status = JobRunning
+		job.Attempts++
+	}
+
+	return jobs, tx.Commit()
+}
+
+// Succeeded records that the job in the receiver j is done
+func (j *Job) Succeeded() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, locked_until = null, last_error = '', updated_at = $2, finished_at = $2
+		where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, JobDone, time.Now(), j.ID)
+	return err
+}
+
+// Failed records a failed run of the job in the receiver j. It runs again at
+// retryAt, or is left as failed if retryAt is zero.
+func (j *Job) Failed(lastError string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	status := JobQueued
+	var finishedAt sql.NullTime
+	if retryAt.IsZero() {
+		status = JobFailed
+		retryAt = j.RunAt
+		finishedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	stmt := `update jobs set status = $1, run_at = $2, locked_until = null, last_error = $3, updated_at = $4, finished_at = $5
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt, status, retryAt, lastError, time.Now(), finishedAt, j.ID)
+	return err
+}
+
+// Retry queues the job in the receiver j to run again straight away, with a
+// fresh set of attempts
+func (j *Job) Retry() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, attempts = 0, run_at = $2, locked_until = null, updated_at = $2, finished_at = null
+		where id = $3 and status <> $4`
+
+	result, err := db.ExecContext(ctx, stmt, JobQueued, time.Now(), j.ID, JobRunning)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobRunning
+	}
+	return nil
+}
+
+// Delete removes the job in the receiver j, unless it is running
+func (j *Job) Delete() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from jobs where id = $1 and status <> $2`, j.ID, JobRunning)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobRunning
+	}
+	return nil
+}
+
+// DeleteDone removes the jobs which were done before t, and returns how many
+// there were. Failed jobs are kept until someone deals with them.
+func (j *Job) DeleteDone(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from jobs where status = $1 and finished_at < $2`, JobDone, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetOne returns one job by id
+func (j *Job) GetOne(id int) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from jobs where id = $1`, jobColumns)
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return jobs[0], nil
+}
+
+// GetAll returns the jobs matching filter, newest first
+func (j *Job) GetAll(filter JobFilter) ([]*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.Queue != "" {
+		add("queue = $%d", filter.Queue)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if filter.Type != "" {
+		add("type = $%d", filter.Type)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	query := fmt.Sprintf(`select %s from jobs`, jobColumns)
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by id desc limit %d offset %d", filter.Limit, filter.Offset)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanJobs(rows)
+}
+
+// Counts returns how many jobs each queue has of each status
+func (j *Job) Counts() ([]JobCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select queue, status, count(*) from jobs group by queue, status order by queue, status`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []JobCount
+	for rows.Next() {
+		var c JobCount
+		err := rows.Scan(&c.Queue, &c.Status, &c.Count)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+func scanJobs(rows *sql.Rows) ([]*Job, error) {
+	var jobs []*Job
+
+	for rows.Next() {
+		var job Job
+		err := rows.Scan(
+			&job.ID,
+			&job.Queue,
+			&job.Type,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LockedUntil,
+			&job.LastError,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+			&job.FinishedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	return jobs, rows.Err()
+}
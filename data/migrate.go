@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migrationFiles are the changes made to the schema since db.sql, one file
+// each, applied in the order of their names
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the postgres advisory lock held while migrating, so
+// that two instances started at once do not both apply a migration
+const migrationLockID = 727002
+
+// migrationTimeout is how long applying all pending migrations may take
+const migrationTimeout = 5 * time.Minute
+
+// Migration is one change to the schema, which is applied once
+type Migration struct {
+	Version string
+	SQL     string
+}
+
+// Migrations returns every migration, in the order they are applied
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		body, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: strings.TrimSuffix(entry.Name(), ".sql"),
+			SQL:     string(body),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// PendingMigrations returns the versions of the migrations which have not
+// been applied to the database yet
+func PendingMigrations() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m.Version)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every pending migration in order, each in its own
+// transaction, and returns the versions it applied. It stops at the first
+// migration which fails, leaving the ones before it applied.
+func Migrate() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockID)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+		version character varying(255) not null primary key,
+		applied_at timestamp without time zone not null
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return done, err
+		}
+		_, err = tx.ExecContext(ctx, m.SQL)
+		if err != nil {
+			tx.Rollback()
+			return done, fmt.Errorf("migration %s: %w", m.Version, err)
+		}
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, applied_at) values ($1, $2)`, m.Version, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return done, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// appliedMigrations returns the versions of the migrations which have been
+// applied; none have if there is no schema_migrations table yet
+func appliedMigrations(ctx context.Context) (map[string]bool, error) {
+	applied := make(map[string]bool)
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `select to_regclass('schema_migrations') is not null`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `select version from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	numbers := make(map[string]string)
+	for i, m := range migrations {
+		number, _, ok := strings.Cut(m.Version, "_")
+		if !ok || len(number) != 4 {
+			t.Errorf("migration %s: want a name like 0001_description.sql", m.Version)
+		}
+		if other, ok := numbers[number]; ok {
+			t.Errorf("migrations %s and %s have the same number", other, m.Version)
+		}
+		numbers[number] = m.Version
+		if i > 0 && migrations[i-1].Version >= m.Version {
+			t.Errorf("migration %s is out of order", m.Version)
+		}
+		if strings.TrimSpace(m.SQL) == "" {
+			t.Errorf("migration %s is empty", m.Version)
+		}
+	}
+}
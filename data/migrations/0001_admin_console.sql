@@ -0,0 +1,14 @@
+-- Plans can be archived, so that nobody new subscribes to them, and users are
+-- invoiced for the plans they subscribe to.
+
+ALTER TABLE public.plans ADD COLUMN IF NOT EXISTS archived integer DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS public.invoices (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    plan_id integer REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE SET NULL,
+    amount integer,
+    status character varying(20) DEFAULT 'pending',
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
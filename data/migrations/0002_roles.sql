@@ -0,0 +1,71 @@
+-- Roles and permissions replace the users.is_admin flag, and users who were
+-- admins become superadmins.
+--
+-- The built in roles are given their default permissions here, when they are
+-- created, and never again, so that changes made to role_permissions by hand
+-- survive a re-run. The admin console only assigns roles to users; it cannot
+-- change what a role may do. users.is_admin is no longer read, but is left in
+-- place so that the previous release can still run against the database.
+
+CREATE TABLE IF NOT EXISTS public.roles (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(50) NOT NULL UNIQUE,
+    description character varying(255) DEFAULT '',
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.role_permissions (
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    permission character varying(100) NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE IF NOT EXISTS public.user_roles (
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    created_at timestamp without time zone,
+    PRIMARY KEY (user_id, role_id)
+);
+
+WITH created AS (
+    INSERT INTO public.roles (name, description, created_at, updated_at)
+    VALUES
+        ('support', 'Can view users and invoices', now(), now()),
+        ('finance', 'Can view users and manage and refund invoices', now(), now()),
+        ('superadmin', 'Can do everything, including managing plans and roles', now(), now())
+    ON CONFLICT (name) DO NOTHING
+    RETURNING id, name
+)
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT created.id, defaults.permission
+FROM created
+JOIN (VALUES
+    ('support', 'users.view'),
+    ('support', 'invoices.view'),
+    ('finance', 'users.view'),
+    ('finance', 'invoices.view'),
+    ('finance', 'invoices.manage'),
+    ('finance', 'invoices.refund'),
+    ('superadmin', 'users.view'),
+    ('superadmin', 'users.manage'),
+    ('superadmin', 'subscriptions.manage'),
+    ('superadmin', 'invoices.view'),
+    ('superadmin', 'invoices.manage'),
+    ('superadmin', 'invoices.refund'),
+    ('superadmin', 'plans.manage'),
+    ('superadmin', 'roles.manage')
+) AS defaults (role, permission) ON defaults.role = created.name;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'is_admin') THEN
+        INSERT INTO public.user_roles (user_id, role_id, created_at)
+        SELECT u.id, r.id, now()
+        FROM public.users u, public.roles r
+        WHERE u.is_admin = 1 AND r.name = 'superadmin'
+        ON CONFLICT DO NOTHING;
+    END IF;
+END
+$$;
@@ -0,0 +1,24 @@
+-- Impersonation is recorded in a log of admin actions, and support staff may
+-- impersonate customers.
+
+CREATE TABLE IF NOT EXISTS public.audit_events (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    actor_id integer,
+    target_id integer,
+    action character varying(100),
+    detail text,
+    created_at timestamp without time zone
+);
+
+-- new permissions are granted to the built in roles only if no role has them
+-- yet, so that a permission which an admin has taken away stays away
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT r.id, grants.permission
+FROM public.roles r
+JOIN (VALUES
+    ('support', 'users.impersonate'),
+    ('superadmin', 'users.impersonate'),
+    ('superadmin', 'users.impersonate_write')
+) AS grants (role, permission) ON grants.role = r.name
+WHERE NOT EXISTS (SELECT 1 FROM public.role_permissions rp WHERE rp.permission = grants.permission)
+ON CONFLICT DO NOTHING;
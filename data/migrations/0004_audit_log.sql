@@ -0,0 +1,51 @@
+-- The audit log records the state before and after each change, and where
+-- it came from. Events are hash chained, and can never be changed or removed.
+-- Events logged before this have no hash, and are not part of the chain.
+
+UPDATE public.audit_events SET actor_id = 0 WHERE actor_id IS NULL;
+UPDATE public.audit_events SET target_id = 0 WHERE target_id IS NULL;
+UPDATE public.audit_events SET action = '' WHERE action IS NULL;
+UPDATE public.audit_events SET detail = '' WHERE detail IS NULL;
+UPDATE public.audit_events SET created_at = now() WHERE created_at IS NULL;
+
+ALTER TABLE public.audit_events
+    ALTER COLUMN actor_id SET DEFAULT 0,
+    ALTER COLUMN actor_id SET NOT NULL,
+    ALTER COLUMN target_id SET DEFAULT 0,
+    ALTER COLUMN target_id SET NOT NULL,
+    ALTER COLUMN action SET NOT NULL,
+    ALTER COLUMN detail SET DEFAULT '',
+    ALTER COLUMN detail SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ADD COLUMN IF NOT EXISTS before_state text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS after_state text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip character varying(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS prev_hash character varying(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS hash character varying(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON public.audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_target_id_idx ON public.audit_events (target_id);
+
+CREATE OR REPLACE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append only';
+END;
+$$;
+
+DROP TRIGGER IF EXISTS audit_events_no_update ON public.audit_events;
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE OR DELETE ON public.audit_events
+    FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON public.audit_events;
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON public.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
+
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT r.id, 'audit.view'
+FROM public.roles r
+WHERE r.name = 'superadmin'
+  AND NOT EXISTS (SELECT 1 FROM public.role_permissions rp WHERE rp.permission = 'audit.view')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,12 @@
+-- Password reset and activation links are backed by single use tokens,
+-- stored hashed.
+
+CREATE TABLE IF NOT EXISTS public.user_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    purpose character varying(50) NOT NULL,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
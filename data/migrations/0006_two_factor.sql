@@ -0,0 +1,14 @@
+-- Users may turn on TOTP two factor authentication, and are given recovery
+-- codes, stored hashed, for when they lose their authenticator.
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS totp_secret character varying(64),
+    ADD COLUMN IF NOT EXISTS totp_enabled integer DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS public.recovery_codes (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    code_hash character varying(64) NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
@@ -0,0 +1,5 @@
+-- Email addresses are unique, whatever their case. This fails if there are
+-- already two users whose addresses differ only in case; merge or rename one
+-- of them first.
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON public.users (lower(email));
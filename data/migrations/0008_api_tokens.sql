@@ -0,0 +1,13 @@
+-- Members may create personal API tokens, stored hashed.
+
+CREATE TABLE IF NOT EXISTS public.api_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    name character varying(100) NOT NULL,
+    prefix character varying(20) NOT NULL,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    scopes character varying(255) NOT NULL DEFAULT '',
+    expires_at timestamp without time zone NOT NULL,
+    last_used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
@@ -0,0 +1,38 @@
+-- Webhooks are sent to registered endpoints, and each delivery is queued and
+-- logged.
+
+CREATE TABLE IF NOT EXISTS public.webhook_endpoints (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    url character varying(2048) NOT NULL,
+    description character varying(255) NOT NULL DEFAULT '',
+    secret character varying(100) NOT NULL,
+    events character varying(1000) NOT NULL DEFAULT '',
+    active integer NOT NULL DEFAULT 1,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.webhook_deliveries (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    endpoint_id integer NOT NULL REFERENCES public.webhook_endpoints(id) ON UPDATE RESTRICT ON DELETE CASCADE,
+    event_id character varying(50) NOT NULL,
+    event character varying(100) NOT NULL,
+    payload text NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp without time zone NOT NULL,
+    last_attempt_at timestamp without time zone,
+    response_status integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON public.webhook_deliveries (status, next_attempt_at);
+
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT r.id, 'webhooks.manage'
+FROM public.roles r
+WHERE r.name = 'superadmin'
+  AND NOT EXISTS (SELECT 1 FROM public.role_permissions rp WHERE rp.permission = 'webhooks.manage')
+ON CONFLICT DO NOTHING;
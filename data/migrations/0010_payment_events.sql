@@ -0,0 +1,15 @@
+-- Webhooks received from the payment provider are stored, and processed at
+-- most once each.
+
+CREATE TABLE IF NOT EXISTS public.payment_events (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    event_id character varying(255) NOT NULL UNIQUE,
+    type character varying(100) NOT NULL,
+    payload text NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'received',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    received_at timestamp without time zone NOT NULL,
+    processed_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
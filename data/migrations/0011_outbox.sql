@@ -0,0 +1,17 @@
+-- Emails and events are written to an outbox in the same transaction as the
+-- change which causes them, and relayed from there.
+
+CREATE TABLE IF NOT EXISTS public.outbox (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    kind character varying(20) NOT NULL,
+    name character varying(255) NOT NULL,
+    payload text NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    available_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    delivered_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS outbox_due_idx ON public.outbox (status, available_at);
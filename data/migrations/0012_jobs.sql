@@ -0,0 +1,26 @@
+-- Background work runs from a queue of jobs.
+
+CREATE TABLE IF NOT EXISTS public.jobs (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    queue character varying(50) NOT NULL,
+    type character varying(100) NOT NULL,
+    payload text NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'queued',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL DEFAULT 5,
+    run_at timestamp without time zone NOT NULL,
+    locked_until timestamp without time zone,
+    last_error text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL,
+    finished_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS jobs_due_idx ON public.jobs (queue, status, run_at);
+
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT r.id, 'jobs.manage'
+FROM public.roles r
+WHERE r.name = 'superadmin'
+  AND NOT EXISTS (SELECT 1 FROM public.role_permissions rp WHERE rp.permission = 'jobs.manage')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,23 @@
+-- Recurring maintenance tasks, and a history of their runs.
+
+CREATE TABLE IF NOT EXISTS public.scheduled_tasks (
+    name character varying(100) NOT NULL PRIMARY KEY,
+    schedule character varying(100) NOT NULL,
+    next_run_at timestamp without time zone NOT NULL,
+    locked_by character varying(255) NOT NULL DEFAULT '',
+    locked_until timestamp without time zone,
+    updated_at timestamp without time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS public.task_runs (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    task character varying(100) NOT NULL,
+    instance character varying(255) NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'running',
+    error text NOT NULL DEFAULT '',
+    started_at timestamp without time zone NOT NULL,
+    finished_at timestamp without time zone,
+    duration_ms integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS task_runs_task_idx ON public.task_runs (task, id);
@@ -0,0 +1,4 @@
+-- TOTP secrets are stored encrypted, which makes them longer. Secrets stored
+-- before this are encrypted when the application starts.
+
+ALTER TABLE public.users ALTER COLUMN totp_secret TYPE character varying(255);
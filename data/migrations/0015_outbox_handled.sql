@@ -0,0 +1,9 @@
+-- The subscribers which have handled each event in the outbox, so that an
+-- event some of its subscribers failed on is only retried for those.
+
+CREATE TABLE IF NOT EXISTS public.outbox_handled (
+    message_id integer NOT NULL REFERENCES public.outbox (id) ON DELETE CASCADE,
+    subscriber character varying(100) NOT NULL,
+    handled_at timestamp without time zone NOT NULL,
+    PRIMARY KEY (message_id, subscriber)
+);
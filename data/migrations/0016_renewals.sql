@@ -0,0 +1,22 @@
+-- Subscriptions renew monthly, and plans may start with a free trial.
+-- Subscriptions made before this renew on the next monthly anniversary of
+-- when they were made, rather than all at once.
+
+ALTER TABLE public.plans ADD COLUMN IF NOT EXISTS trial_days integer NOT NULL DEFAULT 0;
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS trial_started_at timestamp without time zone;
+
+ALTER TABLE public.user_plans ADD COLUMN IF NOT EXISTS renews_at timestamp without time zone;
+ALTER TABLE public.user_plans ADD COLUMN IF NOT EXISTS trial_ends_at timestamp without time zone;
+ALTER TABLE public.user_plans ADD COLUMN IF NOT EXISTS trial_reminded_at timestamp without time zone;
+
+UPDATE public.user_plans
+    SET renews_at = coalesce(created_at, now()) + make_interval(months =>
+        (extract(year from age(now(), coalesce(created_at, now()))) * 12
+            + extract(month from age(now(), coalesce(created_at, now()))))::integer + 1)
+    WHERE renews_at IS NULL;
+
+ALTER TABLE public.user_plans ALTER COLUMN renews_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS user_plans_renews_at_idx ON public.user_plans (renews_at);
+CREATE INDEX IF NOT EXISTS user_plans_trial_ends_at_idx ON public.user_plans (trial_ends_at) WHERE trial_reminded_at IS NULL;
@@ -15,8 +15,20 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: User{},
-		Plan: Plan{},
+		User:     User{},
+		Plan:     Plan{},
+		Invoice:  Invoice{},
+		Role:     Role{},
+		Audit:    AuditEvent{},
+		Token:    Token{},
+		APIToken: APIToken{},
+		Webhook:  WebhookEndpoint{},
+		Delivery: WebhookDelivery{},
+		Payment:  PaymentEvent{},
+		Outbox:   OutboxMessage{},
+		Job:      Job{},
+		Task:     ScheduledTask{},
+		TaskRun:  TaskRun{},
 	}
 }
 
@@ -24,6 +36,18 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
-	Plan Plan
+	User     User
+	Plan     Plan
+	Invoice  Invoice
+	Role     Role
+	Audit    AuditEvent
+	Token    Token
+	APIToken APIToken
+	Webhook  WebhookEndpoint
+	Delivery WebhookDelivery
+	Payment  PaymentEvent
+	Outbox   OutboxMessage
+	Job      Job
+	Task     ScheduledTask
+	TaskRun  TaskRun
 }
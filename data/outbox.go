@@ -0,0 +1,261 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"subscription_service/events"
+	"time"
+)
+
+// Kinds of outbox message
+const (
+	OutboxEmail = "email"
+	OutboxEvent = "event"
+)
+
+// Outbox message statuses
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxFailed    = "failed"
+)
+
+// execer runs statements; both *sql.DB and *sql.Tx are one, so that the same
+// code can write inside a transaction or outside one
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// OutboxMessage is the type for something to be sent once a change has been
+// saved, such as an email or an event. Messages are written in the same
+// transaction as the change which causes them, so they are sent if and only
+// if the change was saved, and they survive the application stopping before
+// they are sent. A relay sends them afterwards, at least once each.
+type OutboxMessage struct {
+	ID          int
+	Kind        string
+	Name        string
+	Payload     string
+	Status      string
+	Attempts    int
+	LastError   string
+	AvailableAt time.Time
+	CreatedAt   time.Time
+	DeliveredAt sql.NullTime
+}
+
+// Insert adds a message to the outbox on its own, for messages which are not
+// part of a change to anything else
+func (o *OutboxMessage) Insert(kind, name string, payload any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return enqueue(ctx, db, kind, name, payload)
+}
+
+// enqueue adds a message to the outbox through q, which is usually the
+// transaction making the change the message is about
+func enqueue(ctx context.Context, q execer, kind, name string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into outbox (kind, name, payload, status, attempts, last_error, available_at, created_at)
+		values ($1, $2, $3, $4, 0, '', $5, $5)`
+
+	_, err = q.ExecContext(ctx, stmt, kind, name, string(body), OutboxPending, time.Now())
+	return err
+}
+
+// publish adds event e to the outbox through q
+func publish(ctx context.Context, q execer, e events.Event) error {
+	return enqueue(ctx, q, OutboxEvent, e.EventName(), e)
+}
+
+// DecodeEvent turns the payload of an event message back into the event,
+// delivered from the outbox message with id outboxID
+func DecodeEvent(outboxID int, name, payload string) (events.Event, error) {
+	delivery := Delivery{OutboxID: outboxID}
+	var e events.Event
+	var err error
+	switch name {
+	case UserRegistered{}.EventName():
+		var ev UserRegistered
+		err = json.Unmarshal([]byte(payload), &ev)
+		ev.Delivery = delivery
+		e = ev
+	case SubscriptionChanged{}.EventName():
+		var ev SubscriptionChanged
+		err = json.Unmarshal([]byte(payload), &ev)
+		ev.Delivery = delivery
+		e = ev
+	case InvoiceCreated{}.EventName():
+		var ev InvoiceCreated
+		err = json.Unmarshal([]byte(payload), &ev)
+		ev.Delivery = delivery
+		e = ev
+	case InvoiceStatusChanged{}.EventName():
+		var ev InvoiceStatusChanged
+		err = json.Unmarshal([]byte(payload), &ev)
+		ev.Delivery = delivery
+		e = ev
+	case TrialEnding{}.EventName():
+		var ev TrialEnding
+		err = json.Unmarshal([]byte(payload), &ev)
+		ev.Delivery = delivery
+		e = ev
+	default:
+		return nil, fmt.Errorf("unknown event %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ClaimDue returns up to limit messages which are due to be sent, and holds
+// them for lease, so that other relays leave them alone while they are sent
+func (o *OutboxMessage) ClaimDue(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `select id, kind, name, payload, status, attempts, last_error, available_at, created_at, delivered_at
+		from outbox
+		where status = $1 and available_at <= $2
+		order by id
+		limit $3
+		for update skip locked`
+
+	rows, err := tx.QueryContext(ctx, query, OutboxPending, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*OutboxMessage
+	for rows.Next() {
+		var m OutboxMessage
+		err := rows.Scan(
+			&m.ID,
+			&m.Kind,
+			&m.Name,
+			&m.Payload,
+			&m.Status,
+			&m.Attempts,
+			&m.LastError,
+			&m.AvailableAt,
+			&m.CreatedAt,
+			&m.DeliveredAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, &m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, m := range messages {
+		_, err = tx.ExecContext(ctx, `update outbox set available_at = $1 where id = $2`, time.Now().Add(lease), m.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, tx.Commit()
+}
+
+// Delivered records that the message in the receiver o was sent
+func (o *OutboxMessage) Delivered() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update outbox set status = $1, attempts = attempts + 1, last_error = '', delivered_at = $2
+		where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, OutboxDelivered, time.Now(), o.ID)
+	return err
+}
+
+// HandledBy returns the names of the subscribers which have already handled
+// the event in the receiver o
+func (o *OutboxMessage) HandledBy() (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `select subscriber from outbox_handled where message_id = $1`, o.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	handled := make(map[string]bool)
+	for rows.Next() {
+		var subscriber string
+		err := rows.Scan(&subscriber)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		handled[subscriber] = true
+	}
+	return handled, rows.Err()
+}
+
+// MarkHandled records that subscriber has handled the event in the receiver o,
+// so that it is skipped if the event is sent again
+func (o *OutboxMessage) MarkHandled(subscriber string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into outbox_handled (message_id, subscriber, handled_at) values ($1, $2, $3)
+		on conflict (message_id, subscriber) do nothing`
+
+	_, err := db.ExecContext(ctx, stmt, o.ID, subscriber, time.Now())
+	return err
+}
+
+// Failed records a failed attempt to send the message in the receiver o. It
+// is tried again at retryAt, or given up on if retryAt is zero.
+func (o *OutboxMessage) Failed(lastError string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	status := OutboxPending
+	if retryAt.IsZero() {
+		status = OutboxFailed
+		retryAt = time.Now()
+	}
+
+	stmt := `update outbox set status = $1, attempts = attempts + 1, last_error = $2, available_at = $3
+		where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, status, lastError, retryAt, o.ID)
+	return err
+}
+
+// DeleteDelivered removes the messages which were delivered before t, and returns how many there were
+func (o *OutboxMessage) DeleteDelivered(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from outbox where status = $1 and delivered_at < $2`, OutboxDelivered, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
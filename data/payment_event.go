@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Payment event statuses
+const (
+	PaymentEventReceived   = "received"
+	PaymentEventProcessing = "processing"
+	PaymentEventProcessed  = "processed"
+	PaymentEventIgnored    = "ignored"
+	PaymentEventFailed     = "failed"
+)
+
+// paymentEventClaimTimeout is how long an event may be processing before it
+// is assumed that whoever was processing it died, and it may be claimed again
+const paymentEventClaimTimeout = 5 * time.Minute
+
+// PaymentEvent is the type for one webhook received from the payment
+// provider. The payload is stored exactly as it was received, before anything
+// is done with it, so that it can be looked at or replayed later.
+type PaymentEvent struct {
+	ID          int
+	EventID     string
+	Type        string
+	Payload     string
+	Status      string
+	Attempts    int
+	LastError   string
+	ReceivedAt  time.Time
+	ProcessedAt sql.NullTime
+	UpdatedAt   time.Time
+}
+
+// Record stores an event the first time it is received, and returns it along
+// with whether it was new. An event which has been received before is
+// returned as it is stored, and its payload is not replaced.
+func (p *PaymentEvent) Record(eventID, eventType, payload string) (*PaymentEvent, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into payment_events (event_id, type, payload, status, attempts, last_error, received_at, updated_at)
+		values ($1, $2, $3, $4, 0, '', $5, $5)
+		on conflict (event_id) do nothing
+		returning id`
+
+	var newID int
+	err := db.QueryRowContext(ctx, stmt, eventID, eventType, payload, PaymentEventReceived, time.Now()).Scan(&newID)
+	isNew := true
+	if errors.Is(err, sql.ErrNoRows) {
+		isNew = false
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	event, err := p.GetByEventID(eventID)
+	if err != nil {
+		return nil, false, err
+	}
+	return event, isNew, nil
+}
+
+// GetByEventID returns the event with the id the payment provider gave it
+func (p *PaymentEvent) GetByEventID(eventID string) (*PaymentEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, event_id, type, payload, status, attempts, last_error, received_at, processed_at, updated_at
+		from payment_events where event_id = $1`
+
+	var event PaymentEvent
+	err := db.QueryRowContext(ctx, query, eventID).Scan(
+		&event.ID,
+		&event.EventID,
+		&event.Type,
+		&event.Payload,
+		&event.Status,
+		&event.Attempts,
+		&event.LastError,
+		&event.ReceivedAt,
+		&event.ProcessedAt,
+		&event.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// Claim marks the event in the receiver p as being processed, and reports
+// whether it was claimed. Events which have been processed or ignored, or
+// which somebody else is processing right now, cannot be claimed; events
+// which failed can, so that they are tried again when they are redelivered.
+func (p *PaymentEvent) Claim() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update payment_events set status = $1, attempts = attempts + 1, updated_at = $2
+		where id = $3 and (status in ($4, $5) or (status = $1 and updated_at < $6))`
+
+	result, err := db.ExecContext(ctx, stmt,
+		PaymentEventProcessing,
+		time.Now(),
+		p.ID,
+		PaymentEventReceived,
+		PaymentEventFailed,
+		time.Now().Add(-paymentEventClaimTimeout),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 1 {
+		p.Status = PaymentEventProcessing
+		p.Attempts++
+	}
+	return n == 1, nil
+}
+
+// Finish records the outcome of processing the event in the receiver p
+func (p *PaymentEvent) Finish(status, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update payment_events set status = $1, last_error = $2, processed_at = $3, updated_at = $3
+		where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, status, lastError, time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+
+	p.Status = status
+	p.LastError = lastError
+	return nil
+}
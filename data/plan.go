@@ -2,6 +2,7 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"time"
@@ -13,17 +14,34 @@ type Plan struct {
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	Archived            int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
+	// TrialDays is how long a subscription to the plan is free for, before
+	// its first invoice, for users who have never had a trial or an invoice
+	TrialDays int
 }
 
+// GetAll returns a slice of all plans that are available to subscribe to, sorted by id
 func (p *Plan) GetAll() ([]*Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+	query := `select id, plan_name, plan_amount, archived, trial_days, created_at, updated_at
+	from plans where archived = 0 order by id`
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
+	return p.getAll(query)
+}
+
+// GetAllWithArchived returns a slice of all plans, including archived ones, sorted by id
+func (p *Plan) GetAllWithArchived() ([]*Plan, error) {
+	query := `select id, plan_name, plan_amount, archived, trial_days, created_at, updated_at
 	from plans order by id`
 
+	return p.getAll(query)
+}
+
+func (p *Plan) getAll(query string) ([]*Plan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
@@ -38,6 +56,8 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 			&plan.ID,
 			&plan.PlanName,
 			&plan.PlanAmount,
+			&plan.Archived,
+			&plan.TrialDays,
 			&plan.CreatedAt,
 			&plan.UpdatedAt,
 		)
@@ -59,7 +79,7 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select id, plan_name, plan_amount, archived, trial_days, created_at, updated_at from plans where id = $1`
 
 	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
@@ -68,6 +88,8 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Archived,
+		&plan.TrialDays,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -81,29 +103,349 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 }
 
 // SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
+// values into user_plans table. The subscription is first invoiced when it
+// renews, a month from now.
 func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = subscribeUserToPlan(ctx, tx, user, plan, nextRenewal(time.Now(), time.Now()), sql.NullTime{})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurchasePlan subscribes a user to one plan and issues them an invoice for
+// it, both or neither, and returns the invoice. If the plan has a trial and
+// the user has never had a trial or an invoice, the subscription starts with the trial
+// instead, and is first invoiced when it ends; there is no invoice to return.
+func (p *Plan) PurchasePlan(user User, plan Plan) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if plan.TrialDays > 0 {
+		var eligible bool
+		query := `select not exists(select 1 from invoices where user_id = $1)
+			and not exists(select 1 from users where id = $1 and trial_started_at is not null)`
+		err = tx.QueryRowContext(ctx, query, user.ID).Scan(&eligible)
+		if err != nil {
+			return nil, err
+		}
+		if eligible {
+			_, err = tx.ExecContext(ctx, `update users set trial_started_at = $1 where id = $2`, now, user.ID)
+			if err != nil {
+				return nil, err
+			}
+			trialEndsAt := now.AddDate(0, 0, plan.TrialDays)
+			err = subscribeUserToPlan(ctx, tx, user, plan, trialEndsAt, sql.NullTime{Time: trialEndsAt, Valid: true})
+			if err != nil {
+				return nil, err
+			}
+			return nil, tx.Commit()
+		}
+	}
+
+	err = subscribeUserToPlan(ctx, tx, user, plan, nextRenewal(now, now), sql.NullTime{})
+	if err != nil {
+		return nil, err
+	}
+	invoice := Invoice{
+		UserID:   user.ID,
+		PlanID:   plan.ID,
+		PlanName: plan.PlanName,
+		Amount:   plan.PlanAmount,
+		Status:   InvoicePending,
+	}
+	invoice.ID, err = insertInvoice(ctx, tx, invoice)
+	if err != nil {
+		return nil, err
+	}
+	invoice.AmountFormatted = invoice.AmountForDisplay()
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// subscribeUserToPlan replaces the plan of a user through tx, and publishes
+// SubscriptionChanged. The subscription next renews at renewsAt, and is in
+// a trial until trialEndsAt, if it is set.
+func subscribeUserToPlan(ctx context.Context, tx *sql.Tx, user User, plan Plan, renewsAt time.Time, trialEndsAt sql.NullTime) error {
 	// delete existing plan, if any
 	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	_, err := tx.ExecContext(ctx, stmt, user.ID)
 	if err != nil {
 		return err
 	}
 
 	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
+	stmt = `insert into user_plans (user_id, plan_id, renews_at, trial_ends_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = tx.ExecContext(ctx, stmt, user.ID, plan.ID, renewsAt, trialEndsAt, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	user.Password = ""
+	return publish(ctx, tx, SubscriptionChanged{User: user, Plan: &plan})
+}
+
+// nextRenewal returns the first monthly anniversary of from which is after now
+func nextRenewal(from, now time.Time) time.Time {
+	next := from.AddDate(0, 1, 0)
+	for !next.After(now) {
+		next = next.AddDate(0, 1, 0)
+	}
+	return next
+}
+
+// RenewDue issues the next invoice for up to limit subscriptions which are
+// due to renew, and moves them on to their next renewal, and returns how
+// many it renewed. A subscription which missed several renewals, while
+// nothing was running them, is invoiced once. Deactivated users are not
+// invoiced; their subscriptions renew once they are active again. Several
+// instances may run this at once; each subscription is only renewed by one
+// of them.
+func (p *Plan) RenewDue(limit int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `select up.id, up.user_id, up.plan_id, up.renews_at, p.plan_amount
+		from user_plans up
+		join users u on (u.id = up.user_id)
+		join plans p on (p.id = up.plan_id)
+		where up.renews_at <= $1 and u.user_active = 1
+		order by up.renews_at
+		limit $2
+		for update of up skip locked`
+
+	rows, err := tx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	type renewal struct {
+		id, userID, planID, amount int
+		renewsAt                   time.Time
+	}
+	var renewals []renewal
+	for rows.Next() {
+		var r renewal
+		err := rows.Scan(&r.id, &r.userID, &r.planID, &r.renewsAt, &r.amount)
+		if err != nil {
+			log.Println("Error scanning", err)
+			rows.Close()
+			return 0, err
+		}
+		renewals = append(renewals, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range renewals {
+		_, err = insertInvoice(ctx, tx, Invoice{
+			UserID: r.userID,
+			PlanID: r.planID,
+			Amount: r.amount,
+			Status: InvoicePending,
+		})
+		if err != nil {
+			return 0, err
+		}
+		stmt := `update user_plans set renews_at = $1, updated_at = $2 where id = $3`
+		_, err = tx.ExecContext(ctx, stmt, nextRenewal(r.renewsAt, now), now, r.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(renewals), tx.Commit()
+}
+
+// RemindTrialsEnding publishes TrialEnding for up to limit subscriptions
+// of active users whose trial ends within the given time and which have not
+// been reminded yet, and returns how many there were
+func (p *Plan) RemindTrialsEnding(within time.Duration, limit int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `select up.id, up.trial_ends_at, u.id, u.email, u.first_name, u.last_name,
+			p.id, p.plan_name, p.plan_amount, p.trial_days
+		from user_plans up
+		join users u on (u.id = up.user_id)
+		join plans p on (p.id = up.plan_id)
+		where up.trial_reminded_at is null and up.trial_ends_at > $1 and up.trial_ends_at <= $2
+			and u.user_active = 1
+		order by up.trial_ends_at
+		limit $3
+		for update of up skip locked`
+
+	rows, err := tx.QueryContext(ctx, query, now, now.Add(within), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	var reminders []TrialEnding
+	for rows.Next() {
+		var id int
+		var e TrialEnding
+		var plan Plan
+		err := rows.Scan(
+			&id,
+			&e.EndsAt,
+			&e.User.ID,
+			&e.User.Email,
+			&e.User.FirstName,
+			&e.User.LastName,
+			&plan.ID,
+			&plan.PlanName,
+			&plan.PlanAmount,
+			&plan.TrialDays,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			rows.Close()
+			return 0, err
+		}
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
+		e.Plan = plan
+		ids = append(ids, id)
+		reminders = append(reminders, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, e := range reminders {
+		err = publish(ctx, tx, e)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `update user_plans set trial_reminded_at = $1 where id = $2`, now, ids[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(reminders), tx.Commit()
+}
+
+// Insert inserts a new plan into the database, and returns the ID of the newly inserted row
+func (p *Plan) Insert(plan Plan) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into plans (plan_name, plan_amount, archived, trial_days, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		plan.PlanName,
+		plan.PlanAmount,
+		plan.Archived,
+		plan.TrialDays,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Update updates one plan in the database, using the information
+// stored in the receiver p
+func (p *Plan) Update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set
+		plan_name = $1,
+		plan_amount = $2,
+		archived = $3,
+		trial_days = $4,
+		updated_at = $5
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt,
+		p.PlanName,
+		p.PlanAmount,
+		p.Archived,
+		p.TrialDays,
+		time.Now(),
+		p.ID,
+	)
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
 	if err != nil {
 		return err
 	}
+
 	return nil
 }
 
+// CancelUserPlan removes any plan the user is subscribed to
+func (p *Plan) CancelUserPlan(user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from user_plans where user_id = $1`
+	_, err = tx.ExecContext(ctx, stmt, user.ID)
+	if err != nil {
+		return err
+	}
+	if user.Plan != nil {
+		user.Password = ""
+		err = publish(ctx, tx, SubscriptionChanged{User: user})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // AmountForDisplay formats the price we have in the DB as a currency string
 func (p *Plan) AmountForDisplay() string {
 	amount := float64(p.PlanAmount) / 100.0
@@ -0,0 +1,310 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextRenewal(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		from time.Time
+		now  time.Time
+		want time.Time
+	}{
+		{"new subscription", day(2024, time.March, 5), day(2024, time.March, 5), day(2024, time.April, 5)},
+		{"renewing on time", day(2024, time.April, 5), day(2024, time.April, 5), day(2024, time.May, 5)},
+		{"renewing late", day(2024, time.April, 5), day(2024, time.April, 9), day(2024, time.May, 5)},
+		{"several renewals missed", day(2024, time.January, 5), day(2024, time.April, 9), day(2024, time.May, 5)},
+		{"end of the year", day(2024, time.December, 20), day(2024, time.December, 20), day(2025, time.January, 20)},
+	}
+	for _, tt := range tests {
+		if got := nextRenewal(tt.from, tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenewDue(t *testing.T) {
+	due := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	subscriptions := []struct {
+		id, userID int
+		active     bool
+		renewsAt   time.Time
+	}{
+		{1, 10, true, due},
+		{2, 11, false, due},
+		{3, 12, true, time.Now().Add(time.Hour)},
+	}
+	f := useFakeDB(t, func(query string, args []driver.Value) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "from user_plans up"):
+			var rows [][]driver.Value
+			for _, s := range subscriptions {
+				if s.renewsAt.After(args[0].(time.Time)) || !s.active && strings.Contains(query, "u.user_active = 1") {
+					continue
+				}
+				rows = append(rows, []driver.Value{int64(s.id), int64(s.userID), int64(2), s.renewsAt, int64(1000)})
+			}
+			return rows
+		case strings.Contains(query, "insert into invoices"):
+			return [][]driver.Value{{int64(100)}}
+		}
+		return nil
+	})
+
+	n, err := (&Plan{}).RenewDue(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("renewed %d subscriptions, want 1", n)
+	}
+	invoices := f.run("insert into invoices")
+	if len(invoices) != 1 || invoices[0].args[0] != int64(10) || invoices[0].args[2] != int64(1000) {
+		t.Errorf("got invoices %v, want one to user 10 for 1000", invoices)
+	}
+	if len(f.run("insert into outbox")) != 1 {
+		t.Error("the invoice was not published")
+	}
+	updates := f.run("update user_plans set renews_at")
+	if len(updates) != 1 || updates[0].args[2] != int64(1) {
+		t.Fatalf("got updates %v, want one to subscription 1", updates)
+	}
+	if want := nextRenewal(due, updates[0].args[1].(time.Time)); !updates[0].args[0].(time.Time).Equal(want) {
+		t.Errorf("renews next at %s, want %s", updates[0].args[0], want)
+	}
+	if !f.committed {
+		t.Error("the renewals were not committed")
+	}
+}
+
+func TestPurchasePlanTrial(t *testing.T) {
+	withTrial := Plan{ID: 2, PlanName: "Gold", PlanAmount: 1000, TrialDays: 14}
+	withoutTrial := withTrial
+	withoutTrial.TrialDays = 0
+
+	tests := []struct {
+		name        string
+		plan        Plan
+		eligible    bool
+		wantInvoice bool
+	}{
+		{"first subscription to a plan with a trial", withTrial, true, false},
+		{"had a trial or an invoice before", withTrial, false, true},
+		{"plan without a trial", withoutTrial, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeDB(t, func(query string, args []driver.Value) [][]driver.Value {
+				switch {
+				case strings.Contains(query, "select not exists"):
+					return [][]driver.Value{{tt.eligible}}
+				case strings.Contains(query, "insert into invoices"):
+					return [][]driver.Value{{int64(7)}}
+				}
+				return nil
+			})
+
+			before := time.Now()
+			invoice, err := (&Plan{}).PurchasePlan(User{ID: 5}, tt.plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotInvoice := invoice != nil; gotInvoice != tt.wantInvoice {
+				t.Fatalf("got an invoice %t, want %t", gotInvoice, tt.wantInvoice)
+			}
+			if invoiced := len(f.run("insert into invoices")) > 0; invoiced != tt.wantInvoice {
+				t.Errorf("invoiced %t, want %t", invoiced, tt.wantInvoice)
+			}
+			if started := len(f.run("update users set trial_started_at")) > 0; started == tt.wantInvoice {
+				t.Errorf("trial started %t, want %t", started, !tt.wantInvoice)
+			}
+
+			subscribed := f.run("insert into user_plans")
+			if len(subscribed) != 1 {
+				t.Fatalf("subscribed %d times, want once", len(subscribed))
+			}
+			renewsAt, trialEndsAt := subscribed[0].args[2].(time.Time), subscribed[0].args[3]
+			if tt.wantInvoice {
+				if trialEndsAt != nil || renewsAt.Before(before.AddDate(0, 1, 0)) || renewsAt.After(time.Now().AddDate(0, 1, 0)) {
+					t.Errorf("renews at %s with trial ending %v, want a month from now without a trial", renewsAt, trialEndsAt)
+				}
+				return
+			}
+			if trialEndsAt != renewsAt || renewsAt.Before(before.AddDate(0, 0, 14)) || renewsAt.After(time.Now().AddDate(0, 0, 14)) {
+				t.Errorf("renews at %s with trial ending %v, want both when the 14 day trial ends", renewsAt, trialEndsAt)
+			}
+		})
+	}
+}
+
+func TestRemindTrialsEnding(t *testing.T) {
+	endsAt := time.Now().Add(48 * time.Hour)
+	f := useFakeDB(t, func(query string, args []driver.Value) [][]driver.Value {
+		if !strings.Contains(query, "from user_plans up") {
+			return nil
+		}
+		rows := [][]driver.Value{
+			{int64(1), endsAt, int64(10), "active@example.com", "A", "B", int64(2), "Gold", int64(1000), int64(14)},
+		}
+		if !strings.Contains(query, "u.user_active = 1") {
+			rows = append(rows, []driver.Value{int64(2), endsAt, int64(11), "inactive@example.com", "C", "D", int64(2), "Gold", int64(1000), int64(14)})
+		}
+		return rows
+	})
+
+	n, err := (&Plan{}).RemindTrialsEnding(72*time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("reminded %d users, want 1", n)
+	}
+	published := f.run("insert into outbox")
+	if len(published) != 1 || published[0].args[1] != (TrialEnding{}).EventName() || !strings.Contains(published[0].args[2].(string), "active@example.com") {
+		t.Errorf("got outbox messages %v, want one TrialEnding", published)
+	}
+	reminded := f.run("update user_plans set trial_reminded_at")
+	if len(reminded) != 1 || reminded[0].args[1] != int64(1) {
+		t.Errorf("got %v, want subscription 1 marked as reminded", reminded)
+	}
+}
+
+// fakeDB is a database/sql driver which records the statements run through it
+// and answers queries with the rows returned by respond, so that models can be
+// tested without postgres
+type fakeDB struct {
+	mu         sync.Mutex
+	respond    func(query string, args []driver.Value) [][]driver.Value
+	statements []fakeStatement
+	committed  bool
+}
+
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+var registerFakeDB sync.Once
+
+// fakeDBs holds the databases opened by tests, by name
+var fakeDBs sync.Map
+
+// useFakeDB points the models at a new fakeDB until the test ends
+func useFakeDB(t *testing.T, respond func(query string, args []driver.Value) [][]driver.Value) *fakeDB {
+	registerFakeDB.Do(func() { sql.Register("fakedb", fakeDriver{}) })
+	f := &fakeDB{respond: respond}
+	fakeDBs.Store(t.Name(), f)
+	fake, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = fake
+	t.Cleanup(func() {
+		db = previous
+		_ = fake.Close()
+		fakeDBs.Delete(t.Name())
+	})
+	return f
+}
+
+// run returns the statements run which start with prefix
+func (f *fakeDB) run(prefix string) []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var run []fakeStatement
+	for _, s := range f.statements {
+		if strings.HasPrefix(strings.TrimSpace(s.query), prefix) {
+			run = append(run, s)
+		}
+	}
+	return run
+}
+
+func (f *fakeDB) record(query string, args []driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, fakeStatement{query: query, args: args})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	f, ok := fakeDBs.Load(name)
+	if !ok {
+		return nil, errors.New("no such database " + name)
+	}
+	return f.(*fakeDB), nil
+}
+
+func (f *fakeDB) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{db: f, query: query}, nil
+}
+
+func (f *fakeDB) Close() error              { return nil }
+func (f *fakeDB) Begin() (driver.Tx, error) { return fakeTx{db: f}, nil }
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.committed = true
+	return nil
+}
+
+func (tx fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.record(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.record(s.query, args)
+	return &fakeRows{rows: s.db.respond(s.query, args)}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Permissions which can be granted to a role
+const (
+	PermUsersView           = "users.view"
+	PermUsersManage         = "users.manage"
+	PermSubscriptionsManage = "subscriptions.manage"
+	PermInvoicesView        = "invoices.view"
+	PermInvoicesManage      = "invoices.manage"
+	PermInvoicesRefund      = "invoices.refund"
+	PermPlansManage         = "plans.manage"
+	PermRolesManage         = "roles.manage"
+	PermImpersonate         = "users.impersonate"
+	PermImpersonateWrite    = "users.impersonate_write"
+	PermAuditView           = "audit.view"
+	PermWebhooksManage      = "webhooks.manage"
+	PermJobsManage          = "jobs.manage"
+)
+
+// Built in roles, created by the migrations along with their default permissions
+const (
+	RoleSupport    = "support"
+	RoleFinance    = "finance"
+	RoleSuperAdmin = "superadmin"
+)
+
+// AllPermissions lists every permission known to the application, in the
+// order they are shown in the admin console
+var AllPermissions = []string{
+	PermUsersView,
+	PermUsersManage,
+	PermSubscriptionsManage,
+	PermInvoicesView,
+	PermInvoicesManage,
+	PermInvoicesRefund,
+	PermPlansManage,
+	PermRolesManage,
+	PermImpersonate,
+	PermImpersonateWrite,
+	PermAuditView,
+	PermWebhooksManage,
+	PermJobsManage,
+}
+
+// Role is the type for a named set of permissions which can be assigned to users
+type Role struct {
+	ID          int
+	Name        string
+	Description string
+	Permissions []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// GetAll returns a slice of all roles, with their permissions, sorted by name
+func (r *Role) GetAll() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, name, description, created_at, updated_at from roles order by name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	byID := make(map[int]*Role)
+
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(
+			&role.ID,
+			&role.Name,
+			&role.Description,
+			&role.CreatedAt,
+			&role.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+		byID[role.ID] = &role
+	}
+
+	rows, err = db.QueryContext(ctx, `select role_id, permission from role_permissions order by permission`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roleID int
+		var permission string
+		if err := rows.Scan(&roleID, &permission); err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		if role, ok := byID[roleID]; ok {
+			role.Permissions = append(role.Permissions, permission)
+		}
+	}
+
+	return roles, nil
+}
+
+// SetUserRoles replaces the roles assigned to a user with the roles in roleIDs
+func (r *Role) SetUserRoles(userID int, roleIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from user_roles where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range roleIDs {
+		_, err = tx.ExecContext(ctx, `insert into user_roles (user_id, role_id, created_at) values ($1, $2, $3)`,
+			userID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HasPermission reports whether the role grants the permission p
+func (r *Role) HasPermission(p string) bool {
+	for _, x := range r.Permissions {
+		if x == p {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesForUser returns the roles, with their permissions, assigned to one user
+func rolesForUser(ctx context.Context, userID int) ([]*Role, error) {
+	query := `select r.id, r.name, r.description, r.created_at, r.updated_at, coalesce(rp.permission, '')
+		from user_roles ur
+		join roles r on (r.id = ur.role_id)
+		left join role_permissions rp on (rp.role_id = r.id)
+		where ur.user_id = $1
+		order by r.name`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles, err := scanRoles(rows, nil)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// rolesByUser returns the roles of every user who has at least one, keyed by user id
+func rolesByUser(ctx context.Context) (map[int][]*Role, error) {
+	query := `select ur.user_id, r.id, r.name, r.description, r.created_at, r.updated_at, coalesce(rp.permission, '')
+		from user_roles ur
+		join roles r on (r.id = ur.role_id)
+		left join role_permissions rp on (rp.role_id = r.id)
+		order by ur.user_id, r.name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int][]*Role)
+	_, err = scanRoles(rows, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// scanRoles collapses rows of role/permission pairs into roles. When byUser is
+// not nil, each row is expected to start with a user id, and roles are
+// collected per user into byUser.
+func scanRoles(rows *sql.Rows, byUser map[int][]*Role) ([]*Role, error) {
+	var roles []*Role
+	seen := make(map[[2]int]*Role)
+
+	for rows.Next() {
+		var userID int
+		var role Role
+		var permission string
+
+		dest := []any{&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt, &permission}
+		if byUser != nil {
+			dest = append([]any{&userID}, dest...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		key := [2]int{userID, role.ID}
+		existing, ok := seen[key]
+		if !ok {
+			existing = &role
+			seen[key] = existing
+			if byUser != nil {
+				byUser[userID] = append(byUser[userID], existing)
+			} else {
+				roles = append(roles, existing)
+			}
+		}
+		if permission != "" {
+			existing.Permissions = append(existing.Permissions, permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
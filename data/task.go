@@ -0,0 +1,294 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Task run statuses
+const (
+	TaskRunRunning   = "running"
+	TaskRunSucceeded = "succeeded"
+	TaskRunFailed    = "failed"
+)
+
+// TaskRunStatuses lists every task run status, in the order they are shown
+var TaskRunStatuses = []string{TaskRunRunning, TaskRunSucceeded, TaskRunFailed}
+
+// ScheduledTask is the type for the state of one recurring task, which every
+// instance of the application shares. Whichever instance claims a run of the
+// task holds it until the run is over, so only one instance runs it.
+type ScheduledTask struct {
+	Name        string
+	Schedule    string
+	NextRunAt   time.Time
+	LockedBy    string
+	LockedUntil sql.NullTime
+	UpdatedAt   time.Time
+	// LastRun is the most recent run of the task, if there has been one; only set by GetAll
+	LastRun *TaskRun
+}
+
+// TaskRun is the type for one run of a scheduled task
+type TaskRun struct {
+	ID         int
+	Task       string
+	Instance   string
+	Status     string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt sql.NullTime
+	DurationMS int
+}
+
+// TaskRunFilter narrows down which runs GetAll returns
+type TaskRunFilter struct {
+	Task   string
+	Status string
+	Limit  int
+	Offset int
+}
+
+// Register records a task with its schedule, and when it is next due. A
+// task which is already known keeps the time it is next due, unless its
+// schedule has changed.
+func (t *ScheduledTask) Register(name, schedule string, nextRunAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into scheduled_tasks (name, schedule, next_run_at, locked_by, updated_at)
+		values ($1, $2, $3, '', $4)
+		on conflict (name) do update set
+			next_run_at = case when scheduled_tasks.schedule = excluded.schedule
+				then scheduled_tasks.next_run_at else excluded.next_run_at end,
+			schedule = excluded.schedule,
+			updated_at = excluded.updated_at`
+
+	_, err := db.ExecContext(ctx, stmt, name, schedule, nextRunAt, time.Now())
+	return err
+}
+
+// Claim takes the run of a task which is due for instance, holding it for
+// lease, and reports whether it was taken. A task which is not due, or which
+// another instance holds, cannot be claimed; a hold which has run out can
+// be, since whoever held it has presumably died.
+func (t *ScheduledTask) Claim(name, instance string, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `update scheduled_tasks set locked_by = $1, locked_until = $2, updated_at = $3
+		where name = $4 and next_run_at <= $3 and (locked_until is null or locked_until < $3)`
+
+	result, err := db.ExecContext(ctx, stmt, instance, now.Add(lease), now, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Release lets go of a task instance holds, and sets when it is next due
+func (t *ScheduledTask) Release(name, instance string, nextRunAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update scheduled_tasks set next_run_at = $1, locked_by = '', locked_until = null, updated_at = $2
+		where name = $3 and locked_by = $4`
+
+	_, err := db.ExecContext(ctx, stmt, nextRunAt, time.Now(), name, instance)
+	return err
+}
+
+// RunNow makes a task due straight away
+func (t *ScheduledTask) RunNow(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update scheduled_tasks set next_run_at = $1, updated_at = $1 where name = $2`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), name)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetAll returns every task along with its most recent run, sorted by name
+func (t *ScheduledTask) GetAll() ([]*ScheduledTask, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select t.name, t.schedule, t.next_run_at, t.locked_by, t.locked_until, t.updated_at,
+			coalesce(r.id, 0), coalesce(r.task, ''), coalesce(r.instance, ''), coalesce(r.status, ''), coalesce(r.error, ''),
+			coalesce(r.started_at, t.updated_at), r.finished_at, coalesce(r.duration_ms, 0)
+		from scheduled_tasks t
+		left join lateral (
+			select %s from task_runs where task = t.name order by id desc limit 1
+		) r on true
+		order by t.name`, taskRunColumns)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*ScheduledTask
+	for rows.Next() {
+		var task ScheduledTask
+		var run TaskRun
+		err := rows.Scan(
+			&task.Name,
+			&task.Schedule,
+			&task.NextRunAt,
+			&task.LockedBy,
+			&task.LockedUntil,
+			&task.UpdatedAt,
+			&run.ID,
+			&run.Task,
+			&run.Instance,
+			&run.Status,
+			&run.Error,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.DurationMS,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		if run.ID != 0 {
+			task.LastRun = &run
+		}
+		tasks = append(tasks, &task)
+	}
+
+	return tasks, rows.Err()
+}
+
+const taskRunColumns = `id, task, instance, status, error, started_at, finished_at, duration_ms`
+
+// Start records that instance has started a run of a task, and returns the run
+func (r *TaskRun) Start(task, instance string) (*TaskRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	run := TaskRun{
+		Task:      task,
+		Instance:  instance,
+		Status:    TaskRunRunning,
+		StartedAt: time.Now(),
+	}
+	stmt := `insert into task_runs (task, instance, status, error, started_at, duration_ms)
+		values ($1, $2, $3, '', $4, 0) returning id`
+
+	err := db.QueryRowContext(ctx, stmt, run.Task, run.Instance, run.Status, run.StartedAt).Scan(&run.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Finish records the outcome of the run in the receiver r; a nil runErr means it succeeded
+func (r *TaskRun) Finish(runErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	r.Status = TaskRunSucceeded
+	r.Error = ""
+	if runErr != nil {
+		r.Status = TaskRunFailed
+		r.Error = runErr.Error()
+	}
+	now := time.Now()
+	r.FinishedAt = sql.NullTime{Time: now, Valid: true}
+	r.DurationMS = int(now.Sub(r.StartedAt).Milliseconds())
+
+	stmt := `update task_runs set status = $1, error = $2, finished_at = $3, duration_ms = $4 where id = $5`
+
+	_, err := db.ExecContext(ctx, stmt, r.Status, r.Error, now, r.DurationMS, r.ID)
+	return err
+}
+
+// GetAll returns the runs matching filter, newest first
+func (r *TaskRun) GetAll(filter TaskRunFilter) ([]*TaskRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.Task != "" {
+		add("task = $%d", filter.Task)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	query := fmt.Sprintf(`select %s from task_runs`, taskRunColumns)
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by id desc limit %d offset %d", filter.Limit, filter.Offset)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*TaskRun
+	for rows.Next() {
+		var run TaskRun
+		err := rows.Scan(
+			&run.ID,
+			&run.Task,
+			&run.Instance,
+			&run.Status,
+			&run.Error,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.DurationMS,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		runs = append(runs, &run)
+	}
+
+	return runs, rows.Err()
+}
+
+// DeleteBefore removes the runs which started before t, and returns how many there were
+func (r *TaskRun) DeleteBefore(t time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from task_runs where started_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Token purposes
+const (
+	TokenPasswordReset = "password_reset"
+	TokenActivation    = "activation"
+)
+
+// ErrTokenInvalid is returned when a token does not exist, has expired or has already been used
+var ErrTokenInvalid = errors.New("token is invalid, expired or already used")
+
+// Token is the type for a random, single use secret given to a user, e.g. in
+// a password reset link. Only a hash of the secret is stored.
+type Token struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	Hash      string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+	CreatedAt time.Time
+}
+
+// TokenEmail builds the email which hands the plain text secret of a new
+// token to its user, returning its subject and the payload to put in the outbox
+type TokenEmail func(plainText string) (subject string, payload any)
+
+// Send creates a token for one user and purpose which is valid for ttl, and
+// puts the email which hands it to the user in the outbox, in one transaction,
+// so that no token is saved without its email, nor an email sent without its
+// token
+func (t *Token) Send(userID int, purpose string, ttl time.Duration, email TokenEmail) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = sendToken(ctx, tx, userID, purpose, ttl, email)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sendToken creates a token and queues its email through q, which is the
+// transaction making the change the token belongs to
+func sendToken(ctx context.Context, q execer, userID int, purpose string, ttl time.Duration, email TokenEmail) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	plainText := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	stmt := `insert into user_tokens (user_id, purpose, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err = q.ExecContext(ctx, stmt, userID, purpose, hashToken(plainText), time.Now().Add(ttl), time.Now())
+	if err != nil {
+		return err
+	}
+
+	subject, payload := email(plainText)
+	return enqueue(ctx, q, OutboxEmail, subject, payload)
+}
+
+// GetValid returns the unused, unexpired token for a purpose matching the plain
+// text secret, or ErrTokenInvalid
+func (t *Token) GetValid(purpose, plainText string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, purpose, token_hash, expires_at, used_at, created_at
+		from user_tokens
+		where token_hash = $1 and purpose = $2 and used_at is null and expires_at > $3`
+
+	var token Token
+	row := db.QueryRowContext(ctx, query, hashToken(plainText), purpose, time.Now())
+
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.Hash,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Use marks the token in the receiver t as used. Only one caller can ever use
+// a token; everyone else gets ErrTokenInvalid.
+func (t *Token) Use() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_tokens set used_at = $1 where id = $2 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), t.ID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// DeleteAllForUser removes every token a user has for one purpose
+func (t *Token) DeleteAllForUser(userID int, purpose string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from user_tokens where user_id = $1 and purpose = $2`
+	_, err := db.ExecContext(ctx, stmt, userID, purpose)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteExpired removes the tokens which expired or were used before t, and returns how many there were
+func (t *Token) DeleteExpired(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from user_tokens where expires_at < $1 or used_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func hashToken(plainText string) string {
+	hash := sha256.Sum256([]byte(plainText))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// GetTOTPSecret returns the user's TOTP secret. It is not loaded with the rest
+// of the user, so that it never ends up anywhere it is not needed. It is
+// stored encrypted.
+func (u *User) GetTOTPSecret() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var stored string
+	err := db.QueryRowContext(ctx, `select coalesce(totp_secret, '') from users where id = $1`, u.ID).Scan(&stored)
+	if err != nil {
+		return "", err
+	}
+	if stored == "" {
+		return "", nil
+	}
+
+	return decryptSecret(stored)
+}
+
+// EnableTOTP turns on two factor authentication for the user with the given
+// secret, replacing any recovery codes with the hashes of codes
+func (u *User) EnableTOTP(secret string, codes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	value, err := encryptSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = $1, totp_enabled = 1, updated_at = $2 where id = $3`,
+		value, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`,
+			u.ID, hashToken(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	u.TOTPEnabled = 1
+	return nil
+}
+
+// DisableTOTP turns off two factor authentication, and removes the secret and
+// any recovery codes
+func (u *User) DisableTOTP() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = null, totp_enabled = 0, updated_at = $1 where id = $2`,
+		time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	u.TOTPEnabled = 0
+	return nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used, and
+// reports whether there was one matching code
+func (u *User) UseRecoveryCode(code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), u.ID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RecoveryCodesRemaining returns how many unused recovery codes the user has left
+func (u *User) RecoveryCodesRemaining() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var n int
+	err := db.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1 and used_at is null`, u.ID).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// EncryptTOTPSecrets encrypts any TOTP secrets which were stored before
+// secrets were encrypted, and returns how many it encrypted
+func (u *User) EncryptTOTPSecrets() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout*10)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `select id, totp_secret from users
+		where totp_secret is not null and totp_secret <> '' and totp_secret not like 'enc:%'`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	plain := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			log.Println("Error scanning", err)
+			return 0, err
+		}
+		plain[id] = secret
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for id, secret := range plain {
+		value, err := encryptSecret(secret)
+		if err != nil {
+			return n, err
+		}
+		_, err = db.ExecContext(ctx, `update users set totp_secret = $1 where id = $2 and totp_secret = $3`, value, id, secret)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
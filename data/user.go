@@ -2,24 +2,31 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"time"
+
+	"github.com/jackc/pgconn"
 )
 
+// ErrDuplicateEmail is returned when saving a user whose email address is already taken
+var ErrDuplicateEmail = errors.New("a user with this email address already exists")
+
 // User is the structure which holds one user from the database.
 type User struct {
-	ID        int
-	Email     string
-	FirstName string
-	LastName  string
-	Password  string
-	Active    int
-	IsAdmin   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Plan      *Plan
+	ID          int
+	Email       string
+	FirstName   string
+	LastName    string
+	Password    string
+	Active      int
+	TOTPEnabled int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Plan        *Plan
+	Roles       []*Role
 }
 
 // GetAll returns a slice of all users, sorted by last name
@@ -35,7 +42,7 @@ func (u *User) GetAll() ([]*User, error) {
        	last_name, 
        	password, 
        	user_active, 
-       	is_admin, 
+       	totp_enabled, 
        	created_at, 
        	updated_at
 	from 
@@ -60,7 +67,7 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.Active,
-			&user.IsAdmin,
+			&user.TOTPEnabled,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -72,6 +79,14 @@ func (u *User) GetAll() ([]*User, error) {
 		users = append(users, &user)
 	}
 
+	roles, err := rolesByUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		user.Roles = roles[user.ID]
+	}
+
 	return users, nil
 }
 
@@ -88,13 +103,13 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    last_name, 
 			    password, 
 			    user_active, 
-			    is_admin, 
+			    totp_enabled, 
 			    created_at, 
 			    updated_at 
 			from 
 			    users 
 			where 
-			    email = $1`
+			    lower(email) = lower($1)`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
@@ -106,7 +121,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
-		&user.IsAdmin,
+		&user.TOTPEnabled,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -115,6 +130,11 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		return nil, err
 	}
 
+	user.Roles, err = rolesForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	// get plan, if any
 	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
 			plans p
@@ -144,7 +164,7 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, totp_enabled, created_at, updated_at 
 				from users 
 				where id = $1`
 
@@ -158,7 +178,7 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
-		&user.IsAdmin,
+		&user.TOTPEnabled,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -167,6 +187,11 @@ func (u *User) GetOne(id int) (*User, error) {
 		return nil, err
 	}
 
+	user.Roles, err = rolesForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	// get plan, if any
 	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
 			plans p
@@ -217,6 +242,9 @@ func (u *User) Update() error {
 	)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateEmail
+		}
 		return err
 	}
 
@@ -263,11 +291,66 @@ func (u *User) Insert(user User) (int, error) {
 		return 0, err
 	}
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertUser(ctx, tx, user, hashedPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// Register inserts a new user like Insert, together with a token to activate
+// the account which is valid for activationTTL, and the email which sends it
+// to them. Either all of them are saved, or none are.
+func (u *User) Register(user User, activationTTL time.Duration, email TokenEmail) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertUser(ctx, tx, user, hashedPassword)
+	if err != nil {
+		return 0, err
+	}
+	err = sendToken(ctx, tx, newID, TokenActivation, activationTTL, email)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// insertUser inserts user, with the hash of their password, through tx, and
+// publishes that they registered
+func insertUser(ctx context.Context, tx *sql.Tx, user User, hashedPassword []byte) (int, error) {
 	var newID int
 	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
 		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	err = db.QueryRowContext(ctx, stmt,
+	err := tx.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
@@ -278,9 +361,18 @@ func (u *User) Insert(user User) (int, error) {
 	).Scan(&newID)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicateEmail
+		}
 		return 0, err
 	}
 
+	user.ID = newID
+	user.Password = ""
+	err = publish(ctx, tx, UserRegistered{User: user})
+	if err != nil {
+		return 0, err
+	}
 	return newID, nil
 }
 
@@ -303,6 +395,51 @@ func (u *User) ResetPassword(password string) error {
 	return nil
 }
 
+// HasPermission reports whether any of the user's roles grants the permission p
+func (u *User) HasPermission(p string) bool {
+	for _, r := range u.Roles {
+		if r.HasPermission(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the user has been assigned the role with the given name
+func (u *User) HasRole(name string) bool {
+	for _, r := range u.Roles {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CanManage reports whether u may change or remove the account of other.
+// Anyone with users.manage may manage customers, but the account of a member
+// of staff may only be managed by someone who may manage roles, or whose own
+// roles grant every permission the other's do, so that nobody can take over
+// or lock out an account which outranks their own.
+func (u *User) CanManage(other *User) bool {
+	if !other.IsStaff() || u.HasPermission(PermRolesManage) {
+		return true
+	}
+	for _, r := range other.Roles {
+		for _, p := range r.Permissions {
+			if !u.HasPermission(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsStaff reports whether the user has any role at all, which is what
+// gives access to the admin console
+func (u *User) IsStaff() bool {
+	return len(u.Roles) > 0
+}
+
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the password
 // and hash match, we return true; otherwise, we return false.
@@ -320,3 +457,9 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// isUniqueViolation reports whether err is postgres refusing to store a duplicate value
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,33 @@
+package data
+
+import "testing"
+
+func TestUserCanManage(t *testing.T) {
+	role := func(name string, permissions ...string) *Role {
+		return &Role{Name: name, Permissions: permissions}
+	}
+	support := role(RoleSupport, PermUsersView, PermInvoicesView)
+	manager := role("manager", PermUsersView, PermUsersManage, PermInvoicesView)
+	superadmin := role(RoleSuperAdmin, PermUsersView, PermUsersManage, PermRolesManage, PermPlansManage)
+
+	customer := &User{}
+	tests := []struct {
+		name   string
+		actor  *User
+		target *User
+		want   bool
+	}{
+		{"customer", &User{Roles: []*Role{manager}}, customer, true},
+		{"staff with fewer permissions", &User{Roles: []*Role{manager}}, &User{Roles: []*Role{support}}, true},
+		{"staff with the same permissions", &User{Roles: []*Role{manager}}, &User{Roles: []*Role{manager}}, true},
+		{"superadmin", &User{Roles: []*Role{manager}}, &User{Roles: []*Role{superadmin}}, false},
+		{"staff with a permission the actor lacks", &User{Roles: []*Role{manager}}, &User{Roles: []*Role{role(RoleFinance, PermInvoicesRefund)}}, false},
+		{"permissions spread over several roles", &User{Roles: []*Role{support, role("refunds", PermInvoicesRefund)}}, &User{Roles: []*Role{role(RoleFinance, PermInvoicesView, PermInvoicesRefund)}}, true},
+		{"actor who manages roles", &User{Roles: []*Role{role("roles", PermUsersManage, PermRolesManage)}}, &User{Roles: []*Role{superadmin}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.actor.CanManage(tt.target); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Webhook events
+const (
+	EventUserRegistered       = "user.registered"
+	EventSubscriptionCreated  = "subscription.created"
+	EventSubscriptionChanged  = "subscription.changed"
+	EventSubscriptionCanceled = "subscription.canceled"
+	EventInvoiceCreated       = "invoice.created"
+	EventInvoicePaid          = "invoice.paid"
+	EventInvoiceVoided        = "invoice.voided"
+	EventInvoiceRefunded      = "invoice.refunded"
+)
+
+// WebhookEvents lists every event a webhook endpoint can subscribe to, in the order they are shown
+var WebhookEvents = []string{
+	EventUserRegistered,
+	EventSubscriptionCreated,
+	EventSubscriptionChanged,
+	EventSubscriptionCanceled,
+	EventInvoiceCreated,
+	EventInvoicePaid,
+	EventInvoiceVoided,
+	EventInvoiceRefunded,
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// webhookSecretPrefix starts every webhook signing secret
+const webhookSecretPrefix = "whsec_"
+
+// WebhookEndpoint is the type for a URL which is sent the events it subscribes to
+type WebhookEndpoint struct {
+	ID          int
+	URL         string
+	Description string
+	Secret      string
+	Events      []string
+	Active      int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// GetAll returns all webhook endpoints, oldest first
+func (e *WebhookEndpoint) GetAll() ([]*WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, description, secret, events, active, created_at, updated_at
+		from webhook_endpoints order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []*WebhookEndpoint
+
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+// GetOne returns one webhook endpoint by id
+func (e *WebhookEndpoint) GetOne(id int) (*WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, description, secret, events, active, created_at, updated_at
+		from webhook_endpoints where id = $1`
+
+	return scanWebhookEndpoint(db.QueryRowContext(ctx, query, id))
+}
+
+// Insert registers a new webhook endpoint with a new signing secret, and
+// returns the ID of the newly inserted row
+func (e *WebhookEndpoint) Insert(endpoint WebhookEndpoint) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into webhook_endpoints (url, description, secret, events, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		endpoint.URL,
+		endpoint.Description,
+		secret,
+		strings.Join(endpoint.Events, ","),
+		endpoint.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Update saves the url, description, events and active flag of the endpoint in the receiver e
+func (e *WebhookEndpoint) Update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_endpoints set
+		url = $1,
+		description = $2,
+		events = $3,
+		active = $4,
+		updated_at = $5
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt,
+		e.URL,
+		e.Description,
+		strings.Join(e.Events, ","),
+		e.Active,
+		time.Now(),
+		e.ID,
+	)
+	return err
+}
+
+// RotateSecret gives the endpoint in the receiver e a new signing secret.
+// Deliveries made from then on are signed with the new secret.
+func (e *WebhookEndpoint) RotateSecret() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `update webhook_endpoints set secret = $1, updated_at = $2 where id = $3`,
+		secret, time.Now(), e.ID)
+	if err != nil {
+		return err
+	}
+
+	e.Secret = secret
+	return nil
+}
+
+// Delete removes the endpoint in the receiver e, along with its deliveries
+func (e *WebhookEndpoint) Delete() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from webhook_endpoints where id = $1`, e.ID)
+	return err
+}
+
+// Subscribes reports whether the endpoint is sent event
+func (e *WebhookEndpoint) Subscribes(event string) bool {
+	for _, ev := range e.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func scanWebhookEndpoint(row interface{ Scan(...any) error }) (*WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	var events string
+	err := row.Scan(
+		&endpoint.ID,
+		&endpoint.URL,
+		&endpoint.Description,
+		&endpoint.Secret,
+		&events,
+		&endpoint.Active,
+		&endpoint.CreatedAt,
+		&endpoint.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if events != "" {
+		endpoint.Events = strings.Split(events, ",")
+	}
+	return &endpoint, nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + hex.EncodeToString(b), nil
+}
+
+// WebhookDelivery is the type for one event queued for, or sent to, one
+// webhook endpoint. Every attempt to send it updates the same row, so that
+// the row is also the delivery log.
+type WebhookDelivery struct {
+	ID             int
+	EndpointID     int
+	EndpointURL    string
+	EndpointSecret string
+	EventID        string
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastAttemptAt  sql.NullTime
+	ResponseStatus int
+	LastError      string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// DeliveryFilter narrows down the deliveries returned by WebhookDelivery.GetAll.
+// Zero values are ignored.
+type DeliveryFilter struct {
+	EndpointID int
+	Status     string
+	Event      string
+	Limit      int
+	Offset     int
+}
+
+// Enqueue queues an event for every active endpoint which subscribes to it,
+// and returns how many deliveries were queued. eventID is the same for every
+// endpoint, and for every redelivery, so that receivers can tell repeats apart.
+func (d *WebhookDelivery) Enqueue(eventID, event, payload string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries (endpoint_id, event_id, event, payload, status, attempts,
+			next_attempt_at, response_status, last_error, created_at, updated_at)
+		select id, $1, $2, $3, $4, 0, $5, 0, '', $5, $5
+		from webhook_endpoints
+		where active = 1 and $2 = any(string_to_array(events, ','))`
+
+	result, err := db.ExecContext(ctx, stmt, eventID, event, payload, DeliveryPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// ClaimDue returns up to limit pending deliveries which are due to be sent,
+// and holds them for lease by pushing back their next attempt, so that no
+// other worker picks them up while they are being sent.
+func (d *WebhookDelivery) ClaimDue(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`select %s
+		from webhook_deliveries d
+		join webhook_endpoints e on (e.id = d.endpoint_id)
+		where d.status = $1 and d.next_attempt_at <= $2
+		order by d.next_attempt_at
+		limit $3
+		for update of d skip locked`, deliveryColumns)
+
+	rows, err := tx.QueryContext(ctx, query, DeliveryPending, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanWebhookDeliveries(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, delivery := range deliveries {
+		_, err = tx.ExecContext(ctx, `update webhook_deliveries set next_attempt_at = $1 where id = $2`,
+			time.Now().Add(lease), delivery.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return deliveries, tx.Commit()
+}
+
+// GetAll returns the deliveries matching filter, newest first
+func (d *WebhookDelivery) GetAll(filter DeliveryFilter) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.EndpointID != 0 {
+		add("d.endpoint_id = $%d", filter.EndpointID)
+	}
+	if filter.Status != "" {
+		add("d.status = $%d", filter.Status)
+	}
+	if filter.Event != "" {
+		add("d.event = $%d", filter.Event)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	query := fmt.Sprintf(`select %s
+		from webhook_deliveries d
+		join webhook_endpoints e on (e.id = d.endpoint_id)`, deliveryColumns)
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by d.id desc limit %d offset %d", filter.Limit, filter.Offset)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// GetOne returns one delivery by id
+func (d *WebhookDelivery) GetOne(id int) (*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s
+		from webhook_deliveries d
+		join webhook_endpoints e on (e.id = d.endpoint_id)
+		where d.id = $1`, deliveryColumns)
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return deliveries[0], nil
+}
+
+// Delivered records a successful attempt to send the delivery in the receiver d
+func (d *WebhookDelivery) Delivered(responseStatus int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = $1, attempts = attempts + 1, last_attempt_at = $2,
+		response_status = $3, last_error = '', updated_at = $2
+		where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, DeliveryDelivered, time.Now(), responseStatus, d.ID)
+	return err
+}
+
+// Failed records a failed attempt to send the delivery in the receiver d. It
+// is tried again at retryAt, or given up on if retryAt is zero.
+func (d *WebhookDelivery) Failed(responseStatus int, lastError string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	status := DeliveryPending
+	if retryAt.IsZero() {
+		status = DeliveryFailed
+		retryAt = time.Now()
+	}
+
+	stmt := `update webhook_deliveries set status = $1, attempts = attempts + 1, last_attempt_at = $2,
+		next_attempt_at = $3, response_status = $4, last_error = $5, updated_at = $2
+		where id = $6`
+
+	_, err := db.ExecContext(ctx, stmt, status, time.Now(), retryAt, responseStatus, lastError, d.ID)
+	return err
+}
+
+// Redeliver queues the delivery in the receiver d to be sent again straight
+// away as a new delivery, leaving the log of the original untouched, and
+// returns the ID of the new delivery
+func (d *WebhookDelivery) Redeliver() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into webhook_deliveries (endpoint_id, event_id, event, payload, status, attempts,
+			next_attempt_at, response_status, last_error, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, 0, $6, 0, '', $6, $6) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		d.EndpointID,
+		d.EventID,
+		d.Event,
+		d.Payload,
+		DeliveryPending,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+const deliveryColumns = `d.id, d.endpoint_id, e.url, e.secret, d.event_id, d.event, d.payload, d.status,
+	d.attempts, d.next_attempt_at, d.last_attempt_at, d.response_status, d.last_error, d.created_at, d.updated_at`
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.EndpointID,
+			&delivery.EndpointURL,
+			&delivery.EndpointSecret,
+			&delivery.EventID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.CreatedAt,
+			&delivery.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -114,6 +114,3 @@ ALTER TABLE ONLY public.user_plans
 
 ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
-
-
-
@@ -0,0 +1,147 @@
+// Package events is a small in-process event bus. Code which does something
+// publishes an event saying what happened, and the side effects of it, such
+// as sending email or recording the change elsewhere, subscribe to the event
+// instead of being wired in by hand. Subscribers run each in its own
+// goroutine, tracked by a wait group so that shutting down can wait for them
+// to finish.
+package events
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Event is something which happened. Its name is what subscribers subscribe
+// to, so every type of event needs a name of its own.
+type Event interface {
+	EventName() string
+}
+
+// subscriber is one function subscribed to one event
+type subscriber struct {
+	name   string
+	handle func(Event) error
+}
+
+// Bus delivers published events to their subscribers
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]subscriber
+	wait        *sync.WaitGroup
+	onError     func(subscriber string, e Event, err error)
+}
+
+// New returns a bus which tracks running subscribers in wait, and passes any
+// error a subscriber returns, or panic it raises, to onError
+func New(wait *sync.WaitGroup, onError func(subscriber string, e Event, err error)) *Bus {
+	return &Bus{
+		subscribers: make(map[string][]subscriber),
+		wait:        wait,
+		onError:     onError,
+	}
+}
+
+// Progress records which subscribers have handled an event, so that when an
+// event is dispatched again after some of its subscribers failed, only those
+// run again
+type Progress interface {
+	// Handled reports whether the subscriber has already handled the event
+	Handled(subscriber string) bool
+	// MarkHandled records that the subscriber has handled the event
+	MarkHandled(subscriber string) error
+}
+
+// Subscribe registers handler to run for every event of type T published on
+// b. The name identifies the subscriber in errors, and in the progress of a
+// dispatch, so it must be unique among the subscribers to T.
+func Subscribe[T Event](b *Bus, name string, handler func(T) error) {
+	var zero T
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.subscribers[zero.EventName()] {
+		if s.name == name {
+			panic(fmt.Sprintf("events: %s already has a subscriber named %q", zero.EventName(), name))
+		}
+	}
+	b.subscribers[zero.EventName()] = append(b.subscribers[zero.EventName()], subscriber{
+		name: name,
+		handle: func(e Event) error {
+			return handler(e.(T))
+		},
+	})
+}
+
+// Publish hands e to each of its subscribers, and returns without waiting
+// for them. Failures are passed to the error function of the bus.
+func (b *Bus) Publish(e Event) {
+	for _, s := range b.subscribersOf(e) {
+		b.wait.Add(1)
+		go func(s subscriber) {
+			defer b.wait.Done()
+			err := s.call(e)
+			if err != nil && b.onError != nil {
+				b.onError(s.name, e, err)
+			}
+		}(s)
+	}
+}
+
+// Dispatch hands e to each of its subscribers which progress says has not
+// handled it yet, and waits for all of them. Each subscriber which succeeds is
+// marked as handled. It returns an error if any of them failed; the others
+// are not undone, and are skipped when e is dispatched again with the same
+// progress. progress may be nil, to hand e to every subscriber.
+func (b *Bus) Dispatch(e Event, progress Progress) error {
+	var subscribers []subscriber
+	for _, s := range b.subscribersOf(e) {
+		if progress == nil || !progress.Handled(s.name) {
+			subscribers = append(subscribers, s)
+		}
+	}
+	errs := make([]error, len(subscribers))
+
+	var wg sync.WaitGroup
+	for i, s := range subscribers {
+		wg.Add(1)
+		b.wait.Add(1)
+		go func(i int, s subscriber) {
+			defer b.wait.Done()
+			defer wg.Done()
+			errs[i] = s.call(e)
+			if errs[i] == nil && progress != nil {
+				errs[i] = progress.MarkHandled(s.name)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", subscribers[i].name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d subscribers to %s failed: %s",
+			len(failed), len(subscribers), e.EventName(), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (b *Bus) subscribersOf(e Event) []subscriber {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.subscribers[e.EventName()]
+}
+
+// call runs the subscriber, turning a panic into an error, so that a
+// subscriber which panics cannot take the application down with it
+func (s subscriber) call(e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handle(e)
+}
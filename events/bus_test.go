@@ -0,0 +1,143 @@
+package events
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type tested struct{}
+
+func (tested) EventName() string { return "tested" }
+
+// memoryProgress keeps the progress of a dispatch in memory
+type memoryProgress struct {
+	mu      sync.Mutex
+	handled map[string]bool
+}
+
+func (p *memoryProgress) Handled(subscriber string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.handled[subscriber]
+}
+
+func (p *memoryProgress) MarkHandled(subscriber string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handled[subscriber] = true
+	return nil
+}
+
+func TestDispatchRetriesOnlyFailedSubscribers(t *testing.T) {
+	var wait sync.WaitGroup
+	b := New(&wait, nil)
+
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	failing := map[string]bool{"email": true, "audit": true}
+	subscribe := func(name string) {
+		Subscribe(b, name, func(tested) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs[name]++
+			if failing[name] {
+				return errors.New("unavailable")
+			}
+			return nil
+		})
+	}
+	subscribe("email")
+	subscribe("audit")
+	subscribe("webhooks")
+	Subscribe(b, "panics", func(tested) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs["panics"]++
+		if runs["panics"] == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+
+	progress := &memoryProgress{handled: make(map[string]bool)}
+
+	err := b.Dispatch(tested{}, progress)
+	if err == nil || !strings.Contains(err.Error(), "3 of 4 subscribers") {
+		t.Fatalf("first dispatch: got error %v", err)
+	}
+
+	failing["email"] = false
+	err = b.Dispatch(tested{}, progress)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 subscribers") || !strings.Contains(err.Error(), "audit") {
+		t.Fatalf("second dispatch: got error %v", err)
+	}
+
+	failing["audit"] = false
+	err = b.Dispatch(tested{}, progress)
+	if err != nil {
+		t.Fatalf("third dispatch: got error %v", err)
+	}
+	err = b.Dispatch(tested{}, progress)
+	if err != nil {
+		t.Fatalf("dispatch after every subscriber handled it: got error %v", err)
+	}
+	wait.Wait()
+
+	want := map[string]int{"email": 2, "audit": 3, "webhooks": 1, "panics": 2}
+	for name, n := range want {
+		if runs[name] != n {
+			t.Errorf("%s ran %d times, want %d", name, runs[name], n)
+		}
+	}
+}
+
+func TestDispatchWithoutProgress(t *testing.T) {
+	var wait sync.WaitGroup
+	b := New(&wait, nil)
+	runs := 0
+	Subscribe(b, "counter", func(tested) error {
+		runs++
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		err := b.Dispatch(tested{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 2 {
+		t.Errorf("ran %d times, want 2", runs)
+	}
+}
+
+func TestDispatchMarkFailure(t *testing.T) {
+	var wait sync.WaitGroup
+	b := New(&wait, nil)
+	Subscribe(b, "counter", func(tested) error { return nil })
+
+	err := b.Dispatch(tested{}, failingProgress{})
+	if err == nil {
+		t.Error("a subscriber which could not be marked as handled must count as failed")
+	}
+}
+
+func TestSubscribeTwiceUnderOneName(t *testing.T) {
+	var wait sync.WaitGroup
+	b := New(&wait, nil)
+	Subscribe(b, "counter", func(tested) error { return nil })
+
+	defer func() {
+		if recover() == nil {
+			t.Error("subscribing twice under the same name must panic")
+		}
+	}()
+	Subscribe(b, "counter", func(tested) error { return nil })
+}
+
+type failingProgress struct{}
+
+func (failingProgress) Handled(string) bool      { return false }
+func (failingProgress) MarkHandled(string) error { return errors.New("database is down") }
@@ -0,0 +1,159 @@
+// Package forms validates submitted html forms, collecting an error message
+// per field so that a form can be shown again with what went wrong.
+package forms
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MinPasswordLength is the shortest password we accept
+const MinPasswordLength = 8
+
+// maxPasswordBytes is the most bcrypt will look at; anything longer is silently ignored by it
+const maxPasswordBytes = 72
+
+// Form is a submitted form, and the errors found while validating it
+type Form struct {
+	url.Values
+	Errors errors
+}
+
+// errors holds the validation errors for a form, by field name
+type errors map[string][]string
+
+// Add adds an error message for a field
+func (e errors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Get returns the first error message for a field, or an empty string
+func (e errors) Get(field string) string {
+	es := e[field]
+	if len(es) == 0 {
+		return ""
+	}
+	return es[0]
+}
+
+// New returns a form for the submitted values, which may be nil for an empty form
+func New(data url.Values) *Form {
+	if data == nil {
+		data = url.Values{}
+	}
+	return &Form{
+		Values: data,
+		Errors: errors{},
+	}
+}
+
+// Valid reports whether the form has no errors
+func (f *Form) Valid() bool {
+	return len(f.Errors) == 0
+}
+
+// Trim removes leading and trailing white space from fields
+func (f *Form) Trim(fields ...string) {
+	for _, field := range fields {
+		f.Set(field, strings.TrimSpace(f.Get(field)))
+	}
+}
+
+// Required checks that fields are not blank
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		if strings.TrimSpace(f.Get(field)) == "" {
+			f.Errors.Add(field, "this field is required")
+		}
+	}
+}
+
+// MaxLength checks that a field is no more than n characters long
+func (f *Form) MaxLength(field string, n int) {
+	if utf8.RuneCountInString(f.Get(field)) > n {
+		f.Errors.Add(field, fmt.Sprintf("must be no more than %d characters long", n))
+	}
+}
+
+// IsEmail normalizes a field holding an email address, and checks it is valid
+func (f *Form) IsEmail(field string) {
+	if f.Get(field) == "" {
+		return
+	}
+	email := NormalizeEmail(f.Get(field))
+	f.Set(field, email)
+	if !validEmail(email) {
+		f.Errors.Add(field, "must be a valid email address")
+	}
+}
+
+// Matches checks that two fields have the same value, such as a password and its confirmation
+func (f *Form) Matches(field, other, message string) {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(other, message)
+	}
+}
+
+// Password checks that a field holds an acceptable password. Passwords must
+// not be the same as the value of any of the fields in notLike, so that for
+// example the password cannot be the email address.
+func (f *Form) Password(field string, notLike ...string) {
+	password := f.Get(field)
+	if password == "" {
+		return
+	}
+	if problem := PasswordProblem(password); problem != "" {
+		f.Errors.Add(field, problem)
+		return
+	}
+	for _, other := range notLike {
+		if v := f.Get(other); v != "" && strings.EqualFold(password, v) {
+			f.Errors.Add(field, fmt.Sprintf("password must not be the same as your %s", strings.ReplaceAll(other, "-", " ")))
+			return
+		}
+	}
+}
+
+// NormalizeEmail returns email in the form it is stored in. Addresses are
+// compared without regard to case, so they are kept in lower case.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// PasswordProblem explains why a password is not acceptable, or returns an
+// empty string if it is fine
+func PasswordProblem(password string) string {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return fmt.Sprintf("password must be at least %d characters long", MinPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		// bcrypt counts bytes, so accented letters and symbols count as more than one
+		return fmt.Sprintf("password must be no more than %d bytes long, which is fewer characters if it has accented letters or symbols", maxPasswordBytes)
+	}
+	hasLetter, hasDigit := false, false
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return "password must contain both letters and numbers"
+	}
+	return ""
+}
+
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return false
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	return strings.Contains(domain, ".") && !strings.HasSuffix(domain, ".")
+}
@@ -0,0 +1,79 @@
+package forms
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordProblem(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"acceptable", "correct9horse", ""},
+		{"too short", "abc1234", "at least 8 characters"},
+		{"short in characters but not bytes", "éééé123", "at least 8 characters"},
+		{"longest allowed", strings.Repeat("a", 71) + "1", ""},
+		{"too long", strings.Repeat("a", 72) + "1", "no more than 72 bytes"},
+		// 36 two byte letters are 72 bytes, so one more digit is too many for bcrypt
+		{"too long in bytes but not characters", strings.Repeat("é", 36) + "1", "no more than 72 bytes"},
+		{"no digits", "correcthorse", "letters and numbers"},
+		{"no letters", "1234567890", "letters and numbers"},
+		{"letters from any alphabet", "пароль123", ""},
+	}
+	for _, tt := range tests {
+		got := PasswordProblem(tt.password)
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		wantEmail string
+		wantValid bool
+	}{
+		{"valid", "someone@example.com", "someone@example.com", true},
+		{"normalized", "  Someone@Example.COM ", "someone@example.com", true},
+		{"plus addressing", "someone+bills@example.co.uk", "someone+bills@example.co.uk", true},
+		{"blank is left to Required", "", "", true},
+		{"no at sign", "someone.example.com", "someone.example.com", false},
+		{"no domain", "someone@", "someone@", false},
+		{"domain without a dot", "someone@localhost", "someone@localhost", false},
+		{"domain ending in a dot", "someone@example.", "someone@example.", false},
+		{"display name", "Someone <someone@example.com>", "someone <someone@example.com>", false},
+		{"two addresses", "a@example.com, b@example.com", "a@example.com, b@example.com", false},
+	}
+	for _, tt := range tests {
+		f := New(url.Values{"email": {tt.email}})
+		f.IsEmail("email")
+		if got := f.Get("email"); got != tt.wantEmail {
+			t.Errorf("%s: email is %q, want %q", tt.name, got, tt.wantEmail)
+		}
+		if f.Valid() != tt.wantValid {
+			t.Errorf("%s: valid is %t, want %t", tt.name, f.Valid(), tt.wantValid)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"someone@example.com", "someone@example.com"},
+		{"Someone@Example.com", "someone@example.com"},
+		{" someone@example.com\n", "someone@example.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeEmail(tt.email); got != tt.want {
+			t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
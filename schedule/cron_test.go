@@ -0,0 +1,109 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 8-18/2 1,15 jan-jun mon-fri", true},
+		{"@daily", true},
+		{"@HOURLY", true},
+		{"0 0 * * 7", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"5-1 * * * *", false},
+		{"* * * foo *", false},
+		{"@fortnightly", false},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v", tt.expr, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2024, time.January, 10, 10, 7, 30, 0, time.UTC)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{"every minute", "* * * * *", at(time.January, 10, 10, 8)},
+		{"minute step", "*/15 * * * *", at(time.January, 10, 10, 15)},
+		{"step from a value", "5/20 * * * *", at(time.January, 10, 10, 25)},
+		{"step over a range", "0 9-17/4 * * *", at(time.January, 10, 13, 0)},
+		{"list", "0 3,11 * * *", at(time.January, 10, 11, 0)},
+		{"daily, later today", "30 10 * * *", at(time.January, 10, 10, 30)},
+		{"daily, tomorrow", "0 3 * * *", at(time.January, 11, 3, 0)},
+		{"hourly", "@hourly", at(time.January, 10, 11, 0)},
+		{"monthly", "@monthly", at(time.February, 1, 0, 0)},
+		{"day of week only", "0 0 * * fri", at(time.January, 12, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", at(time.January, 14, 0, 0)},
+		{"sunday as 0", "0 0 * * 0", at(time.January, 14, 0, 0)},
+		{"day of month only", "0 0 20 * *", at(time.January, 20, 0, 0)},
+		// restricting both the day of the month and the day of the week
+		// fires on either, not only on days matching both
+		{"day of month or week, week first", "0 0 20 * fri", at(time.January, 12, 0, 0)},
+		{"day of month or week, month first", "0 0 11 * fri", at(time.January, 11, 0, 0)},
+		{"day of week with day of month *", "0 0 * * mon", at(time.January, 15, 0, 0)},
+		// as in vixie cron, a field starting with * is not restricted, even
+		// with a step, so this is the 1st, 11th, 21st or 31st and a monday
+		{"day of month step with day of week", "0 0 */10 * mon", at(time.March, 11, 0, 0)},
+		{"month names", "0 0 1 mar *", at(time.March, 1, 0, 0)},
+		{"leap day", "0 0 29 feb *", at(time.February, 29, 0, 0)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q after %s: got %s, want %s", tt.name, tt.expr, from, got, tt.want)
+		}
+	}
+}
+
+func TestNextNeverFires(t *testing.T) {
+	for _, expr := range []string{"0 0 30 feb *", "0 0 31 apr,jun,sep,nov *"} {
+		s, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+			t.Errorf("%q: got %s, want the zero time", expr, got)
+		}
+	}
+}
+
+func TestNextKeepsLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	s, err := Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Next(time.Date(2024, time.January, 10, 4, 0, 0, 0, loc))
+	want := time.Date(2024, time.January, 11, 3, 0, 0, 0, loc)
+	if !got.Equal(want) || got.Location() != loc {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
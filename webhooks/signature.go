@@ -0,0 +1,88 @@
+// Package webhooks signs and verifies webhook bodies. The same scheme is used
+// for webhooks this application sends and for those it receives: the
+// signature header reads t=<unix seconds>,v1=<hex signature>, where the
+// signature is the HMAC-SHA256 of "<unix seconds>.<body>" keyed with a
+// secret shared by sender and receiver. Signing the timestamp along with the
+// body lets receivers refuse old webhooks, so that a captured webhook cannot
+// be replayed later.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingSignature is returned when there is no usable signature header
+	ErrMissingSignature = errors.New("webhook signature missing or malformed")
+	// ErrInvalidSignature is returned when no signature matches any of the secrets
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	// ErrStaleSignature is returned when the signed timestamp is too far from now
+	ErrStaleSignature = errors.New("webhook timestamp is outside the allowed tolerance")
+)
+
+// Sign returns the signature header for body sent at timestamp
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac(secret, t, body))
+}
+
+// Verify checks a signature header against body. The header may carry several
+// v1 signatures, and any of secrets may match any of them, so that secrets can
+// be rotated without dropping webhooks. The timestamp must be within
+// tolerance of now, in either direction.
+func Verify(header string, body []byte, secrets []string, tolerance time.Duration, now time.Time) error {
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			sig, err := hex.DecodeString(value)
+			if err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrMissingSignature
+	}
+
+	valid := false
+	for _, secret := range secrets {
+		expected := mac(secret, t, body)
+		for _, sig := range signatures {
+			if hmac.Equal(sig, expected) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrStaleSignature
+	}
+	return nil
+}
+
+func mac(secret, t string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
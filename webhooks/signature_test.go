@@ -0,0 +1,63 @@
+package webhooks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"evt_1","type":"payment.succeeded"}`)
+	signed := Sign("whsec_current", now, body)
+	tolerance := 5 * time.Minute
+
+	// a provider rotating its secret sends a signature for each
+	v1 := signed[strings.Index(signed, "v1="):]
+	rotating := Sign("whsec_new", now, body) + "," + v1
+
+	tests := []struct {
+		name    string
+		header  string
+		body    []byte
+		secrets []string
+		now     time.Time
+		want    error
+	}{
+		{"valid", signed, body, []string{"whsec_current"}, now, nil},
+		{"one of several secrets", signed, body, []string{"whsec_old", "whsec_current"}, now, nil},
+		{"one of several signatures", rotating, body, []string{"whsec_current"}, now, nil},
+		{"spaces in the header", strings.ReplaceAll(signed, ",", ", "), body, []string{"whsec_current"}, now, nil},
+		{"a little late", signed, body, []string{"whsec_current"}, now.Add(4 * time.Minute), nil},
+		{"clock a little behind", signed, body, []string{"whsec_current"}, now.Add(-4 * time.Minute), nil},
+		{"wrong secret", signed, body, []string{"whsec_other"}, now, ErrInvalidSignature},
+		{"no secrets", signed, body, nil, now, ErrInvalidSignature},
+		{"changed body", signed, []byte(`{"id":"evt_1","type":"payment.refunded"}`), []string{"whsec_current"}, now, ErrInvalidSignature},
+		{"changed timestamp", strings.Replace(signed, "t=1700000000", "t=1700000001", 1), body, []string{"whsec_current"}, now, ErrInvalidSignature},
+		{"replayed later", signed, body, []string{"whsec_current"}, now.Add(6 * time.Minute), ErrStaleSignature},
+		{"from the future", signed, body, []string{"whsec_current"}, now.Add(-6 * time.Minute), ErrStaleSignature},
+		{"empty header", "", body, []string{"whsec_current"}, now, ErrMissingSignature},
+		{"no timestamp", v1, body, []string{"whsec_current"}, now, ErrMissingSignature},
+		{"no signature", "t=1700000000", body, []string{"whsec_current"}, now, ErrMissingSignature},
+		{"signature not hex", "t=1700000000,v1=zz", body, []string{"whsec_current"}, now, ErrMissingSignature},
+		{"timestamp not a number", "t=yesterday," + v1, body, []string{"whsec_current"}, now, ErrMissingSignature},
+		{"other scheme only", "t=1700000000,v0=" + strings.TrimPrefix(v1, "v1="), body, []string{"whsec_current"}, now, ErrMissingSignature},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.header, tt.body, tt.secrets, tolerance, tt.now)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// worked out independently with
+	// printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", time.Unix(1700000000, 0), []byte("{}"))
+	want := "t=1700000000,v1=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}